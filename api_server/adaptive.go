@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAdaptiveMin           = 1
+	defaultAdaptiveMax           = 64
+	defaultAdaptiveLatencyTarget = 2 * time.Second
+
+	// adaptiveBackoff is the multiplicative decrease applied on a slow or
+	// failed call.
+	adaptiveBackoff = 0.9
+)
+
+// adaptiveLimiter caps concurrent upstream calls with a limit that follows
+// AIMD: each fast, successful call raises it by 1/limit (about one per
+// round of calls), and each call slower than target, or failing with an
+// overload sign, cuts it by adaptiveBackoff. The limit stays within
+// [min, max]. A nil *adaptiveLimiter is unlimited.
+type adaptiveLimiter struct {
+	min, max float64
+	target   time.Duration
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	// changed is closed and replaced whenever a slot may have opened up.
+	changed chan struct{}
+}
+
+// adaptive is set from config in main.
+var adaptive *adaptiveLimiter
+
+// newAdaptiveLimiter returns nil unless enabled. The limit starts at min.
+func newAdaptiveLimiter(enabled bool, min, max int, target time.Duration) *adaptiveLimiter {
+	if !enabled {
+		adaptiveLimit.Set(0)
+		return nil
+	}
+	l := &adaptiveLimiter{
+		min:     float64(min),
+		max:     float64(max),
+		target:  target,
+		limit:   float64(min),
+		changed: make(chan struct{}),
+	}
+	adaptiveLimit.Set(l.limit)
+	return l
+}
+
+// acquire waits for a slot under the current limit. The returned func gives
+// the slot back and feeds the call's latency and error into the limit.
+func (l *adaptiveLimiter) acquire(ctx context.Context) (func(error), error) {
+	if l == nil {
+		return func(error) {}, nil
+	}
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.mu.Unlock()
+			break
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	start := time.Now()
+	return func(err error) {
+		l.release(time.Since(start), err)
+	}, nil
+}
+
+func (l *adaptiveLimiter) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	switch {
+	case overloaded(err) || (err == nil && latency > l.target):
+		l.limit = max(l.min, l.limit*adaptiveBackoff)
+	case err == nil:
+		l.limit = min(l.max, l.limit+1/l.limit)
+	}
+	adaptiveLimit.Set(l.limit)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// overloaded reports whether err suggests the model host is struggling: a
+// timeout, a 5xx, or a 429. Client cancellations and other 4xx say nothing
+// about upstream load.
+func overloaded(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if _, ok := rateLimitHint(err); ok {
+		return true
+	}
+	if kind, _ := upstreamKind(err); kind == kindTimeout {
+		return true
+	}
+	return countsAsUpstreamFailure(err)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Audit content modes for INFER_AUDIT_CONTENT. Hashes let an auditor prove
+// what was asked and answered without the trail holding user content.
+const (
+	auditContentHash = "hash"
+	auditContentFull = "full"
+)
+
+const defaultAuditBuffer = 4096
+
+var auditRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qna_audit_records_total",
+	Help: "Audit records by outcome: written, dropped (buffer full) or failed (sink error).",
+}, []string{"outcome"})
+
+// auditSettings configures the audit trail; an empty path turns it off.
+type auditSettings struct {
+	path    string
+	content string
+	buffer  int
+}
+
+// loadAuditSettings reads INFER_AUDIT_LOG_FILE, INFER_AUDIT_CONTENT and
+// INFER_AUDIT_BUFFER. The file itself is opened once, in main, so a reload
+// does not reopen it.
+func loadAuditSettings() (auditSettings, error) {
+	a := auditSettings{path: os.Getenv("INFER_AUDIT_LOG_FILE"), content: os.Getenv("INFER_AUDIT_CONTENT")}
+	switch a.content {
+	case "":
+		a.content = auditContentHash
+	case auditContentHash, auditContentFull:
+	default:
+		return a, fmt.Errorf("INFER_AUDIT_CONTENT %q: must be hash or full", a.content)
+	}
+	var err error
+	a.buffer, err = positiveIntEnv("INFER_AUDIT_BUFFER", defaultAuditBuffer)
+	return a, err
+}
+
+// auditRecord is one line of the audit trail. Depending on the content
+// mode it carries either the prompts and response or their SHA-256 hashes.
+// Status is "ok" or the error code the client got.
+type auditRecord struct {
+	Time               time.Time `json:"time"`
+	RequestID          string    `json:"request_id"`
+	ChatID             string    `json:"chat_id"`
+	APIKey             string    `json:"api_key,omitempty"`
+	SystemPrompt       string    `json:"system_prompt,omitempty"`
+	UserPrompt         string    `json:"user_prompt,omitempty"`
+	Response           string    `json:"response,omitempty"`
+	SystemPromptSHA256 string    `json:"system_prompt_sha256,omitempty"`
+	UserPromptSHA256   string    `json:"user_prompt_sha256,omitempty"`
+	ResponseSHA256     string    `json:"response_sha256,omitempty"`
+	LatencyMS          int64     `json:"latency_ms"`
+	Status             string    `json:"status"`
+	Cached             bool      `json:"cached"`
+	Stream             bool      `json:"stream,omitempty"`
+}
+
+// AuditSink stores audit records. Write gets them in the order they were
+// recorded, several at a time when they queue up.
+type AuditSink interface {
+	Write(records []auditRecord) error
+	Close() error
+}
+
+// fileAuditSink appends records as JSON lines to a file that is only ever
+// opened for appending.
+type fileAuditSink struct {
+	f *os.File
+}
+
+func openFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("INFER_AUDIT_LOG_FILE: %w", err)
+	}
+	return &fileAuditSink{f: f}, nil
+}
+
+func (s *fileAuditSink) Write(records []auditRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		enc.Encode(r)
+	}
+	_, err := s.f.Write(buf.Bytes())
+	return err
+}
+
+func (s *fileAuditSink) Close() error {
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// auditEntry is what the request path hands over; turning it into a record,
+// hashing included, happens on the writer goroutine.
+type auditEntry struct {
+	at        time.Time
+	requestID string
+	apiKey    string
+	req       ChatRequest
+	resp      string
+	latency   time.Duration
+	err       error
+	cached    bool
+	stream    bool
+}
+
+// auditLogger hands records to its sink from one background goroutine. The
+// request path never waits on it: when the buffer is full, the record is
+// dropped and counted. A nil *auditLogger records nothing.
+type auditLogger struct {
+	sink    AuditSink
+	content string
+	entries chan auditEntry
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newAuditLogger opens the configured sink and starts the writer, or
+// returns nil when the audit trail is off.
+func newAuditLogger(cfg auditSettings) (*auditLogger, error) {
+	if cfg.path == "" {
+		return nil, nil
+	}
+	sink, err := openFileAuditSink(cfg.path)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLogger{
+		sink:    sink,
+		content: cfg.content,
+		entries: make(chan auditEntry, cfg.buffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// record queues one answered, or failed, query made for ctx.
+func (a *auditLogger) record(ctx context.Context, req ChatRequest, resp string, start time.Time, cached, stream bool, err error) {
+	if a == nil {
+		return
+	}
+	e := auditEntry{
+		at:        start,
+		requestID: requestIDFrom(ctx),
+		apiKey:    apiKeyLabelFrom(ctx),
+		req:       req,
+		resp:      resp,
+		latency:   time.Since(start),
+		err:       err,
+		cached:    cached,
+		stream:    stream,
+	}
+	select {
+	case a.entries <- e:
+	default:
+		auditRecords.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (a *auditLogger) run() {
+	defer close(a.done)
+	for {
+		select {
+		case e := <-a.entries:
+			a.write(e)
+		case <-a.stop:
+			for {
+				select {
+				case e := <-a.entries:
+					a.write(e)
+				default:
+					if err := a.sink.Close(); err != nil {
+						slog.Error("closing audit log", "error", err.Error())
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// write sends e along with whatever else is already queued.
+func (a *auditLogger) write(e auditEntry) {
+	batch := []auditRecord{a.toRecord(e)}
+queued:
+	for len(batch) < cap(a.entries) {
+		select {
+		case more := <-a.entries:
+			batch = append(batch, a.toRecord(more))
+		default:
+			break queued
+		}
+	}
+	if err := a.sink.Write(batch); err != nil {
+		auditRecords.WithLabelValues("failed").Add(float64(len(batch)))
+		slog.Error("writing audit log", "records", len(batch), "error", err.Error())
+		return
+	}
+	auditRecords.WithLabelValues("written").Add(float64(len(batch)))
+}
+
+func (a *auditLogger) toRecord(e auditEntry) auditRecord {
+	r := auditRecord{
+		Time:      e.at.UTC(),
+		RequestID: e.requestID,
+		ChatID:    e.req.ChatID,
+		APIKey:    e.apiKey,
+		LatencyMS: e.latency.Milliseconds(),
+		Status:    "ok",
+		Cached:    e.cached,
+		Stream:    e.stream,
+	}
+	if e.err != nil {
+		r.Status = upstreamErrorCode(e.err)
+	}
+	if a.content == auditContentFull {
+		r.SystemPrompt, r.UserPrompt, r.Response = e.req.SystemPrompt, e.req.UserPrompt, e.resp
+		return r
+	}
+	r.SystemPromptSHA256 = sha256Hex(e.req.SystemPrompt)
+	r.UserPromptSHA256 = sha256Hex(e.req.UserPrompt)
+	if e.err == nil {
+		r.ResponseSHA256 = sha256Hex(e.resp)
+	}
+	return r
+}
+
+// close writes out the queued records and closes the sink. Records made
+// after close are dropped.
+func (a *auditLogger) close() {
+	if a == nil {
+		return
+	}
+	a.stopOnce.Do(func() { close(a.stop) })
+	<-a.done
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
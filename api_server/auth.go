@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiKeyLabelKey = "api_key_label"
+
+// apiKeyLabelCtxKey carries the label into the request context, for work
+// that has no gin context, such as batch queries and the audit trail.
+type apiKeyLabelCtxKey struct{}
+
+func apiKeyLabelFrom(ctx context.Context) string {
+	label, _ := ctx.Value(apiKeyLabelCtxKey{}).(string)
+	return label
+}
+
+// apiKey is a configured credential. Only its digest is kept so comparisons
+// run in constant time regardless of key length.
+type apiKey struct {
+	label  string
+	digest [sha256.Size]byte
+	// quota is the key's own daily quota: 0 when its entry sets none, or
+	// quotaUnlimited.
+	quota int
+}
+
+// loadAPIKeys reads "label:key" entries from INFER_API_KEYS (comma
+// separated) and INFER_API_KEYS_FILE (one per line, # comments). An entry
+// without a label is labelled by its position. A labelled entry may end in
+// ":quota=N" or ":quota=unlimited" to override INFER_DAILY_QUOTA for that
+// key. No keys means auth is off.
+func loadAPIKeys() ([]apiKey, error) {
+	var entries []string
+	if raw := os.Getenv("INFER_API_KEYS"); raw != "" {
+		entries = append(entries, strings.Split(raw, ",")...)
+	}
+	if path := os.Getenv("INFER_API_KEYS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("INFER_API_KEYS_FILE: %w", err)
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("INFER_API_KEYS_FILE: %w", err)
+		}
+	}
+
+	var keys []apiKey
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var quota int
+		if i := strings.LastIndex(entry, quotaSuffix); i >= 0 {
+			var err error
+			if quota, err = parseKeyQuota(entry[i+len(quotaSuffix):]); err != nil {
+				return nil, fmt.Errorf("API key entry %d: %w", len(keys)+1, err)
+			}
+			entry = entry[:i]
+			// Without a label, "label:quota=N" would make the label the key.
+			if !strings.Contains(entry, ":") {
+				return nil, fmt.Errorf("API key entry %d: a quota needs a label:key entry", len(keys)+1)
+			}
+		}
+		label, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			label, key = fmt.Sprintf("key-%d", len(keys)+1), entry
+		}
+		if key == "" {
+			return nil, fmt.Errorf("API key %q has an empty value", label)
+		}
+		keys = append(keys, apiKey{label: label, digest: sha256.Sum256([]byte(key)), quota: quota})
+	}
+	return keys, nil
+}
+
+// presentedKey extracts the client's key from "Authorization: Bearer" or
+// X-API-Key.
+func presentedKey(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	return c.GetHeader("X-API-Key")
+}
+
+// matchAPIKey compares against every configured key so the time taken does
+// not reveal which, if any, matched.
+func matchAPIKey(keys []apiKey, presented string) (string, bool) {
+	digest := sha256.Sum256([]byte(presented))
+	label, found := "", false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(digest[:], k.digest[:]) == 1 {
+			label, found = k.label, true
+		}
+	}
+	return label, found
+}
+
+// requireAPIKey rejects requests without a valid key with 401 and records
+// the key's label for the access log.
+func requireAPIKey(keys []apiKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		presented := presentedKey(c)
+		if presented == "" {
+			abortWithError(c, codeUnauthorized, "missing API key", nil)
+			return
+		}
+		label, ok := matchAPIKey(keys, presented)
+		if !ok {
+			abortWithError(c, codeUnauthorized, "invalid API key", nil)
+			return
+		}
+		c.Set(apiKeyLabelKey, label)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), apiKeyLabelCtxKey{}, label))
+		addLogAttrs(c, "api_key", label)
+		c.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	model := &fakeInferencer{}
+	r, _ := newTestRouter(t, model, map[string]string{"INFER_API_KEYS": "ops:s3cret"})
+	body := map[string]any{"chat_id": "c1", "user_prompt": "hello"}
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{name: "missing", status: http.StatusUnauthorized},
+		{name: "invalid", header: "X-API-Key", value: "guess", status: http.StatusUnauthorized},
+		{name: "bearer without scheme", header: "Authorization", value: "s3cret", status: http.StatusUnauthorized},
+		{name: "bearer", header: "Authorization", value: "Bearer s3cret", status: http.StatusOK},
+		{name: "x-api-key", header: "X-API-Key", value: "s3cret", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := jsonRequest(t, "/chat", body)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := serve(r, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusUnauthorized && errorCode(t, w) != codeUnauthorized {
+				t.Errorf("error code = %q, want %q", errorCode(t, w), codeUnauthorized)
+			}
+		})
+	}
+	if got := model.callCount(); got != 2 {
+		t.Errorf("model called %d times, want 2: only authenticated requests reach it", got)
+	}
+
+	// Probes stay open without a key.
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/healthz", nil)); w.Code != http.StatusOK {
+		t.Errorf("/healthz status = %d without a key, want 200", w.Code)
+	}
+}
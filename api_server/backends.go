@@ -0,0 +1,442 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	backendHeader  = "X-Upstream-Backend"
+	fallbackHeader = "X-Upstream-Fallback"
+)
+
+const (
+	backendFailThreshold  = 3
+	backendHealthInterval = 10 * time.Second
+	backendHealthTimeout  = 3 * time.Second
+
+	// backendStatsWindow is how many recent calls GET /backends reports on.
+	backendStatsWindow = 100
+)
+
+// backend is one model host. It leaves rotation after backendFailThreshold
+// consecutive failures and rejoins once its health route answers again.
+type backend struct {
+	url   string
+	stats *backendStats
+
+	mu       sync.Mutex
+	failures int
+	down     bool
+}
+
+func newBackend(url string) *backend {
+	backendUp.WithLabelValues(url).Set(1)
+	return &backend{url: url, stats: &backendStats{url: url}}
+}
+
+func (b *backend) isDown() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down
+}
+
+// record updates the backend's failure count and stats with the outcome of
+// a call that took elapsed.
+func (b *backend) record(err error, elapsed time.Duration) {
+	b.stats.observe(err, elapsed)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	if !countsAsUpstreamFailure(err) {
+		return
+	}
+	b.failures++
+	if !b.down && b.failures >= backendFailThreshold {
+		b.down = true
+		backendUp.WithLabelValues(b.url).Set(0)
+		slog.Warn("upstream backend removed from rotation", "backend", b.url, "failures", b.failures)
+	}
+}
+
+func (b *backend) markUp() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		slog.Info("upstream backend restored to rotation", "backend", b.url)
+		backendUp.WithLabelValues(b.url).Set(1)
+	}
+	b.down, b.failures = false, 0
+}
+
+// Routing modes for INFER_ROUTING.
+const (
+	routingRoundRobin = "round_robin"
+	routingSticky     = "sticky"
+)
+
+// backendPool spreads calls round-robin across the configured model hosts,
+// or, when sticky, sends each chat_id to the same one. fallback, if set, is
+// only used once the pool itself has failed; it never leaves rotation, but
+// its calls are tracked in fallbackStats.
+type backendPool struct {
+	backends      []*backend
+	fallback      string
+	fallbackStats *backendStats
+	sticky        bool
+	next          atomic.Uint64
+}
+
+func newBackendPool(urls []string, fallback, routing string) *backendPool {
+	p := &backendPool{fallback: fallback, sticky: routing == routingSticky}
+	for _, u := range urls {
+		p.backends = append(p.backends, newBackend(u))
+	}
+	if fallback != "" {
+		p.fallbackStats = &backendStats{url: fallback}
+	}
+	return p
+}
+
+// withURLs returns a pool for urls with p's other settings. Backends whose
+// URL is unchanged keep their health state, and p itself is returned when
+// nothing changed.
+func (p *backendPool) withURLs(urls []string) *backendPool {
+	if slices.Equal(urls, p.urls()) {
+		return p
+	}
+	known := make(map[string]*backend, len(p.backends))
+	for _, b := range p.backends {
+		known[b.url] = b
+	}
+	next := &backendPool{fallback: p.fallback, fallbackStats: p.fallbackStats, sticky: p.sticky}
+	for _, u := range urls {
+		b, ok := known[u]
+		if ok {
+			delete(known, u)
+		} else {
+			b = newBackend(u)
+		}
+		next.backends = append(next.backends, b)
+	}
+	for u := range known {
+		dropBackendMetrics(u)
+	}
+	return next
+}
+
+func (p *backendPool) urls() []string {
+	urls := make([]string, len(p.backends))
+	for i, b := range p.backends {
+		urls[i] = b.url
+	}
+	return urls
+}
+
+// pick returns the next backend in rotation, skipping those that are down.
+// If every backend is down it still returns one rather than failing.
+func (p *backendPool) pick() *backend {
+	n := uint64(len(p.backends))
+	start := p.next.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		if b := p.backends[(start+i)%n]; !b.isDown() {
+			return b
+		}
+	}
+	return p.backends[start%n]
+}
+
+// pickFor returns the backend for attempt (counting from 1) of a call for
+// chatID. In sticky mode the backends are ranked by rendezvous hash of
+// chatID and URL; the first attempt takes the highest-ranked backend that
+// is up, and retries move down the ranking. Without sticky routing or a
+// chat ID it is pick.
+func (p *backendPool) pickFor(chatID string, attempt int) *backend {
+	if !p.sticky || chatID == "" || len(p.backends) == 1 {
+		return p.pick()
+	}
+	ranked := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if !b.isDown() {
+			ranked = append(ranked, b)
+		}
+	}
+	if len(ranked) == 0 {
+		ranked = append(ranked, p.backends...)
+	}
+	slices.SortFunc(ranked, func(a, b *backend) int {
+		return cmp.Compare(rendezvousScore(chatID, b.url), rendezvousScore(chatID, a.url))
+	})
+	return ranked[(attempt-1)%len(ranked)]
+}
+
+// rendezvousScore weighs backend url for chatID. Adding or removing a
+// backend only moves the chats whose top-ranked backend changed.
+func rendezvousScore(chatID, url string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(chatID))
+	h.Write([]byte{0})
+	h.Write([]byte(url))
+	return h.Sum64()
+}
+
+// healthURL is the root of the model host, which it serves as a health
+// check.
+func healthURL(upstream string) (string, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return "", err
+	}
+	u.Path, u.RawQuery, u.Fragment = "/", "", ""
+	return u.String(), nil
+}
+
+// probe issues a GET against the backend's health route.
+func probe(ctx context.Context, upstream string) error {
+	target, err := healthURL(upstream)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	setUpstreamHeaders(req.Header)
+	resp, err := liveFrom(ctx).client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// watchBackends probes the live pool's backends that are out of rotation
+// every backendHealthInterval until ctx is done.
+func watchBackends(ctx context.Context) {
+	t := time.NewTicker(backendHealthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, b := range live.Load().pool.backends {
+			if !b.isDown() {
+				continue
+			}
+			pctx, cancel := context.WithTimeout(ctx, backendHealthTimeout)
+			if err := probe(pctx, b.url); err == nil {
+				b.markUp()
+			}
+			cancel()
+		}
+	}
+}
+
+// backendStats keeps the outcomes of a backend's last backendStatsWindow
+// calls and counts every call in the per-backend metrics. Calls cut short
+// by the caller say nothing about the backend and are left out; 4xx
+// rejections count as answered.
+type backendStats struct {
+	url string
+
+	mu        sync.Mutex
+	recent    [backendStatsWindow]callOutcome
+	calls     int
+	lastErr   string
+	lastErrAt time.Time
+}
+
+type callOutcome struct {
+	failed  bool
+	elapsed time.Duration
+}
+
+func (s *backendStats) observe(err error, elapsed time.Duration) {
+	if s == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	failed := countsAsUpstreamFailure(err)
+	outcome := "ok"
+	switch {
+	case failed:
+		outcome = "error"
+	case err != nil:
+		outcome = "rejected"
+	}
+	backendRequestsTotal.WithLabelValues(s.url, outcome).Inc()
+	backendDuration.WithLabelValues(s.url).Observe(elapsed.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent[s.calls%backendStatsWindow] = callOutcome{failed: failed, elapsed: elapsed}
+	s.calls++
+	if failed {
+		s.lastErr, s.lastErrAt = truncate(err.Error(), maxDecodeSnippetBytes), time.Now()
+	}
+}
+
+// backendStatus is one backend's entry in GET /backends.
+type backendStatus struct {
+	URL                 string     `json:"url"`
+	Role                string     `json:"role"`
+	InRotation          bool       `json:"in_rotation"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	RecentCalls         int        `json:"recent_calls"`
+	RecentErrorRate     float64    `json:"recent_error_rate"`
+	RecentLatencyMS     int64      `json:"recent_latency_ms"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+}
+
+// status fills in the recent-call fields of st from the window.
+func (s *backendStats) status(st *backendStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := min(s.calls, backendStatsWindow)
+	var failed int
+	var total time.Duration
+	for _, o := range s.recent[:n] {
+		if o.failed {
+			failed++
+		}
+		total += o.elapsed
+	}
+	st.RecentCalls = n
+	if n > 0 {
+		st.RecentErrorRate = float64(failed) / float64(n)
+		st.RecentLatencyMS = (total / time.Duration(n)).Milliseconds()
+	}
+	if s.lastErr != "" {
+		at := s.lastErrAt
+		st.LastError, st.LastErrorAt = s.lastErr, &at
+	}
+}
+
+func (b *backend) status() backendStatus {
+	b.mu.Lock()
+	st := backendStatus{URL: b.url, Role: "primary", InRotation: !b.down, ConsecutiveFailures: b.failures}
+	b.mu.Unlock()
+	b.stats.status(&st)
+	return st
+}
+
+// handleBackends lists the live pool's backends, then the fallback, with
+// their rotation state and how their last backendStatsWindow calls went.
+func handleBackends(c *gin.Context) {
+	pool := liveFrom(c.Request.Context()).pool
+	list := make([]backendStatus, 0, len(pool.backends)+1)
+	for _, b := range pool.backends {
+		list = append(list, b.status())
+	}
+	if pool.fallback != "" {
+		st := backendStatus{URL: pool.fallback, Role: "fallback", InRotation: true}
+		pool.fallbackStats.status(&st)
+		list = append(list, st)
+	}
+	c.JSON(http.StatusOK, gin.H{"backends": list, "circuit": breaker.currentState().String()})
+}
+
+type callInfoKey struct{}
+
+// callInfo records which backend answered a call, and any metadata it sent
+// alongside the response, for response headers and meta. raw is the whole
+// upstream body, for raw /chat.
+type callInfo struct {
+	mu       sync.Mutex
+	backend  string
+	fallback bool
+	meta     map[string]any
+	raw      []byte
+}
+
+func (ci *callInfo) setBackend(url string) {
+	if ci == nil {
+		return
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.backend = url
+}
+
+func (ci *callInfo) setFallback() {
+	if ci == nil {
+		return
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.fallback = true
+}
+
+func (ci *callInfo) setMeta(meta map[string]any) {
+	if ci == nil {
+		return
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.meta = meta
+}
+
+func (ci *callInfo) setRaw(body []byte) {
+	if ci == nil {
+		return
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.raw = body
+}
+
+func (ci *callInfo) Backend() string {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return ci.backend
+}
+
+func (ci *callInfo) UsedFallback() bool {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return ci.fallback
+}
+
+func (ci *callInfo) Meta() map[string]any {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return ci.meta
+}
+
+func (ci *callInfo) Raw() []byte {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return ci.raw
+}
+
+// withCallInfo attaches an empty callInfo for upstream calls made with ctx to
+// fill in.
+func withCallInfo(ctx context.Context) (context.Context, *callInfo) {
+	ci := &callInfo{}
+	return context.WithValue(ctx, callInfoKey{}, ci), ci
+}
+
+func callInfoFrom(ctx context.Context) *callInfo {
+	ci, _ := ctx.Value(callInfoKey{}).(*callInfo)
+	return ci
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BatchRequest struct {
+	Queries []ChatRequest `json:"queries"`
+
+	// FailFast stops the batch at the first failed query instead of
+	// running every query regardless.
+	FailFast bool `json:"fail_fast,omitempty"`
+}
+
+const (
+	batchStatusOK      = "ok"
+	batchStatusError   = "error"
+	batchStatusTimeout = "timeout"
+
+	// batchStatusRateLimited marks a query the model host refused with 429;
+	// the client should back off and retry it.
+	batchStatusRateLimited = "rate_limited"
+
+	// batchStatusInvalidJSON marks a JSON-mode query whose responses never
+	// parsed.
+	batchStatusInvalidJSON = "invalid_json"
+
+	// batchStatusCancelled marks a query stopped by cancelling its job.
+	batchStatusCancelled = "cancelled"
+
+	// batchStatusEmpty marks a query whose every answer was blank.
+	batchStatusEmpty = "empty_response"
+
+	// batchStatusSkipped marks a query a fail_fast batch stopped after an
+	// earlier query failed.
+	batchStatusSkipped = "skipped"
+)
+
+// batchResult is the outcome of one query, reported in input order.
+type batchResult struct {
+	ChatID    string `json:"chat_id"`
+	Response  string `json:"response,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Status    string `json:"status"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	// Code is the stable error code of a failed query, as in error
+	// responses.
+	Code string `json:"code,omitempty"`
+
+	// RetryAfterSeconds is the model host's hint for rate_limited queries.
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+
+	Meta *responseMeta `json:"meta,omitempty"`
+}
+
+// failedResult reports err, distinguishing queries cut off by a deadline or
+// a cancellation, refused by upstream rate limiting or answered with
+// invalid JSON.
+func failedResult(err error) batchResult {
+	r := batchResult{Error: publicMessage(err), Status: batchStatusError, Code: upstreamErrorCode(err)}
+	switch r.Code {
+	case codeUpstreamTimeout:
+		r.Status = batchStatusTimeout
+	case codeInvalidJSON:
+		r.Status = batchStatusInvalidJSON
+	case codeClientCancelled:
+		r.Status = batchStatusCancelled
+	case codeEmptyResponse:
+		r.Status = batchStatusEmpty
+	case codeBatchAborted:
+		r.Status = batchStatusSkipped
+	}
+	if wait, ok := rateLimitHint(err); ok {
+		r.Status = batchStatusRateLimited
+		if wait > 0 {
+			r.RetryAfterSeconds = retryAfterSeconds(wait)
+		}
+	}
+	return r
+}
+
+// bindBatch decodes and checks a batch, writing the error response itself
+// when the batch is rejected.
+func (s *server) bindBatch(c *gin.Context) (BatchRequest, bool) {
+	var batchReq BatchRequest
+	if err := bindJSON(c, &batchReq); err != nil {
+		writeError(c, bindError(err))
+		return batchReq, false
+	}
+	return batchReq, s.checkBatch(c, batchReq, nil)
+}
+
+// checkBatch applies the size limit, rate limit, quota, validation and
+// moderation to a decoded batch, writing the error response if it is
+// rejected. Only the queries at indices are charged and checked, or all of
+// them if indices is nil; errors always name the position in batchReq.
+func (s *server) checkBatch(c *gin.Context, batchReq BatchRequest, indices []int) bool {
+	addLogAttrs(c, "batch_size", len(batchReq.Queries))
+	if indices == nil {
+		indices = make([]int, len(batchReq.Queries))
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+
+	if n := len(batchReq.Queries); n > s.maxBatchSize {
+		abortWithError(c, codeBatchTooLarge, fmt.Sprintf("batch has %d queries, maximum is %d", n, s.maxBatchSize), gin.H{
+			"received": n,
+			"maximum":  s.maxBatchSize,
+		})
+		return false
+	}
+
+	if rl := liveFrom(c.Request.Context()).limiter; rl.perQuery() && !rl.allow(c, len(indices)) {
+		return false
+	}
+	if s.quota.perQuery() && !s.quota.allow(c, len(indices)) {
+		return false
+	}
+
+	// Queries shares its backing array with the caller's batch, so this
+	// reaches the queries that will run.
+	for _, i := range indices {
+		s.filters.allowBypass(c, &batchReq.Queries[i])
+	}
+	for _, i := range indices {
+		if errs := validateChatRequest(batchReq.Queries[i], s.maxPromptChars); len(errs) > 0 {
+			abortWithError(c, codeValidationFailed, "invalid query in batch", gin.H{"index": i, "fields": errs})
+			return false
+		}
+		if !s.checkBudget(c, batchReq.Queries[i], gin.H{"index": i}) {
+			return false
+		}
+	}
+	for _, i := range indices {
+		if !s.moderateInput(c, batchReq.Queries[i], gin.H{"index": i}) {
+			return false
+		}
+	}
+	return true
+}
+
+// runBatch answers every query with at most batchConcurrency upstream calls
+// in flight, returning results in input order and the number of cache hits:
+// results[i] is always the answer to queries[i], however the calls were
+// scheduled, shared, chunked or finished. Queries identical in prompts and
+// parameters share a single upstream call.
+// If emit is non-nil it is called, one call at a time, with each query's
+// result as soon as it is known. Once ctx is done, queries not yet started
+// are reported as failed without calling upstream.
+func (s *server) runBatch(ctx context.Context, queries []ChatRequest, emit func(int, batchResult)) ([]batchResult, int64) {
+	ctx = withBatchPath(ctx)
+	ff := failFastFrom(ctx)
+	slot := make(map[string]int)
+	var members [][]int
+	for i, q := range queries {
+		key := cacheKey(q)
+		u, ok := slot[key]
+		if !ok {
+			u = len(members)
+			slot[key] = u
+			members = append(members, nil)
+		}
+		members[u] = append(members[u], i)
+	}
+	// Higher priority queries are dispatched first, in request order within
+	// a priority. Identical queries run at the highest priority any of them
+	// asked for.
+	level := func(positions []int) int {
+		l := priorityLevels - 1
+		for _, i := range positions {
+			l = min(l, priorityLevel(queries[i].Priority))
+		}
+		return l
+	}
+	slices.SortStableFunc(members, func(a, b []int) int { return cmp.Compare(level(a), level(b)) })
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var cacheHits atomic.Int64
+	results := make([]batchResult, len(queries))
+	sem := make(chan struct{}, liveFrom(ctx).batchConcurrency)
+
+	// finish fans a shared result out to every position that asked for it,
+	// applying each query's own filters and max_response_chars.
+	finish := func(u int, r batchResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, i := range members[u] {
+			results[i] = r
+			results[i].ChatID = queries[i].ChatID
+			if r.Status == batchStatusOK {
+				results[i].Response, results[i].Truncated = limitResponse(queries[i], s.filters.apply(queries[i], r.Response))
+			}
+			if emit != nil {
+				emit(i, results[i])
+			}
+		}
+		if r.Status != batchStatusOK {
+			ff.fail(members[u][0], r)
+		} else {
+			stats.coalesced(coalescedBatch, len(members[u])-1, len(r.Response))
+		}
+	}
+	// fail reports err, telling queries cut off by fail-fast from those
+	// the client cancelled.
+	fail := func(err error) batchResult {
+		return failedResult(abortedErr(ctx, err))
+	}
+
+	// run answers the unique query u, whose first position is i.
+	run := func(u, i int, qctx context.Context) {
+		q := queries[i]
+		if l := level(members[u]); l < priorityLevel(q.Priority) {
+			q.Priority = priorityName(l)
+		}
+		batchInflight.Inc()
+		stats.batchQueries.Add(1)
+		defer func() {
+			batchInflight.Dec()
+			stats.batchQueries.Add(-1)
+		}()
+		start := time.Now()
+		upstreamReq, err := s.prompt.apply(liveFrom(qctx).systemPrompt.apply(q))
+		if err != nil {
+			finish(u, fail(err))
+			return
+		}
+		ictx, info := withCallInfo(qctx)
+		resp, cached, err := s.infer(ictx, upstreamReq)
+		if cached {
+			cacheHits.Add(1)
+		}
+		meta := &responseMeta{UpstreamMS: time.Since(start).Milliseconds(), Cached: cached, Upstream: info.Meta()}
+		attrs := append(chatLogAttrs(q), "request_id", requestIDFrom(qctx), "index", i, "upstream_ms", meta.UpstreamMS, "cached", cached)
+		if err != nil {
+			slog.Warn("batch query failed", append(attrs, "error", err.Error())...)
+			r := fail(err)
+			r.Meta = meta
+			finish(u, r)
+		} else {
+			msg := "batch query"
+			logLevel, slow := latencyLevel(meta.UpstreamMS)
+			if slow {
+				msg = "slow batch query"
+				attrs = append(attrs, "slow_threshold_ms", slowRequestThreshold.Milliseconds())
+			}
+			slog.Log(qctx, logLevel, msg, attrs...)
+			finish(u, batchResult{Response: resp, Status: batchStatusOK, Meta: meta})
+		}
+	}
+
+	// Without chunking each unique query takes a slot of its own. With it,
+	// a chunk of them takes one slot and all its queries run together, so
+	// they can meet in one upstream call.
+	step := max(1, s.chunkSize)
+	parentID := requestIDFrom(ctx)
+	for lo := 0; lo < len(members); lo += step {
+		hi := min(lo+step, len(members))
+		if ctx.Err() == nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			for u := lo; u < hi; u++ {
+				finish(u, fail(err))
+			}
+			continue
+		}
+		var chunk *upstreamChunk
+		if s.chunkSize > 0 {
+			chunk = newUpstreamChunk(ctx, hi-lo)
+		}
+		var chunkWG sync.WaitGroup
+		for u := lo; u < hi; u++ {
+			i := members[u][0]
+			qctx := withRequestID(ctx, fmt.Sprintf("%s-%d", parentID, i))
+			wg.Add(1)
+			chunkWG.Add(1)
+			go func(u, i int, qctx context.Context) {
+				defer wg.Done()
+				defer chunkWG.Done()
+				if chunk != nil {
+					var m *chunkMember
+					qctx, m = withChunkMember(qctx, chunk)
+					defer m.leave()
+				}
+				run(u, i, qctx)
+			}(u, i, qctx)
+		}
+		go func() {
+			chunkWG.Wait()
+			<-sem
+		}()
+	}
+
+	wg.Wait()
+	return results, cacheHits.Load()
+}
+
+// clientGone reports whether the client disconnected during the batch, so
+// there is nobody to answer; the request is logged as 499.
+func clientGone(c *gin.Context) bool {
+	if !errors.Is(c.Request.Context().Err(), context.Canceled) {
+		return false
+	}
+	addLogAttrs(c, "client_disconnected", true)
+	c.AbortWithStatus(statusClientClosed)
+	return true
+}
+
+// batchSummary counts outcomes so clients can find the queries to retry
+// without scanning every result.
+type batchSummary struct {
+	Total         int   `json:"total"`
+	Succeeded     int   `json:"succeeded"`
+	Failed        int   `json:"failed"`
+	FailedIndices []int `json:"failed_indices"`
+
+	// Aborted is the failure that stopped a fail_fast batch.
+	Aborted *batchAbort `json:"aborted,omitempty"`
+}
+
+func summarize(results []batchResult) batchSummary {
+	sum := batchSummary{Total: len(results), FailedIndices: []int{}}
+	for i, r := range results {
+		if r.Status == batchStatusOK {
+			sum.Succeeded++
+		} else {
+			sum.Failed++
+			sum.FailedIndices = append(sum.FailedIndices, i)
+		}
+	}
+	return sum
+}
+
+// setTruncatedCount reports how many responses max_response_chars cut.
+func setTruncatedCount(c *gin.Context, results []batchResult) {
+	n := 0
+	for _, r := range results {
+		if r.Truncated {
+			n++
+		}
+	}
+	if n > 0 {
+		c.Header(truncatedHeader, strconv.Itoa(n))
+	}
+}
+
+// handleBatch keeps the original response shape: a list of strings with
+// failures prefixed by "Error: ".
+func (s *server) handleBatch(c *gin.Context) {
+	batchReq, ok := s.bindBatch(c)
+	if !ok {
+		return
+	}
+
+	ctx, ff := withFailFast(c.Request.Context(), batchReq.FailFast)
+	defer ff.stop()
+	results, cacheHits := s.runBatch(ctx, batchReq.Queries, nil)
+	if clientGone(c) {
+		return
+	}
+	responses := make([]string, len(results))
+	for i, r := range results {
+		if r.Status != batchStatusOK {
+			responses[i] = "Error: " + r.Error
+		} else {
+			responses[i] = r.Response
+		}
+	}
+
+	sum := summarize(results)
+	sum.Aborted = ff.aborted()
+	c.Header("X-Cache-Hits", strconv.FormatInt(cacheHits, 10))
+	setTruncatedCount(c, results)
+	c.JSON(http.StatusOK, gin.H{"responses": responses, "summary": sum})
+}
+
+// handleBatchV2 reports each query as a batchResult so failures can be told
+// apart from responses.
+func (s *server) handleBatchV2(c *gin.Context) {
+	batchReq, ok := s.bindBatch(c)
+	if !ok {
+		return
+	}
+
+	ctx, ff := withFailFast(c.Request.Context(), batchReq.FailFast)
+	defer ff.stop()
+	results, cacheHits := s.runBatch(ctx, batchReq.Queries, nil)
+	if clientGone(c) {
+		return
+	}
+	sum := summarize(results)
+	sum.Aborted = ff.aborted()
+	c.Header("X-Cache-Hits", strconv.FormatInt(cacheHits, 10))
+	setTruncatedCount(c, results)
+	c.JSON(http.StatusOK, gin.H{"responses": results, "summary": sum})
+}
+
+// indexedResult tags a streamed result with its position in the batch and
+// how many queries had finished when it was written, counting itself.
+type indexedResult struct {
+	Type      string `json:"type"`
+	Index     int    `json:"index"`
+	Completed int    `json:"completed"`
+	batchResult
+}
+
+// batchStreamEvent is the first ("start") and last ("done") line of a
+// streamed batch; results come in between.
+type batchStreamEvent struct {
+	Type      string        `json:"type"`
+	Total     int           `json:"total"`
+	Completed int           `json:"completed,omitempty"`
+	Summary   *batchSummary `json:"summary,omitempty"`
+}
+
+// handleBatchStream writes one NDJSON line per query as soon as it
+// completes, between a start line carrying the query count and a done line
+// with the totals. If the request deadline passes first, an error line takes
+// the place of the done line. A client disconnect, or a write that fails,
+// cancels the queries still outstanding and suppresses the last line.
+func (s *server) handleBatchStream(c *gin.Context) {
+	batchReq, ok := s.bindBatch(c)
+	if !ok {
+		return
+	}
+
+	total := len(batchReq.Queries)
+	c.Header("Content-Type", mimeNDJSON)
+	c.Header("X-Batch-Total", strconv.Itoa(total))
+	c.Status(http.StatusOK)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	progress := newStreamProgress("ndjson")
+	var writeErr error
+	write := func(line any) {
+		if writeErr != nil {
+			return
+		}
+		data, _ := json.Marshal(line)
+		if _, writeErr = c.Writer.Write(append(data, '\n')); writeErr != nil {
+			cancel()
+			return
+		}
+		c.Writer.Flush()
+		progress.sent(len(data) + 1)
+	}
+	write(batchStreamEvent{Type: "start", Total: total})
+
+	// emit is serialized by runBatch, so completed needs no lock.
+	completed := 0
+	bctx, ff := withFailFast(ctx, batchReq.FailFast)
+	defer ff.stop()
+	results, _ := s.runBatch(bctx, batchReq.Queries, func(i int, r batchResult) {
+		completed++
+		if ctx.Err() != nil {
+			return
+		}
+		write(indexedResult{Type: "result", Index: i, Completed: completed, batchResult: r})
+	})
+	if err := ctx.Err(); err != nil || writeErr != nil {
+		cause := streamCause(c, err)
+		if writeErr != nil {
+			err, cause = writeErr, streamCauseClient
+		}
+		if cause == streamCauseDeadline {
+			line := newAPIError(upstreamErrorCode(err), "batch stream interrupted: "+err.Error(), nil).body(c)
+			line["type"] = "error"
+			line["total"] = total
+			line["completed"] = completed
+			write(line)
+		}
+		progress.interrupted(c, cause, err)
+		return
+	}
+	sum := summarize(results)
+	sum.Aborted = ff.aborted()
+	write(batchStreamEvent{Type: "done", Total: total, Completed: completed, Summary: &sum})
+	progress.finished(c)
+}
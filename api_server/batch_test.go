@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchOf builds a batch of queries with the given user prompts, one
+// chat_id per position.
+func batchOf(prompts ...string) []ChatRequest {
+	queries := make([]ChatRequest, len(prompts))
+	for i, p := range prompts {
+		queries[i] = ChatRequest{ChatID: fmt.Sprintf("chat-%d", i), UserPrompt: p}
+	}
+	return queries
+}
+
+// postBatchV2 sends queries to /chat/batched/v2 and returns its results.
+func postBatchV2(t *testing.T, r http.Handler, queries []ChatRequest) ([]batchResult, *httptest.ResponseRecorder) {
+	t.Helper()
+	w := postJSON(t, r, "/chat/batched/v2", BatchRequest{Queries: queries})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body %s", w.Code, w.Body)
+	}
+	var body struct {
+		Responses []batchResult `json:"responses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(body.Responses) != len(queries) {
+		t.Fatalf("got %d results for %d queries", len(body.Responses), len(queries))
+	}
+	return body.Responses, w
+}
+
+// checkAligned fails t unless every result answers the query at its own
+// position.
+func checkAligned(t *testing.T, queries []ChatRequest, results []batchResult) {
+	t.Helper()
+	for i, r := range results {
+		if r.ChatID != queries[i].ChatID {
+			t.Errorf("results[%d].chat_id = %q, want %q", i, r.ChatID, queries[i].ChatID)
+		}
+		if want := "echo: " + queries[i].UserPrompt; r.Status != batchStatusOK || r.Response != want {
+			t.Errorf("results[%d] = %q (%s), want %q", i, r.Response, r.Status, want)
+		}
+	}
+}
+
+func TestBatchOutOfOrderCompletion(t *testing.T) {
+	const n = 20
+	prompts := make([]string, n)
+	for i := range prompts {
+		prompts[i] = "q" + strconv.Itoa(i)
+	}
+	queries := batchOf(prompts...)
+	for _, concurrency := range []int{1, 4, n} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			var mu sync.Mutex
+			var finished []string
+			// Later queries answer sooner, so with more than one in flight
+			// they finish ahead of the earlier ones.
+			model := &fakeInferencer{answer: func(ctx context.Context, req ChatRequest) (string, error) {
+				i, _ := strconv.Atoi(req.UserPrompt[1:])
+				time.Sleep(time.Duration(n-i) * 2 * time.Millisecond)
+				mu.Lock()
+				finished = append(finished, req.UserPrompt)
+				mu.Unlock()
+				return "echo: " + req.UserPrompt, nil
+			}}
+			r, _ := newTestRouter(t, model, map[string]string{"INFER_BATCH_CONCURRENCY": strconv.Itoa(concurrency)})
+
+			results, _ := postBatchV2(t, r, queries)
+			checkAligned(t, queries, results)
+			if concurrency == n && finished[0] == prompts[0] {
+				t.Errorf("queries finished in request order %v; the test did not reorder them", finished)
+			}
+
+			w := postJSON(t, r, "/chat/batched", BatchRequest{Queries: queries})
+			var body struct {
+				Responses []string `json:"responses"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding /chat/batched response: %v", err)
+			}
+			for i, resp := range body.Responses {
+				if want := "echo: " + prompts[i]; resp != want {
+					t.Errorf("/chat/batched responses[%d] = %q, want %q", i, resp, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchMixedFailures(t *testing.T) {
+	failures := map[string]error{
+		"fail-500":     &UpstreamStatusError{StatusCode: 500, Body: "boom"},
+		"fail-timeout": context.DeadlineExceeded,
+		"fail-empty":   errEmptyResponse,
+	}
+	model := &fakeInferencer{answer: func(ctx context.Context, req ChatRequest) (string, error) {
+		if err, ok := failures[req.UserPrompt]; ok {
+			return "", classifyUpstream(err)
+		}
+		return "echo: " + req.UserPrompt, nil
+	}}
+	r, _ := newTestRouter(t, model, nil)
+
+	queries := batchOf("a", "fail-500", "b", "fail-timeout", "c", "fail-empty", "d")
+	wantCodes := []string{"", codeUpstreamStatus, "", codeUpstreamTimeout, "", codeEmptyResponse, ""}
+	results, _ := postBatchV2(t, r, queries)
+	for i, r := range results {
+		if r.ChatID != queries[i].ChatID {
+			t.Errorf("results[%d].chat_id = %q, want %q", i, r.ChatID, queries[i].ChatID)
+		}
+		if wantCodes[i] == "" {
+			if want := "echo: " + queries[i].UserPrompt; r.Status != batchStatusOK || r.Response != want {
+				t.Errorf("results[%d] = %q (%s), want %q", i, r.Response, r.Status, want)
+			}
+			continue
+		}
+		if r.Status == batchStatusOK || r.Code != wantCodes[i] {
+			t.Errorf("results[%d] = %s %q, want a failure with code %q", i, r.Status, r.Code, wantCodes[i])
+		}
+	}
+}
+
+func TestBatchDuplicates(t *testing.T) {
+	model := &fakeInferencer{}
+	r, _ := newTestRouter(t, model, nil)
+
+	queries := batchOf("a", "b", "a", "c", "b", "a")
+	results, _ := postBatchV2(t, r, queries)
+	checkAligned(t, queries, results)
+	if got := model.callCount(); got != 3 {
+		t.Errorf("model called %d times for 3 distinct queries", got)
+	}
+}
+
+func TestBatchCacheHits(t *testing.T) {
+	model := &fakeInferencer{}
+	r, _ := newTestRouter(t, model, nil)
+
+	postBatchV2(t, r, batchOf("a", "b"))
+	queries := batchOf("b", "c", "a", "d")
+	results, w := postBatchV2(t, r, queries)
+	checkAligned(t, queries, results)
+	if got := w.Header().Get("X-Cache-Hits"); got != "2" {
+		t.Errorf("X-Cache-Hits = %q, want 2", got)
+	}
+	for i, want := range []bool{true, false, true, false} {
+		if got := results[i].Meta != nil && results[i].Meta.Cached; got != want {
+			t.Errorf("results[%d] cached = %v, want %v", i, got, want)
+		}
+	}
+	if got := model.callCount(); got != 4 {
+		t.Errorf("model called %d times, want 4 (2 per batch)", got)
+	}
+}
+
+func TestBatchPriorityReordering(t *testing.T) {
+	model := &fakeInferencer{}
+	r, _ := newTestRouter(t, model, map[string]string{"INFER_BATCH_CONCURRENCY": "1"})
+
+	queries := batchOf("low-0", "normal-1", "high-2", "low-3", "high-4", "normal-5")
+	for i, p := range []string{priorityLow, "", priorityHigh, priorityLow, priorityHigh, priorityNormal} {
+		queries[i].Priority = p
+	}
+	results, _ := postBatchV2(t, r, queries)
+	checkAligned(t, queries, results)
+
+	// One query at a time, so the model sees them in dispatch order.
+	want := []string{"high-2", "high-4", "normal-1", "normal-5", "low-0", "low-3"}
+	if len(model.calls) != len(want) {
+		t.Fatalf("model called %d times, want %d", len(model.calls), len(want))
+	}
+	for i, call := range model.calls {
+		if call.UserPrompt != want[i] {
+			t.Fatalf("dispatch order %v, want %v", prompts(model.calls), want)
+		}
+	}
+}
+
+func prompts(calls []ChatRequest) []string {
+	out := make([]string, len(calls))
+	for i, c := range calls {
+		out[i] = c.UserPrompt
+	}
+	return out
+}
+
+// batchStub is a model host whose /infer/batch answers each query with its
+// echo, holding the first chunk back so later chunks finish first.
+type batchStub struct {
+	mu      sync.Mutex
+	sizes   []int
+	singles int
+}
+
+func (s *batchStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/infer/batch" {
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		s.mu.Lock()
+		s.singles++
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"response": "echo: " + req.UserPrompt})
+		return
+	}
+	var batch upstreamBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.sizes = append(s.sizes, len(batch.Queries))
+	first := len(s.sizes) == 1
+	s.mu.Unlock()
+	if first {
+		time.Sleep(20 * time.Millisecond)
+	}
+	var out upstreamBatch
+	for _, q := range batch.Queries {
+		entry, _ := json.Marshal(map[string]string{"response": "echo: " + q.UserPrompt})
+		out.Responses = append(out.Responses, entry)
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func TestBatchChunking(t *testing.T) {
+	stub := &batchStub{}
+	upstream := httptest.NewServer(stub)
+	defer upstream.Close()
+	r, _ := newTestRouter(t, httpInferencer{}, map[string]string{
+		"INFER_UPSTREAM_URL":        upstream.URL + "/infer",
+		"INFER_UPSTREAM_BATCH_SIZE": "4",
+		"INFER_BATCH_CONCURRENCY":   "3",
+	})
+
+	queries := batchOf("a", "b", "c", "d", "e", "b", "f", "g", "h", "i", "a")
+	results, _ := postBatchV2(t, r, queries)
+	checkAligned(t, queries, results)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	total := 0
+	for _, n := range stub.sizes {
+		if n > 4 {
+			t.Errorf("chunk of %d queries sent upstream, want at most 4", n)
+		}
+		total += n
+	}
+	if total+stub.singles != 9 {
+		t.Errorf("upstream answered %d queries (%d chunked, %d single), want the 9 distinct ones", total+stub.singles, total, stub.singles)
+	}
+	if len(stub.sizes) < 3 {
+		t.Errorf("upstream got %d /infer/batch calls, want at least 3", len(stub.sizes))
+	}
+}
+
+func TestBatchChunkOutlivesAMember(t *testing.T) {
+	stub := &batchStub{}
+	upstream := httptest.NewServer(stub)
+	defer upstream.Close()
+	cfg := testConfig(t, map[string]string{"INFER_UPSTREAM_URL": upstream.URL + "/infer"})
+	installConfig(cfg, newUpstreamTransport(upstreamMaxIdleConnsPerHost))
+	// Anything sent outside the chunk fails, so the answer must come from it.
+	ci := chunkInferencer{next: &fakeInferencer{answer: func(context.Context, ChatRequest) (string, error) {
+		return "", errors.New("sent outside the chunk")
+	}}}
+	chunk := newUpstreamChunk(context.Background(), 2)
+
+	// The first member joins, then gives up before the chunk is complete.
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstCtx, _ = withChunkMember(firstCtx, chunk)
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := ci.Infer(firstCtx, ChatRequest{UserPrompt: "a"})
+		firstErr <- err
+	}()
+	for joined := false; !joined; time.Sleep(time.Millisecond) {
+		chunk.mu.Lock()
+		joined = len(chunk.calls) == 1
+		chunk.mu.Unlock()
+	}
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first member: %v, want %v", err, context.Canceled)
+	}
+
+	secondCtx, second := withChunkMember(context.Background(), chunk)
+	defer second.leave()
+	resp, err := ci.Infer(secondCtx, ChatRequest{UserPrompt: "b"})
+	if err != nil || resp != "echo: b" {
+		t.Errorf("second member = %q, %v; want its answer from the chunk", resp, err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaxBodyBytes = 4 << 20
+
+// limitBody caps how much of a request body handlers may read. Bodies that
+// declare an oversized Content-Length are rejected before any reading.
+func limitBody(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > n {
+			writeError(c, bodyTooLarge(n))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+		c.Next()
+	}
+}
+
+func bodyTooLarge(n int64) apiError {
+	return newAPIError(codeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", n), gin.H{"maximum": n})
+}
+
+// bindError maps a binding failure to a status, so a body cut off by
+// limitBody is reported as 413, and one of the wrong type as 415, rather
+// than as malformed JSON.
+func bindError(err error) apiError {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return bodyTooLarge(maxErr.Limit)
+	}
+	var typeErr *unsupportedMediaTypeError
+	if errors.As(err, &typeErr) {
+		return newAPIError(codeUnsupportedMediaType, typeErr.Error(), nil)
+	}
+	return newAPIError(codeInvalidBody, err.Error(), nil)
+}
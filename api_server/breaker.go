@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// errCircuitOpen is returned without contacting the upstream while the
+// breaker is open.
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// circuitBreaker trips open after threshold consecutive upstream failures,
+// rejects calls for cooldown, then lets a single probe through and closes
+// again if it succeeds.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// breaker guards every upstream call; main replaces it with the configured
+// threshold and cooldown.
+var breaker = newCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown)
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	circuitState.Set(float64(s))
+}
+
+// allow reports whether a call may proceed. In half-open state only one
+// probe is admitted at a time.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+		return nil
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of an admitted call.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !countsAsUpstreamFailure(err) {
+		if err == nil {
+			b.failures = 0
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.setState(breakerOpen)
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// countsAsUpstreamFailure excludes outcomes that say nothing about upstream
+// health: client cancellations, caller-imposed deadlines and 4xx rejections
+// of the request itself. The shared client's own timeout still counts.
+func countsAsUpstreamFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	kind, _ := upstreamKind(err)
+	return kind != kindUpstream4xx
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	var calls atomic.Int64
+	failing.Store(true)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			http.Error(w, "overloaded", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"response": "ok"})
+	}))
+	defer stub.Close()
+	r, _ := newTestRouter(t, httpInferencer{}, map[string]string{
+		"INFER_UPSTREAM_URL":      stub.URL + "/infer",
+		"INFER_MAX_ATTEMPTS":      "1",
+		"INFER_CACHE_SIZE":        "0",
+		"INFER_BREAKER_THRESHOLD": "2",
+		"INFER_BREAKER_COOLDOWN":  "50ms",
+	})
+	chat := func(wantStatus int, wantCode string) {
+		t.Helper()
+		w := postJSON(t, r, "/chat", map[string]any{"chat_id": "c1", "user_prompt": "hello"})
+		if w.Code != wantStatus {
+			t.Fatalf("status = %d, want %d; body %s", w.Code, wantStatus, w.Body)
+		}
+		if wantCode != "" && errorCode(t, w) != wantCode {
+			t.Fatalf("error code = %q, want %q", errorCode(t, w), wantCode)
+		}
+	}
+
+	chat(http.StatusBadGateway, "")
+	chat(http.StatusBadGateway, "")
+	if got := breaker.currentState(); got != breakerOpen {
+		t.Fatalf("state after two failures = %s, want open", got)
+	}
+	chat(http.StatusServiceUnavailable, codeCircuitOpen)
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream called %d times, want 2: an open breaker must not call it", got)
+	}
+
+	// A failed probe after the cooldown opens the breaker again at once.
+	time.Sleep(60 * time.Millisecond)
+	chat(http.StatusBadGateway, "")
+	chat(http.StatusServiceUnavailable, codeCircuitOpen)
+
+	// A successful probe closes it.
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	chat(http.StatusOK, "")
+	if got := breaker.currentState(); got != breakerClosed {
+		t.Errorf("state after a successful probe = %s, want closed", got)
+	}
+	chat(http.StatusOK, "")
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := newCircuitBreaker(1, time.Millisecond)
+	b.record(&UpstreamStatusError{StatusCode: http.StatusBadGateway})
+	time.Sleep(5 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("first call after the cooldown: %v, want a probe", err)
+	}
+	if got := b.currentState(); got != breakerHalfOpen {
+		t.Errorf("state while probing = %s, want half_open", got)
+	}
+	if err := b.allow(); err != errCircuitOpen {
+		t.Errorf("second call while probing = %v, want %v", err, errCircuitOpen)
+	}
+}
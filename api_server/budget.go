@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Units for INFER_PROMPT_BUDGET_UNIT.
+const (
+	budgetUnitChars  = "chars"
+	budgetUnitTokens = "tokens"
+)
+
+// estimateTokens approximates how many tokens a tokenizer like the model's
+// splits s into: about four characters per token for English text, and
+// never fewer than the number of words. It is a budgeting estimate, not an
+// exact count.
+func estimateTokens(s string) int {
+	return max((utf8.RuneCountInString(s)+3)/4, len(strings.Fields(s)))
+}
+
+// measureText sizes s in unit, counting characters as runes.
+func measureText(unit, s string) int {
+	if unit == budgetUnitTokens {
+		return estimateTokens(s)
+	}
+	return utf8.RuneCountInString(s)
+}
+
+// promptBudget caps the combined size of a query's system and user prompts.
+// The zero value has no cap.
+type promptBudget struct {
+	max  int
+	unit string
+}
+
+// loadPromptBudget reads INFER_PROMPT_BUDGET and INFER_PROMPT_BUDGET_UNIT.
+func loadPromptBudget() (promptBudget, error) {
+	var b promptBudget
+	var err error
+	if b.max, err = nonNegativeIntEnv("INFER_PROMPT_BUDGET", 0); err != nil {
+		return b, err
+	}
+	switch b.unit = os.Getenv("INFER_PROMPT_BUDGET_UNIT"); b.unit {
+	case "":
+		b.unit = budgetUnitTokens
+	case budgetUnitChars, budgetUnitTokens:
+	default:
+		return b, fmt.Errorf("INFER_PROMPT_BUDGET_UNIT %q: must be chars or tokens", b.unit)
+	}
+	return b, nil
+}
+
+// measure returns the size of req's prompts as the client sent them, before
+// any template or history is added.
+func (b promptBudget) measure(req ChatRequest) int {
+	return measureText(b.unit, req.SystemPrompt) + measureText(b.unit, req.UserPrompt)
+}
+
+// exceeded reports req's size and whether it is over the budget.
+func (b promptBudget) exceeded(req ChatRequest) (int, bool) {
+	if b.max == 0 {
+		return 0, false
+	}
+	n := b.measure(req)
+	return n, n > b.max
+}
+
+func (b promptBudget) message(n int) string {
+	return fmt.Sprintf("prompts measure %d %s, over the budget of %d", n, b.unit, b.max)
+}
+
+// checkBudget writes a 400 with the measured size, plus any extra fields,
+// if req's prompts exceed the budget.
+func (s *server) checkBudget(c *gin.Context, req ChatRequest, extra gin.H) bool {
+	n, over := s.budget.exceeded(req)
+	if !over {
+		return true
+	}
+	addLogAttrs(c, "prompt_size", n, "prompt_budget", s.budget.max)
+	details := gin.H{
+		"measured": n,
+		"budget":   s.budget.max,
+		"unit":     s.budget.unit,
+	}
+	for k, val := range extra {
+		details[k] = val
+	}
+	abortWithError(c, codePromptTooLong, s.budget.message(n), details)
+	return false
+}
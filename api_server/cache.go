@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheSize = 1000
+	defaultCacheTTL  = 5 * time.Minute
+)
+
+// Backends for INFER_CACHE_STORE.
+const (
+	cacheStoreMemory = "memory"
+	cacheStoreRedis  = "redis"
+)
+
+// ResponseCache holds successful model responses by cacheKey. It never
+// fails the request: a store that cannot be reached reports a miss and
+// drops writes.
+type ResponseCache interface {
+	Get(ctx context.Context, key string) (string, bool)
+	Put(ctx context.Context, key, response string)
+}
+
+// noCache keeps nothing; it is used when INFER_CACHE_SIZE is 0.
+type noCache struct{}
+
+func (noCache) Get(context.Context, string) (string, bool) { return "", false }
+func (noCache) Put(context.Context, string, string)        {}
+
+// loadResponseCache builds the cache named by INFER_CACHE_STORE. size caps
+// the in-memory LRU; Redis relies on ttl and its own eviction policy.
+func loadResponseCache(size int, ttl time.Duration) (ResponseCache, error) {
+	kind := os.Getenv("INFER_CACHE_STORE")
+	if size <= 0 {
+		return noCache{}, nil
+	}
+	switch kind {
+	case "", cacheStoreMemory:
+		return newResponseCache(size, ttl), nil
+	case cacheStoreRedis:
+		client, err := redisClient()
+		if err != nil {
+			return nil, err
+		}
+		return newRedisCache(client, ttl), nil
+	}
+	return nil, fmt.Errorf("INFER_CACHE_STORE %q: must be memory or redis", kind)
+}
+
+type cacheEntry struct {
+	key       string
+	response  string
+	expiresAt time.Time
+}
+
+// responseCache is a size-bounded LRU of model responses with a fixed TTL,
+// local to this replica.
+type responseCache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey hashes the prompts and generation parameters that determine the
+// model's output, and whether it is cleaned up.
+func cacheKey(req ChatRequest) string {
+	h := sha256.New()
+	h.Write([]byte(req.SystemPrompt))
+	h.Write([]byte{0})
+	h.Write([]byte(req.UserPrompt))
+	h.Write([]byte{0})
+	h.Write(generationParams(req))
+	if req.RawOutput {
+		h.Write([]byte{0, 'r'})
+	}
+	if req.RepairJSON {
+		h.Write([]byte{0, 'j'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// generationParams encodes the settings, other than prompts, that change
+// what the model host generates for req.
+func generationParams(req ChatRequest) []byte {
+	params, _ := json.Marshal(struct {
+		Temperature *float64 `json:"t,omitempty"`
+		MaxTokens   *int     `json:"m,omitempty"`
+		TopP        *float64 `json:"p,omitempty"`
+		Stop        []string `json:"s,omitempty"`
+		Format      string   `json:"f,omitempty"`
+	}{req.Temperature, req.MaxTokens, req.TopP, req.Stop, req.ResponseFormat})
+	return params
+}
+
+func (rc *responseCache) Get(_ context.Context, key string) (string, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	el, ok := rc.items[key]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		rc.ll.Remove(el)
+		delete(rc.items, key)
+		return "", false
+	}
+	rc.ll.MoveToFront(el)
+	return entry.response, true
+}
+
+func (rc *responseCache) Put(_ context.Context, key, response string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	expiresAt := time.Now().Add(rc.ttl)
+	if el, ok := rc.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.response, entry.expiresAt = response, expiresAt
+		rc.ll.MoveToFront(el)
+		return
+	}
+	rc.items[key] = rc.ll.PushFront(&cacheEntry{key: key, response: response, expiresAt: expiresAt})
+	for rc.ll.Len() > rc.size {
+		oldest := rc.ll.Back()
+		rc.ll.Remove(oldest)
+		delete(rc.items, oldest.Value.(*cacheEntry).key)
+	}
+}
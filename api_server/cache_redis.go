@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisCachePrefix = "qna:cache:"
+
+// redisCache keeps responses in Redis under their cacheKey, so every
+// replica shares the same hits. Entries expire ttl after they are written.
+// Errors are logged and counted; a failed read is a miss and a failed
+// write is dropped.
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisCache(client *redis.Client, ttl time.Duration) *redisCache {
+	return &redisCache{client: client, ttl: ttl}
+}
+
+func (rc *redisCache) Get(ctx context.Context, key string) (string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	resp, err := rc.client.Get(ctx, redisCachePrefix+key).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			cacheStoreFailed("get", err)
+		}
+		return "", false
+	}
+	return resp, true
+}
+
+func (rc *redisCache) Put(ctx context.Context, key, response string) {
+	// Other callers may be sharing this response, so the write should not
+	// be cut short by the one that started it going away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), redisOpTimeout)
+	defer cancel()
+	if err := rc.client.Set(ctx, redisCachePrefix+key, response, rc.ttl).Err(); err != nil {
+		cacheStoreFailed("put", err)
+	}
+}
+
+func cacheStoreFailed(op string, err error) {
+	cacheStoreErrorsTotal.WithLabelValues(op).Inc()
+	slog.Warn("response cache unavailable", "op", op, "error", err.Error())
+}
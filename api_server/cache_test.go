@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// chatCacheStatus posts a chat and returns its X-Cache header.
+func chatCacheStatus(t *testing.T, r http.Handler, body map[string]any) string {
+	t.Helper()
+	w := postJSON(t, r, "/chat", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body %s", w.Code, w.Body)
+	}
+	return w.Header().Get("X-Cache")
+}
+
+func TestChatCache(t *testing.T) {
+	model := &fakeInferencer{}
+	r, _ := newTestRouter(t, model, nil)
+
+	// Different chats, so neither has history that changes the prompt.
+	if got := chatCacheStatus(t, r, map[string]any{"chat_id": "c1", "user_prompt": "hello"}); got != "MISS" {
+		t.Errorf("first X-Cache = %q, want MISS", got)
+	}
+	if got := chatCacheStatus(t, r, map[string]any{"chat_id": "c2", "user_prompt": "hello"}); got != "HIT" {
+		t.Errorf("repeat X-Cache = %q, want HIT", got)
+	}
+	if got := chatCacheStatus(t, r, map[string]any{"chat_id": "c3", "user_prompt": "hello", "temperature": 0.2}); got != "MISS" {
+		t.Errorf("other temperature X-Cache = %q, want MISS", got)
+	}
+	if got := model.callCount(); got != 2 {
+		t.Errorf("model called %d times, want 2", got)
+	}
+}
+
+func TestChatCacheDisabledOrExpired(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "disabled", env: map[string]string{"INFER_CACHE_SIZE": "0"}},
+		{name: "expired", env: map[string]string{"INFER_CACHE_TTL": "10ms"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := &fakeInferencer{}
+			r, _ := newTestRouter(t, model, tt.env)
+			chatCacheStatus(t, r, map[string]any{"chat_id": "c1", "user_prompt": "hello"})
+			time.Sleep(30 * time.Millisecond)
+			if got := chatCacheStatus(t, r, map[string]any{"chat_id": "c2", "user_prompt": "hello"}); got != "MISS" {
+				t.Errorf("repeat X-Cache = %q, want MISS", got)
+			}
+			if got := model.callCount(); got != 2 {
+				t.Errorf("model called %d times, want 2", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// chunkJoinWait bounds how long a chunk waits for members that are slow to
+// reach the upstream, such as one held up by a shared call; those that
+// arrive later are sent on their own.
+const chunkJoinWait = 50 * time.Millisecond
+
+var (
+	chunkSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "qna_batch_chunk_size",
+		Help:    "Batch queries sent upstream together in one chunk.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	})
+
+	chunkFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qna_batch_chunk_failures_total",
+		Help: "Chunks whose /infer/batch call failed, failing each of their queries.",
+	})
+)
+
+type chunkMemberKey struct{}
+
+// upstreamChunk gathers the queries runBatch put in one chunk so they can
+// go upstream in one /infer/batch call. A member either joins, when its
+// query reaches the upstream, or leaves without joining, when the cache or
+// a shared call answered it first. The chunk is sent once no member is
+// outstanding, or chunkJoinWait after the first one joined.
+type upstreamChunk struct {
+	// ctx is the batch's own context, which the chunk's calls run under.
+	ctx context.Context
+
+	mu          sync.Mutex
+	outstanding int
+	calls       []*batchedCall
+	sent        bool
+	timer       *time.Timer
+}
+
+// chunkMember is one query's place in a chunk. Its fields are guarded by
+// the chunk's mutex.
+type chunkMember struct {
+	chunk  *upstreamChunk
+	joined bool
+	left   bool
+}
+
+func newUpstreamChunk(ctx context.Context, size int) *upstreamChunk {
+	return &upstreamChunk{ctx: ctx, outstanding: size}
+}
+
+// withChunkMember enrols the query run under ctx in chunk. The caller must
+// call leave once the query is answered.
+func withChunkMember(ctx context.Context, chunk *upstreamChunk) (context.Context, *chunkMember) {
+	m := &chunkMember{chunk: chunk}
+	return context.WithValue(ctx, chunkMemberKey{}, m), m
+}
+
+// leave gives up the member's place if it never joined, which may complete
+// the chunk.
+func (m *chunkMember) leave() {
+	ck := m.chunk
+	ck.mu.Lock()
+	if m.joined || m.left {
+		ck.mu.Unlock()
+		return
+	}
+	m.left = true
+	ck.outstanding--
+	ready := ck.readyLocked()
+	ck.mu.Unlock()
+	if ready {
+		ck.send()
+	}
+}
+
+// readyLocked reports whether the chunk should go now, and if so marks it
+// sent.
+func (ck *upstreamChunk) readyLocked() bool {
+	if ck.sent || ck.outstanding > 0 || len(ck.calls) == 0 {
+		return false
+	}
+	ck.sent = true
+	return true
+}
+
+// chunkInferencer sends the queries of a chunked batch through their
+// chunk. Queries outside a chunk, and retries of a query whose chunk has
+// already gone, go straight to next.
+type chunkInferencer struct {
+	next Inferencer
+}
+
+func (ci chunkInferencer) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	m, _ := ctx.Value(chunkMemberKey{}).(*chunkMember)
+	if m == nil {
+		return ci.next.Infer(ctx, req)
+	}
+	ck := m.chunk
+	ck.mu.Lock()
+	if ck.sent || m.joined || m.left {
+		ck.mu.Unlock()
+		return ci.next.Infer(ctx, req)
+	}
+	call := &batchedCall{ctx: ctx, req: req, done: make(chan struct{})}
+	m.joined = true
+	ck.outstanding--
+	ck.calls = append(ck.calls, call)
+	if len(ck.calls) == 1 {
+		ck.timer = time.AfterFunc(chunkJoinWait, func() {
+			ck.mu.Lock()
+			late := !ck.sent
+			ck.sent = true
+			ck.mu.Unlock()
+			if late {
+				ck.send()
+			}
+		})
+	}
+	ready := ck.readyLocked()
+	ck.mu.Unlock()
+	if ready {
+		go ck.send()
+	}
+
+	select {
+	case <-call.done:
+		return call.resp, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// send calls the upstream for the members that joined, one call per set
+// of generation parameters. A failed call fails each of its queries; other
+// calls of the chunk, and other chunks, are not affected.
+func (ck *upstreamChunk) send() {
+	ck.mu.Lock()
+	ck.timer.Stop()
+	calls := ck.calls
+	ck.mu.Unlock()
+
+	groups := make(map[string][]*batchedCall)
+	var order []string
+	for _, call := range calls {
+		key := string(generationParams(call.req))
+		if groups[key] == nil {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], call)
+	}
+	var wg sync.WaitGroup
+	for _, key := range order {
+		wg.Add(1)
+		go func(calls []*batchedCall) {
+			defer wg.Done()
+			sendChunk(ck.ctx, calls)
+		}(groups[key])
+	}
+	wg.Wait()
+}
+
+// sendChunk runs under the batch's context rather than any one member's,
+// so a member that gives up does not fail the others; the call stops only
+// once the batch is abandoned.
+func sendChunk(ctx context.Context, calls []*batchedCall) {
+	chunkSize.Observe(float64(len(calls)))
+	lc := liveFrom(ctx)
+	reqs := make([]ChatRequest, len(calls))
+	for i, call := range calls {
+		reqs[i] = call.req
+	}
+	backend, entries, err := callModelBatch(ctx, lc.pool, reqs)
+	if err != nil {
+		chunkFailures.Inc()
+		slog.Warn("upstream batch chunk failed", "request_id", requestIDFrom(ctx), "size", len(calls), "error", err.Error())
+		for _, call := range calls {
+			call.err = err
+			close(call.done)
+		}
+		return
+	}
+	deliverBatch(backend, entries, lc.responseField, calls)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// responseCleanup tidies model output before anything else sees it: the
+// configured special tokens are removed wherever they appear, then
+// surrounding whitespace is trimmed if trim is set.
+type responseCleanup struct {
+	trim   bool
+	tokens []string
+}
+
+// loadResponseCleanup reads INFER_RESPONSE_TRIM and the comma-separated
+// INFER_RESPONSE_STRIP_TOKENS, e.g. "</s>,<|eot_id|>".
+func loadResponseCleanup() (responseCleanup, error) {
+	var rc responseCleanup
+	var err error
+	if rc.trim, err = boolEnv("INFER_RESPONSE_TRIM", true); err != nil {
+		return rc, err
+	}
+	for _, tok := range strings.Split(os.Getenv("INFER_RESPONSE_STRIP_TOKENS"), ",") {
+		if tok = strings.TrimSpace(tok); tok != "" {
+			rc.tokens = append(rc.tokens, tok)
+		}
+	}
+	return rc, nil
+}
+
+func (rc responseCleanup) apply(resp string) string {
+	for _, tok := range rc.tokens {
+		resp = strings.ReplaceAll(resp, tok, "")
+	}
+	if rc.trim {
+		resp = strings.TrimSpace(resp)
+	}
+	return resp
+}
+
+// cleanupInferencer applies cleanup to every response from next unless the
+// query asked for raw output. It sits below the cache, so cleaned and raw
+// responses are cached apart.
+type cleanupInferencer struct {
+	next    Inferencer
+	cleanup responseCleanup
+}
+
+func (ci cleanupInferencer) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	resp, err := ci.next.Infer(ctx, req)
+	if err != nil || req.RawOutput {
+		return resp, err
+	}
+	return ci.cleanup.apply(resp), nil
+}
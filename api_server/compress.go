@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultGzipMinBytes = 1024
+
+// decompressBody transparently decodes gzip request bodies. The n-byte body
+// limit applies to the decompressed size as well, so a small compressed
+// body cannot expand without bound.
+func decompressBody(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch enc := strings.ToLower(c.GetHeader("Content-Encoding")); enc {
+		case "", "identity":
+		case "gzip":
+			zr, err := gzip.NewReader(c.Request.Body)
+			if err != nil {
+				abortWithError(c, codeInvalidBody, "invalid gzip body: "+err.Error(), nil)
+				return
+			}
+			defer zr.Close()
+			c.Request.Body = http.MaxBytesReader(c.Writer, zr, n)
+			c.Request.Header.Del("Content-Encoding")
+			c.Request.Header.Del("Content-Length")
+			c.Request.ContentLength = -1
+		default:
+			abortWithError(c, codeUnsupportedMediaType, "unsupported Content-Encoding "+enc, nil)
+			return
+		}
+		c.Next()
+	}
+}
+
+// compressResponses gzips responses for clients that accept it once the
+// body reaches minBytes. Smaller bodies, and streams flushed before reaching
+// minBytes, are sent as is.
+func compressResponses(minBytes int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		c.Header("Vary", "Accept-Encoding")
+		gw := &gzipWriter{ResponseWriter: c.Writer, minBytes: minBytes}
+		c.Writer = gw
+		defer gw.finish()
+		c.Next()
+	}
+}
+
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipWriter buffers the start of a response until it knows whether the
+// body is large enough to compress.
+type gzipWriter struct {
+	gin.ResponseWriter
+	minBytes int
+
+	buf     bytes.Buffer
+	decided bool
+	zw      *gzip.Writer
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.zw != nil {
+			return w.zw.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf.Write(p)
+	if w.buf.Len() >= w.minBytes {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// decide fixes the encoding and writes out what has been buffered so far.
+func (w *gzipWriter) decide(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if compress && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.zw = gzip.NewWriter(w.ResponseWriter)
+		_, err := w.zw.Write(w.buf.Bytes())
+		return err
+	}
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	return err
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.zw != nil {
+		w.zw.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) finish() {
+	if !w.decided {
+		if w.buf.Len() == 0 {
+			return
+		}
+		w.decide(false)
+	}
+	if w.zw != nil {
+		w.zw.Close()
+	}
+}
+
+// gzipBody compresses an upstream request body.
+func gzipBody(body []byte) (io.Reader, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Policies for INFER_UPSTREAM_LIMIT_POLICY when every upstream slot is taken.
+const (
+	limitPolicyQueue  = "queue"
+	limitPolicyReject = "reject"
+)
+
+const defaultUpstreamQueueTimeout = time.Second
+
+// errUpstreamBusy is returned when no upstream slot frees up in time.
+var errUpstreamBusy = errors.New("too many upstream calls in flight")
+
+// upstreamLimiter is a semaphore shared by every upstream call the server
+// makes, whichever route it serves. Waiting calls are served by priority
+// and then in arrival order, or, with fairBy set, round-robin by key; see
+// fairQueue. A nil *upstreamLimiter is unlimited.
+type upstreamLimiter struct {
+	policy       string
+	queueTimeout time.Duration
+	fairBy       string
+	queue        *fairQueue
+}
+
+// upstreamSlots is set from config in main.
+var upstreamSlots *upstreamLimiter
+
+// newUpstreamLimiter returns nil when max is zero, disabling the limit.
+func newUpstreamLimiter(max int, policy string, queueTimeout time.Duration, fairBy string, aging time.Duration) *upstreamLimiter {
+	upstreamLimit.Set(float64(max))
+	if max <= 0 {
+		return nil
+	}
+	return &upstreamLimiter{policy: policy, queueTimeout: queueTimeout, fairBy: fairBy, queue: newFairQueue(max, aging)}
+}
+
+// acquire takes a slot for a call on behalf of chatID, which may be empty,
+// at the given priority level, waiting up to queueTimeout under the queue
+// policy. The returned func gives the slot back.
+func (l *upstreamLimiter) acquire(ctx context.Context, chatID string, level int) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	// Without fairness every call waits in the one line.
+	key := ""
+	if l.fairBy != fairByOff {
+		key = fairKey(ctx, l.fairBy, chatID)
+	}
+	if err := l.queue.acquire(ctx, key, level, l.policy == limitPolicyReject, l.queueTimeout); err != nil {
+		return nil, err
+	}
+	upstreamInflight.Inc()
+	return func() {
+		upstreamInflight.Dec()
+		l.queue.release()
+	}, nil
+}
+
+// releaseOnClose holds an upstream slot until a streamed body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultListenAddr = ":8080"
+
+// config holds the settings read from the environment at startup.
+type config struct {
+	listenAddr       string
+	upstreams        []string
+	fallbackURL      string
+	timeout          time.Duration
+	maxAttempts      int
+	batchConcurrency int
+	maxBatchSize     int
+	maxPromptChars   int
+	promptLogMode    string
+	apiKeys          []apiKey
+	cacheSize        int
+	cacheTTL         time.Duration
+	cache            ResponseCache
+	shutdownTimeout  time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	historyMaxTurns  int
+	historyTTL       time.Duration
+	history          HistoryStore
+	corsOrigins      []string
+	maxBodyBytes     int
+	moderator        Moderator
+	jobRetention     time.Duration
+	callbackSecret   string
+	callbackHosts    map[string]bool
+	callbackAttempts int
+	gzipMinBytes     int
+	upstreamGzip     bool
+	embeddingsURL    string
+	embeddingsBatch  int
+	upstreamDetail   upstreamDetail
+
+	upstreamConcurrency  int
+	upstreamLimitPolicy  string
+	upstreamQueueTimeout time.Duration
+	idempotencyKeys      int
+	idempotencyTTL       time.Duration
+	tls                  *tls.Config
+	prompt               *promptTemplate
+	filters              *responseFilters
+
+	rateLimitRPS         float64
+	rateLimitBurst       int
+	rateLimitMode        string
+	globalRateLimitRPS   float64
+	globalRateLimitBurst int
+
+	queueWorkers    int
+	queueDepth      int
+	queueRetryAfter time.Duration
+
+	warmup            bool
+	keepAliveInterval time.Duration
+	routing           string
+
+	adaptiveEnabled bool
+	adaptiveMin     int
+	adaptiveMax     int
+	adaptiveTarget  time.Duration
+
+	dryRun        bool
+	dryRunLatency time.Duration
+	budget        promptBudget
+
+	listener listenerSettings
+
+	upstreamHeaders http.Header
+	responseField   string
+
+	chatTimeout  time.Duration
+	batchTimeout time.Duration
+	jsonAttempts int
+
+	microBatch     bool
+	microBatchWait time.Duration
+	microBatchSize int
+
+	fairBy string
+
+	cleanup responseCleanup
+
+	systemPrompt systemPrompt
+
+	loadTest loadTestSettings
+
+	maxUpstreamBytes int
+
+	audit auditSettings
+
+	chatTypes []string
+
+	chunkSize int
+
+	rejectEmpty bool
+
+	priorityAging time.Duration
+
+	upstreamDebug upstreamDebugSettings
+
+	handlerTimeout handlerTimeouts
+
+	shadow shadowSettings
+
+	quota quotaSettings
+
+	degraded degradedSettings
+
+	logLevel      slog.Level
+	slowThreshold time.Duration
+}
+
+// loadConfig reads every INFER_* setting, failing on the first malformed one.
+func loadConfig() (config, error) {
+	var cfg config
+	var err error
+	if cfg.listenAddr, err = listenAddr(); err != nil {
+		return cfg, err
+	}
+	if err = loadLiveSettings(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.fallbackURL = os.Getenv("INFER_FALLBACK_URL"); cfg.fallbackURL != "" {
+		if err = validateUpstreamURL("INFER_FALLBACK_URL", cfg.fallbackURL); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.maxAttempts, err = positiveIntEnv("INFER_MAX_ATTEMPTS", defaultMaxAttempts); err != nil {
+		return cfg, err
+	}
+	if cfg.maxBatchSize, err = positiveIntEnv("INFER_MAX_BATCH_SIZE", defaultMaxBatchSize); err != nil {
+		return cfg, err
+	}
+	if cfg.maxPromptChars, err = positiveIntEnv("INFER_MAX_PROMPT_CHARS", defaultMaxPromptChars); err != nil {
+		return cfg, err
+	}
+	if cfg.promptLogMode, err = logPromptMode(); err != nil {
+		return cfg, err
+	}
+	if cfg.apiKeys, err = loadAPIKeys(); err != nil {
+		return cfg, err
+	}
+	if cfg.cacheSize, err = nonNegativeIntEnv("INFER_CACHE_SIZE", defaultCacheSize); err != nil {
+		return cfg, err
+	}
+	if cfg.cacheTTL, err = durationEnv("INFER_CACHE_TTL", defaultCacheTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.cache, err = loadResponseCache(cfg.cacheSize, cfg.cacheTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.shutdownTimeout, err = durationEnv("INFER_SHUTDOWN_TIMEOUT", defaultShutdownTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.breakerThreshold, err = positiveIntEnv("INFER_BREAKER_THRESHOLD", defaultBreakerThreshold); err != nil {
+		return cfg, err
+	}
+	if cfg.breakerCooldown, err = durationEnv("INFER_BREAKER_COOLDOWN", defaultBreakerCooldown); err != nil {
+		return cfg, err
+	}
+	if cfg.historyMaxTurns, err = nonNegativeIntEnv("INFER_HISTORY_MAX_TURNS", defaultHistoryMaxTurns); err != nil {
+		return cfg, err
+	}
+	if cfg.historyTTL, err = durationEnv("INFER_HISTORY_TTL", defaultHistoryTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.history, err = loadHistoryStore(cfg.historyMaxTurns, cfg.historyTTL); err != nil {
+		return cfg, err
+	}
+	cfg.corsOrigins = corsOrigins()
+	if cfg.maxBodyBytes, err = positiveIntEnv("INFER_MAX_BODY_BYTES", defaultMaxBodyBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.moderator, err = loadModerator(); err != nil {
+		return cfg, err
+	}
+	if cfg.jobRetention, err = durationEnv("INFER_JOB_RETENTION", defaultJobRetention); err != nil {
+		return cfg, err
+	}
+	cfg.callbackSecret = os.Getenv("INFER_CALLBACK_SECRET")
+	cfg.callbackHosts = callbackHosts()
+	if cfg.callbackAttempts, err = positiveIntEnv("INFER_CALLBACK_ATTEMPTS", defaultCallbackAttempts); err != nil {
+		return cfg, err
+	}
+	if cfg.gzipMinBytes, err = nonNegativeIntEnv("INFER_GZIP_MIN_BYTES", defaultGzipMinBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.upstreamGzip, err = boolEnv("INFER_UPSTREAM_GZIP", false); err != nil {
+		return cfg, err
+	}
+	if cfg.embeddingsURL, err = embeddingsURL(); err != nil {
+		return cfg, err
+	}
+	if cfg.embeddingsBatch, err = positiveIntEnv("INFER_EMBEDDINGS_BATCH_SIZE", defaultEmbeddingsBatchSize); err != nil {
+		return cfg, err
+	}
+	if cfg.upstreamDetail, err = loadUpstreamDetail(); err != nil {
+		return cfg, err
+	}
+	if cfg.upstreamConcurrency, err = nonNegativeIntEnv("INFER_UPSTREAM_CONCURRENCY", 0); err != nil {
+		return cfg, err
+	}
+	switch cfg.upstreamLimitPolicy = os.Getenv("INFER_UPSTREAM_LIMIT_POLICY"); cfg.upstreamLimitPolicy {
+	case "":
+		cfg.upstreamLimitPolicy = limitPolicyQueue
+	case limitPolicyQueue, limitPolicyReject:
+	default:
+		return cfg, fmt.Errorf("INFER_UPSTREAM_LIMIT_POLICY %q: must be queue or reject", cfg.upstreamLimitPolicy)
+	}
+	if cfg.upstreamQueueTimeout, err = durationEnv("INFER_UPSTREAM_QUEUE_TIMEOUT", defaultUpstreamQueueTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.idempotencyKeys, err = nonNegativeIntEnv("INFER_IDEMPOTENCY_MAX_KEYS", defaultIdempotencyKeys); err != nil {
+		return cfg, err
+	}
+	if cfg.idempotencyTTL, err = durationEnv("INFER_IDEMPOTENCY_TTL", defaultIdempotencyTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.tls, err = loadTLSConfig(); err != nil {
+		return cfg, err
+	}
+	if cfg.prompt, err = loadPromptTemplate(); err != nil {
+		return cfg, err
+	}
+	if cfg.filters, err = loadResponseFilters(); err != nil {
+		return cfg, err
+	}
+	if cfg.queueWorkers, err = nonNegativeIntEnv("INFER_QUEUE_WORKERS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.queueDepth, err = nonNegativeIntEnv("INFER_QUEUE_DEPTH", defaultQueueDepth); err != nil {
+		return cfg, err
+	}
+	if cfg.queueRetryAfter, err = durationEnv("INFER_QUEUE_RETRY_AFTER", defaultQueueRetryAfter); err != nil {
+		return cfg, err
+	}
+	if cfg.warmup, err = boolEnv("INFER_WARMUP", true); err != nil {
+		return cfg, err
+	}
+	if cfg.keepAliveInterval, err = durationEnv("INFER_KEEPALIVE_INTERVAL", defaultKeepAliveInterval); err != nil {
+		return cfg, err
+	}
+	switch cfg.routing = os.Getenv("INFER_ROUTING"); cfg.routing {
+	case "":
+		cfg.routing = routingRoundRobin
+	case routingRoundRobin, routingSticky:
+	default:
+		return cfg, fmt.Errorf("INFER_ROUTING %q: must be round_robin or sticky", cfg.routing)
+	}
+	if cfg.adaptiveEnabled, err = boolEnv("INFER_ADAPTIVE_CONCURRENCY", false); err != nil {
+		return cfg, err
+	}
+	if cfg.adaptiveMin, err = positiveIntEnv("INFER_ADAPTIVE_MIN", defaultAdaptiveMin); err != nil {
+		return cfg, err
+	}
+	if cfg.adaptiveMax, err = positiveIntEnv("INFER_ADAPTIVE_MAX", defaultAdaptiveMax); err != nil {
+		return cfg, err
+	}
+	if cfg.adaptiveMax < cfg.adaptiveMin {
+		return cfg, fmt.Errorf("INFER_ADAPTIVE_MAX %d: must not be below INFER_ADAPTIVE_MIN %d", cfg.adaptiveMax, cfg.adaptiveMin)
+	}
+	if cfg.adaptiveTarget, err = durationEnv("INFER_ADAPTIVE_LATENCY_TARGET", defaultAdaptiveLatencyTarget); err != nil {
+		return cfg, err
+	}
+	if cfg.dryRun, err = boolEnv("INFER_DRY_RUN", false); err != nil {
+		return cfg, err
+	}
+	if cfg.dryRunLatency, err = durationEnv("INFER_DRY_RUN_LATENCY", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.budget, err = loadPromptBudget(); err != nil {
+		return cfg, err
+	}
+	if cfg.listener, err = loadListenerSettings(cfg.tls != nil); err != nil {
+		return cfg, err
+	}
+	if cfg.upstreamHeaders, err = loadUpstreamHeaders(); err != nil {
+		return cfg, err
+	}
+	if cfg.jsonAttempts, err = positiveIntEnv("INFER_JSON_MODE_ATTEMPTS", defaultJSONModeAttempts); err != nil {
+		return cfg, err
+	}
+	if cfg.microBatch, err = boolEnv("INFER_MICROBATCH", false); err != nil {
+		return cfg, err
+	}
+	if cfg.microBatchWait, err = durationEnv("INFER_MICROBATCH_WAIT", defaultMicroBatchWait); err != nil {
+		return cfg, err
+	}
+	if cfg.microBatchSize, err = positiveIntEnv("INFER_MICROBATCH_SIZE", defaultMicroBatchSize); err != nil {
+		return cfg, err
+	}
+	switch cfg.fairBy = os.Getenv("INFER_FAIR_QUEUE"); cfg.fairBy {
+	case "":
+		cfg.fairBy = fairByOff
+	case fairByOff:
+	case fairByChatID, fairByAPIKey:
+		if cfg.upstreamConcurrency == 0 {
+			return cfg, fmt.Errorf("INFER_FAIR_QUEUE needs INFER_UPSTREAM_CONCURRENCY")
+		}
+	default:
+		return cfg, fmt.Errorf("INFER_FAIR_QUEUE %q: must be off, chat_id or api_key", cfg.fairBy)
+	}
+	if cfg.cleanup, err = loadResponseCleanup(); err != nil {
+		return cfg, err
+	}
+	if cfg.loadTest, err = loadLoadTestSettings(); err != nil {
+		return cfg, err
+	}
+	if cfg.maxUpstreamBytes, err = positiveIntEnv("INFER_MAX_UPSTREAM_RESPONSE_BYTES", defaultMaxUpstreamResponseBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.audit, err = loadAuditSettings(); err != nil {
+		return cfg, err
+	}
+	if cfg.chatTypes, err = chatResponseTypes(); err != nil {
+		return cfg, err
+	}
+	if cfg.chunkSize, err = nonNegativeIntEnv("INFER_UPSTREAM_BATCH_SIZE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.rejectEmpty, err = boolEnv("INFER_REJECT_EMPTY_RESPONSES", true); err != nil {
+		return cfg, err
+	}
+	if cfg.priorityAging, err = durationEnv("INFER_PRIORITY_AGING", defaultPriorityAging); err != nil {
+		return cfg, err
+	}
+	if cfg.upstreamDebug, err = loadUpstreamDebugSettings(); err != nil {
+		return cfg, err
+	}
+	if cfg.handlerTimeout, err = loadHandlerTimeouts(); err != nil {
+		return cfg, err
+	}
+	if cfg.shadow, err = loadShadowSettings(); err != nil {
+		return cfg, err
+	}
+	if cfg.quota, err = loadQuotaSettings(); err != nil {
+		return cfg, err
+	}
+	if cfg.degraded, err = loadDegradedSettings(); err != nil {
+		return cfg, err
+	}
+	if cfg.logLevel, err = parseLogLevel(); err != nil {
+		return cfg, err
+	}
+	if cfg.slowThreshold, err = durationEnv("INFER_SLOW_REQUEST_THRESHOLD", 0); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// upstreamURLs resolves the inference endpoints from INFER_UPSTREAM_URL, a
+// comma-separated list, falling back to HF_SPACE_URL when unset.
+func upstreamURLs() ([]string, error) {
+	raw := os.Getenv("INFER_UPSTREAM_URL")
+	if raw == "" {
+		return []string{HF_SPACE_URL}, nil
+	}
+	var urls []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if err := validateUpstreamURL("INFER_UPSTREAM_URL", entry); err != nil {
+			return nil, err
+		}
+		urls = append(urls, entry)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("INFER_UPSTREAM_URL %q: no URLs given", raw)
+	}
+	return urls, nil
+}
+
+func validateUpstreamURL(name, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%s %q: %w", name, raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s %q: must be an absolute http or https URL", name, raw)
+	}
+	return nil
+}
+
+// listenAddr reads LISTEN_ADDR as host:port, where host may be empty to
+// bind every interface.
+func listenAddr() (string, error) {
+	raw := os.Getenv("LISTEN_ADDR")
+	if raw == "" {
+		return defaultListenAddr, nil
+	}
+	_, port, err := net.SplitHostPort(raw)
+	if err != nil {
+		return "", fmt.Errorf("LISTEN_ADDR %q: %w", raw, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("LISTEN_ADDR %q: invalid port", raw)
+	}
+	return raw, nil
+}
+
+// devModeEnv reads INFER_DEV_MODE, which development-only features require
+// on top of their own switch, so none of them is turned on by a single
+// stray variable in production.
+func devModeEnv() (bool, error) {
+	return boolEnv("INFER_DEV_MODE", false)
+}
+
+// durationEnv reads name as a positive Go duration (e.g. "45s"), returning
+// def when unset.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s %q: must be a positive duration", name, raw)
+	}
+	return d, nil
+}
+
+// positiveIntEnv reads name as a positive integer, returning def when unset.
+func positiveIntEnv(name string, def int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s %q: must be a positive integer", name, raw)
+	}
+	return n, nil
+}
+
+// boolEnv reads name with strconv.ParseBool, returning def when unset.
+func boolEnv(name string, def bool) (bool, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s %q: must be true or false", name, raw)
+	}
+	return b, nil
+}
+
+// nonNegativeFloatEnv reads name as a float >= 0, returning def when unset.
+func nonNegativeFloatEnv(name string, def float64) (float64, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s %q: must be a non-negative number", name, raw)
+	}
+	return f, nil
+}
+
+// nonNegativeIntEnv is like positiveIntEnv but accepts zero, which callers
+// use to mean "disabled".
+func nonNegativeIntEnv(name string, def int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s %q: must be a non-negative integer", name, raw)
+	}
+	return n, nil
+}
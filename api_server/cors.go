@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	corsAllowMethods = "GET, POST, DELETE, OPTIONS"
+	corsMaxAge       = "600"
+
+	// corsAllowHeaders are the request headers a browser may send: auth,
+	// a gzip body, and the per-request options.
+	corsAllowHeaders = "Authorization, Content-Type, Content-Encoding, Accept, X-API-Key, " +
+		idempotencyHeader + ", " + requestTimeoutHeader + ", " + requestIDHeader + ", " +
+		traceparentHeader + ", " + dryRunHeader
+
+	// corsExposeHeaders are the response headers browser code may read,
+	// so it can pace itself on the quota and rate limit and report
+	// request IDs.
+	corsExposeHeaders = "X-Cache, X-Cache-Hits, Retry-After, Location, X-Batch-Total, " +
+		requestIDHeader + ", " + traceparentHeader + ", " +
+		quotaLimitHeader + ", " + quotaRemainingHeader + ", " + quotaResetHeader + ", " +
+		degradedHeader + ", " + idempotencyReplayHeader + ", " + dryRunHeader + ", " +
+		upstreamLatencyHeader + ", " + backendHeader + ", " + fallbackHeader + ", " + truncatedHeader
+)
+
+// corsOrigins reads INFER_CORS_ORIGINS as a comma-separated origin list;
+// "*" allows any origin. Empty means CORS headers are never sent.
+func corsOrigins() []string {
+	var origins []string
+	for _, o := range strings.Split(os.Getenv("INFER_CORS_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	return origins
+}
+
+// corsMiddleware sets Access-Control-* headers for allowed origins and
+// answers preflight requests before they reach auth or routing.
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	allowAny := slices.Contains(origins, "*")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		c.Header("Vary", "Origin")
+		if !allowAny && !slices.Contains(origins, origin) {
+			if c.Request.Method == http.MethodOptions {
+				abortWithError(c, codeOriginNotAllowed, "origin "+origin+" is not allowed", nil)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if allowAny {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		c.Header("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+			c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+			c.Header("Access-Control-Max-Age", corsMaxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestTimeoutHeader = "X-Request-Timeout-Ms"
+	maxRequestTimeoutMs  = 300000
+)
+
+type clientDeadlineKey struct{}
+
+type batchPathKey struct{}
+
+// requestDeadline applies the client's X-Request-Timeout-Ms to the request
+// context, so every upstream call made for the request shares the deadline.
+// The deadline then replaces the per-call INFER_CHAT_TIMEOUT and
+// INFER_BATCH_TIMEOUT rather than adding to them.
+func requestDeadline() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader(requestTimeoutHeader)
+		if raw == "" {
+			c.Next()
+			return
+		}
+		ms, err := strconv.Atoi(raw)
+		if err != nil || ms <= 0 || ms > maxRequestTimeoutMs {
+			abortWithError(c, codeInvalidHeader, fmt.Sprintf("%s must be an integer between 1 and %d", requestTimeoutHeader, maxRequestTimeoutMs), nil)
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		ctx = context.WithValue(ctx, clientDeadlineKey{}, true)
+		c.Request = c.Request.WithContext(ctx)
+		addLogAttrs(c, "request_timeout_ms", ms)
+		c.Next()
+	}
+}
+
+// withBatchPath marks ctx as batch work, whose upstream calls are capped by
+// INFER_BATCH_TIMEOUT instead of INFER_CHAT_TIMEOUT.
+func withBatchPath(ctx context.Context) context.Context {
+	return context.WithValue(ctx, batchPathKey{}, true)
+}
+
+// callTimeout is the cap on one inference call made for ctx. A client
+// deadline wins over the route setting; a /jobs run has shed that deadline,
+// so it falls back to the batch timeout.
+func callTimeout(ctx context.Context) time.Duration {
+	if _, ok := ctx.Deadline(); ok && ctx.Value(clientDeadlineKey{}) != nil {
+		return 0
+	}
+	lc := liveFrom(ctx)
+	if ctx.Value(batchPathKey{}) != nil {
+		return lc.batchTimeout
+	}
+	return lc.chatTimeout
+}
+
+// inferenceClient is the live upstream client with its timeout set by
+// callTimeout. It shares the live transport.
+func inferenceClient(ctx context.Context) *http.Client {
+	client := *liveFrom(ctx).client
+	client.Timeout = callTimeout(ctx)
+	return &client
+}
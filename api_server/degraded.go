@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// degradedHeader marks a response that is the configured degraded message
+// rather than a model answer.
+const degradedHeader = "X-Degraded"
+
+var degradedResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qna_degraded_responses_total",
+	Help: "Requests answered with INFER_DEGRADED_RESPONSE because the upstream was unavailable, by route and error code.",
+}, []string{"route", "code"})
+
+// degradedSettings is the static answer given while the upstream is down,
+// which is off unless INFER_DEGRADED_RESPONSE is set.
+type degradedSettings struct {
+	message string
+	status  int
+}
+
+// loadDegradedSettings reads INFER_DEGRADED_RESPONSE and
+// INFER_DEGRADED_STATUS, which is 503 unless set to 200.
+func loadDegradedSettings() (degradedSettings, error) {
+	d := degradedSettings{message: os.Getenv("INFER_DEGRADED_RESPONSE"), status: http.StatusServiceUnavailable}
+	raw := os.Getenv("INFER_DEGRADED_STATUS")
+	if raw == "" {
+		return d, nil
+	}
+	if d.message == "" {
+		return d, errors.New("INFER_DEGRADED_STATUS needs INFER_DEGRADED_RESPONSE")
+	}
+	var err error
+	if d.status, err = strconv.Atoi(raw); err != nil || (d.status != http.StatusOK && d.status != http.StatusServiceUnavailable) {
+		return d, fmt.Errorf("INFER_DEGRADED_STATUS %q: must be 200 or 503", raw)
+	}
+	return d, nil
+}
+
+// degradedResponse answers a chat whose upstream call failed because no
+// backend could be reached, after the retries and the fallback URL. A nil
+// *degradedResponse answers nothing, and the error is passed on.
+type degradedResponse struct {
+	message string
+	status  int
+}
+
+func newDegradedResponse(cfg degradedSettings) *degradedResponse {
+	if cfg.message == "" {
+		return nil
+	}
+	return &degradedResponse{message: cfg.message, status: cfg.status}
+}
+
+// upstreamUnavailable reports whether err means the model host could not
+// give an answer at all: the breaker is open, or the last call timed out,
+// could not connect or got a 5xx. A 4xx, a malformed answer or the client
+// going away is passed on as an error.
+func upstreamUnavailable(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		return true
+	}
+	kind, _ := upstreamKind(err)
+	switch kind {
+	case kindConnection, kindTimeout, kindUpstream5xx:
+		return true
+	}
+	return false
+}
+
+// use reports whether err is answered with the degraded message instead,
+// in which case it marks, logs and counts the response and the caller
+// writes d.message with d.status. It is never cached, added to the history
+// or stored for an Idempotency-Key.
+func (d *degradedResponse) use(c *gin.Context, err error) bool {
+	if d == nil || !upstreamUnavailable(err) {
+		return false
+	}
+	code := upstreamErrorCode(err)
+	degradedResponses.WithLabelValues(c.FullPath(), code).Inc()
+	addLogAttrs(c, "degraded", true, "error_code", code)
+	slog.Warn("upstream unavailable, serving degraded response",
+		"request_id", requestIDFrom(c.Request.Context()), "route", c.FullPath(), "code", code, "error", err.Error())
+	c.Header(degradedHeader, "true")
+	return true
+}
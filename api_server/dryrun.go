@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const dryRunHeader = "X-Dry-Run"
+
+type dryRunKey struct{}
+
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+func isDryRun(ctx context.Context) bool {
+	on, _ := ctx.Value(dryRunKey{}).(bool)
+	return on
+}
+
+// dryRun marks requests that must not reach the model host: all of them
+// when always is set (INFER_DRY_RUN), otherwise those sent with
+// "X-Dry-Run: true". The mark is echoed back in the same header.
+func dryRun(always bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		on, _ := strconv.ParseBool(c.GetHeader(dryRunHeader))
+		if always || on {
+			c.Request = c.Request.WithContext(withDryRun(c.Request.Context()))
+			c.Header(dryRunHeader, "true")
+			addLogAttrs(c, "dry_run", true)
+		}
+		c.Next()
+	}
+}
+
+// dryRunResponse is the deterministic stand-in for a model response.
+func dryRunResponse(req ChatRequest) string {
+	return "[dry-run] " + req.UserPrompt
+}
+
+// dryRunInferencer answers dry-run requests with dryRunResponse after the
+// simulated latency, and passes everything else to next.
+type dryRunInferencer struct {
+	next    Inferencer
+	latency time.Duration
+}
+
+func (d dryRunInferencer) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	if !isDryRun(ctx) {
+		return d.next.Infer(ctx, req)
+	}
+	if err := sleepCtx(ctx, d.latency); err != nil {
+		return "", err
+	}
+	callInfoFrom(ctx).setMeta(map[string]any{"dry_run": true})
+	return dryRunResponse(req), nil
+}
+
+// dryRunStream is the streaming counterpart of dryRunInferencer.
+func dryRunStream(ctx context.Context, req ChatRequest, latency time.Duration) (io.ReadCloser, error) {
+	if err := sleepCtx(ctx, latency); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(dryRunResponse(req))), nil
+}
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultEmbeddingsBatchSize = 32
+
+// EmbeddingsRequest is the body of POST /embeddings.
+type EmbeddingsRequest struct {
+	Input []string `json:"input"`
+}
+
+type embedding struct {
+	Index     int       `json:"index"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// upstreamEmbeddings is the model host's /embeddings request and response.
+type upstreamEmbeddings struct {
+	Inputs     []string    `json:"inputs,omitempty"`
+	Embeddings [][]float64 `json:"embeddings,omitempty"`
+}
+
+// embeddingsURL reads INFER_EMBEDDINGS_URL, defaulting to the model host's
+// embeddings route.
+func embeddingsURL() (string, error) {
+	raw := os.Getenv("INFER_EMBEDDINGS_URL")
+	if raw == "" {
+		return HF_EMBEDDINGS_URL, nil
+	}
+	return raw, validateUpstreamURL("INFER_EMBEDDINGS_URL", raw)
+}
+
+func (s *server) handleEmbeddings(c *gin.Context) {
+	var req EmbeddingsRequest
+	if err := bindJSON(c, &req); err != nil {
+		writeError(c, bindError(err))
+		return
+	}
+	addLogAttrs(c, "batch_size", len(req.Input))
+	if errs := validateEmbeddingsRequest(req, s.maxBatchSize, s.maxPromptChars); len(errs) > 0 {
+		abortWithError(c, codeValidationFailed, "invalid request", gin.H{"fields": errs})
+		return
+	}
+
+	start := time.Now()
+	data := make([]embedding, 0, len(req.Input))
+	// Inputs go upstream embeddingsBatchSize at a time, so most requests
+	// take a single call.
+	for lo := 0; lo < len(req.Input); lo += s.embeddingsBatch {
+		chunk := req.Input[lo:min(lo+s.embeddingsBatch, len(req.Input))]
+		vectors, err := callEmbeddings(c.Request.Context(), s.embeddingsURL, chunk)
+		if err != nil {
+			recordUpstreamMS(c, time.Since(start).Milliseconds())
+			writeError(c, s.upstreamError(c, err))
+			return
+		}
+		for i, v := range vectors {
+			data = append(data, embedding{Index: lo + i, Embedding: v})
+		}
+	}
+	recordUpstreamMS(c, time.Since(start).Milliseconds())
+
+	dims := 0
+	if len(data) > 0 {
+		dims = len(data[0].Embedding)
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data, "dimensions": dims})
+}
+
+// callEmbeddings embeds inputs in one upstream call, returning one vector
+// per input in order.
+func callEmbeddings(ctx context.Context, url string, inputs []string) (_ [][]float64, err error) {
+	release, err := upstreamSlots.acquire(ctx, "", priorityLevel(priorityNormal))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, span := startUpstreamSpan(ctx, "upstream.embeddings", url)
+	status := 0
+	defer func() { endUpstreamSpan(span, status, err) }()
+	defer func() { err = classifyUpstream(err) }()
+
+	httpReq, err := newUpstreamRequest(ctx, url, upstreamEmbeddings{Inputs: inputs})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := liveFrom(ctx).client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+
+	data, err := readUpstreamBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	upstreamDebug.response(ctx, url, "", resp.StatusCode, data)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newUpstreamStatusError(resp, data)
+	}
+	var out upstreamEmbeddings
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("decoding upstream response: %w (body: %q)", err, truncate(string(data), maxDecodeSnippetBytes))
+	}
+	if len(out.Embeddings) != len(inputs) {
+		return nil, &UpstreamError{Kind: kindDecode, Err: fmt.Errorf("upstream returned %d embeddings for %d inputs", len(out.Embeddings), len(inputs))}
+	}
+	return out.Embeddings, nil
+}
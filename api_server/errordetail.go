@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamDetail decides which clients see the upstream status and body of
+// a failed call. The zero value shows them to nobody.
+type upstreamDetail struct {
+	all    bool
+	labels map[string]bool
+}
+
+// loadUpstreamDetail reads INFER_UPSTREAM_DETAIL: empty or "off" for
+// nobody, "all" for every client, or a comma-separated list of API key
+// labels.
+func loadUpstreamDetail() (upstreamDetail, error) {
+	raw := strings.TrimSpace(os.Getenv("INFER_UPSTREAM_DETAIL"))
+	switch raw {
+	case "", "off":
+		return upstreamDetail{}, nil
+	case "all":
+		return upstreamDetail{all: true}, nil
+	}
+	d := upstreamDetail{labels: make(map[string]bool)}
+	for _, label := range strings.Split(raw, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			d.labels[label] = true
+		}
+	}
+	if len(d.labels) == 0 {
+		return d, fmt.Errorf("INFER_UPSTREAM_DETAIL %q: must be off, all or API key labels", raw)
+	}
+	return d, nil
+}
+
+func (d upstreamDetail) allowed(c *gin.Context) bool {
+	if d.all {
+		return true
+	}
+	label, ok := c.Get(apiKeyLabelKey)
+	return ok && d.labels[label.(string)]
+}
+
+// publicMessage is err's message without the upstream response body or
+// field names, which may hold internal details.
+func publicMessage(err error) string {
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		return fmt.Sprintf("upstream returned %d", statusErr.StatusCode)
+	}
+	if errors.As(err, new(*SchemaDriftError)) {
+		return "upstream response did not match the expected schema"
+	}
+	return err.Error()
+}
+
+// upstreamError maps a failed upstream call to an error response, adding
+// upstream_status and upstream_detail for trusted clients. An upstream 429
+// passes its Retry-After hint on to the client. The error's kind goes in
+// the access log.
+func (s *server) upstreamError(c *gin.Context, err error) apiError {
+	status, code := upstreamErrorStatus(err)
+	e := apiError{status: status, code: code, message: publicMessage(err), details: gin.H{}}
+	if kind, ok := upstreamKind(err); ok {
+		addLogAttrs(c, "error_kind", string(kind))
+	}
+	if wait, ok := rateLimitHint(err); ok && wait > 0 {
+		secs := retryAfterSeconds(wait)
+		c.Header("Retry-After", strconv.Itoa(secs))
+		e.details["retry_after_seconds"] = secs
+	}
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) && s.upstreamDetail.allowed(c) {
+		e.details["upstream_status"] = statusErr.StatusCode
+		e.details["upstream_detail"] = statusErr.Body
+	}
+	var drift *SchemaDriftError
+	if errors.As(err, &drift) && s.upstreamDetail.allowed(c) {
+		e.details["upstream_detail"] = drift.Error()
+	}
+	return e
+}
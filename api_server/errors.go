@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stable error codes. Every error response has the body
+// {"error": {"code": ..., "message": ..., "request_id": ...}}, plus whatever
+// details the code carries, such as fields or retry_after_seconds. Clients
+// branch on code; messages are for people and may change.
+const (
+	codeUnauthorized         = "unauthorized"
+	codeRawNotAllowed        = "raw_not_allowed"
+	codeOriginNotAllowed     = "origin_not_allowed"
+	codeValidationFailed     = "validation_failed"
+	codeInvalidBody          = "invalid_body"
+	codeInvalidHeader        = "invalid_header"
+	codeBodyTooLarge         = "body_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeNotAcceptable        = "not_acceptable"
+	codeBatchTooLarge        = "batch_too_large"
+	codeBatchAborted         = "batch_aborted"
+	codePromptTooLong        = "prompt_too_long"
+	codePromptBlocked        = "prompt_blocked"
+	codeModerationFailed     = "moderation_unavailable"
+	codeRateLimited          = "rate_limited"
+	codeQuotaExceeded        = "quota_exceeded"
+	codeQueueFull            = "queue_full"
+	codeQueueTimeout         = "queue_timeout"
+	codeHandlerTimeout       = "request_timeout"
+	codeIdempotencyMismatch  = "idempotency_key_reused"
+	codeIdempotencyPending   = "idempotency_in_progress"
+	codeNotFound             = "not_found"
+	codeJobFinished          = "job_finished"
+	codeChatInProgress       = "chat_in_progress"
+	codeHistoryUnavailable   = "history_unavailable"
+	codePromptTemplate       = "prompt_template"
+	codeInternal             = "internal_error"
+	codeUpstreamUnavailable  = "upstream_unavailable"
+
+	// Failed upstream calls, as classified by upstreamErrorCode.
+	codeCircuitOpen         = "circuit_open"
+	codeUpstreamBusy        = "upstream_busy"
+	codeSchemaMismatch      = "upstream_schema_mismatch"
+	codeResponseTooLarge    = "upstream_response_too_large"
+	codeEmptyResponse       = "empty_response"
+	codeInvalidJSON         = "invalid_json_response"
+	codeUpstreamRateLimited = "upstream_rate_limited"
+	codeUpstreamStatus      = "upstream_status"
+	codeClientCancelled     = "client_cancelled"
+	codeUpstreamTimeout     = "upstream_timeout"
+	codeConnectionRefused   = "upstream_connection_refused"
+	codeUpstreamError       = "upstream_error"
+)
+
+// errorStatuses is the HTTP status of each code. upstream_status is the
+// exception: an upstream 4xx is passed on as is.
+var errorStatuses = map[string]int{
+	codeUnauthorized:         http.StatusUnauthorized,
+	codeRawNotAllowed:        http.StatusForbidden,
+	codeOriginNotAllowed:     http.StatusForbidden,
+	codeValidationFailed:     http.StatusBadRequest,
+	codeInvalidBody:          http.StatusBadRequest,
+	codeInvalidHeader:        http.StatusBadRequest,
+	codeBodyTooLarge:         http.StatusRequestEntityTooLarge,
+	codeUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	codeNotAcceptable:        http.StatusNotAcceptable,
+	codeBatchTooLarge:        http.StatusRequestEntityTooLarge,
+	codeBatchAborted:         http.StatusFailedDependency,
+	codePromptTooLong:        http.StatusBadRequest,
+	codePromptBlocked:        http.StatusBadRequest,
+	codeModerationFailed:     http.StatusServiceUnavailable,
+	codeRateLimited:          http.StatusTooManyRequests,
+	codeQuotaExceeded:        http.StatusTooManyRequests,
+	codeQueueFull:            http.StatusServiceUnavailable,
+	codeQueueTimeout:         http.StatusGatewayTimeout,
+	codeHandlerTimeout:       http.StatusGatewayTimeout,
+	codeIdempotencyMismatch:  http.StatusUnprocessableEntity,
+	codeIdempotencyPending:   http.StatusConflict,
+	codeNotFound:             http.StatusNotFound,
+	codeJobFinished:          http.StatusConflict,
+	codeChatInProgress:       http.StatusConflict,
+	codeHistoryUnavailable:   http.StatusServiceUnavailable,
+	codePromptTemplate:       http.StatusInternalServerError,
+	codeInternal:             http.StatusInternalServerError,
+	codeUpstreamUnavailable:  http.StatusServiceUnavailable,
+
+	codeCircuitOpen:         http.StatusServiceUnavailable,
+	codeUpstreamBusy:        http.StatusServiceUnavailable,
+	codeSchemaMismatch:      http.StatusBadGateway,
+	codeResponseTooLarge:    http.StatusBadGateway,
+	codeEmptyResponse:       http.StatusBadGateway,
+	codeInvalidJSON:         http.StatusBadGateway,
+	codeUpstreamRateLimited: http.StatusTooManyRequests,
+	codeUpstreamStatus:      http.StatusBadGateway,
+	codeClientCancelled:     statusClientClosed,
+	codeUpstreamTimeout:     http.StatusGatewayTimeout,
+	codeConnectionRefused:   http.StatusBadGateway,
+	codeUpstreamError:       http.StatusBadGateway,
+}
+
+// apiError is an error response on its way to the client.
+type apiError struct {
+	status  int // 0 means the status of code
+	code    string
+	message string
+	details gin.H
+}
+
+func newAPIError(code, message string, details gin.H) apiError {
+	return apiError{code: code, message: message, details: details}
+}
+
+func (e apiError) httpStatus() int {
+	if e.status != 0 {
+		return e.status
+	}
+	if status, ok := errorStatuses[e.code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// body is the error envelope, with the details alongside code and message.
+func (e apiError) body(c *gin.Context) gin.H {
+	return e.envelope(requestIDFrom(c.Request.Context()))
+}
+
+// envelope is body for a request ID already looked up, for callers that
+// cannot touch the gin context.
+func (e apiError) envelope(requestID string) gin.H {
+	inner := gin.H{}
+	for k, v := range e.details {
+		inner[k] = v
+	}
+	inner["code"], inner["message"] = e.code, e.message
+	if requestID != "" {
+		inner["request_id"] = requestID
+	}
+	return gin.H{"error": inner}
+}
+
+// writeError sends e and stops the handler chain.
+func writeError(c *gin.Context, e apiError) {
+	c.AbortWithStatusJSON(e.httpStatus(), e.body(c))
+}
+
+// abortWithError sends the error for code.
+func abortWithError(c *gin.Context, code, message string, details gin.H) {
+	writeError(c, newAPIError(code, message, details))
+}
+
+// notFound answers requests for routes that do not exist.
+func notFound(c *gin.Context) {
+	abortWithError(c, codeNotFound, "no route for "+c.Request.Method+" "+c.Request.URL.Path, nil)
+}
+
+// recoverPanics turns a panicking handler into a 500 with the envelope;
+// the panic itself goes to the log.
+func recoverPanics() gin.HandlerFunc {
+	return gin.CustomRecovery(func(c *gin.Context, _ any) {
+		abortWithError(c, codeInternal, "internal server error", nil)
+	})
+}
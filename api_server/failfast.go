@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errBatchAborted is the cause of the cancellation that stops a fail_fast
+// batch. Queries it cut off, waiting or in flight, report batch_aborted.
+var errBatchAborted = errors.New("batch stopped after an earlier query failed")
+
+type failFastKey struct{}
+
+// batchAbort names the failed query that stopped a fail_fast batch.
+type batchAbort struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// failFast stops a batch at its first failed query. It cancels the batch's
+// context, so queries still waiting for a slot are skipped and those in
+// flight give up their upstream calls. A nil *failFast never stops
+// anything.
+type failFast struct {
+	cancel context.CancelCauseFunc
+	once   sync.Once
+	first  *batchAbort
+}
+
+// withFailFast arms fail-fast for a batch run under the returned context,
+// or returns ctx and nil when enabled is false. The caller must call stop
+// once the batch has returned.
+func withFailFast(ctx context.Context, enabled bool) (context.Context, *failFast) {
+	if !enabled {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	ff := &failFast{cancel: cancel}
+	return context.WithValue(ctx, failFastKey{}, ff), ff
+}
+
+func failFastFrom(ctx context.Context) *failFast {
+	ff, _ := ctx.Value(failFastKey{}).(*failFast)
+	return ff
+}
+
+// fail records the failure r of the query at index i, if it is the first,
+// and cancels the rest of the batch.
+func (ff *failFast) fail(i int, r batchResult) {
+	if ff == nil {
+		return
+	}
+	ff.once.Do(func() {
+		ff.first = &batchAbort{Index: i, Code: r.Code, Message: r.Error}
+		ff.cancel(errBatchAborted)
+	})
+}
+
+// aborted returns the failure that stopped the batch, or nil if none did.
+// It is read once the batch has returned.
+func (ff *failFast) aborted() *batchAbort {
+	if ff == nil {
+		return nil
+	}
+	return ff.first
+}
+
+func (ff *failFast) stop() {
+	if ff != nil {
+		ff.cancel(nil)
+	}
+}
+
+// abortedErr substitutes errBatchAborted for the cancellation it caused in
+// err, so the query is reported as cut off rather than cancelled by the
+// client.
+func abortedErr(ctx context.Context, err error) error {
+	if errors.Is(err, context.Canceled) && errors.Is(context.Cause(ctx), errBatchAborted) {
+		return errBatchAborted
+	}
+	return err
+}
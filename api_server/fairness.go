@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dimensions for INFER_FAIR_QUEUE.
+const (
+	fairByOff    = "off"
+	fairByChatID = "chat_id"
+	fairByAPIKey = "api_key"
+)
+
+type fairClientKey struct{}
+
+// tagFairClient records the caller's rate limit identity, its API key label
+// or else its IP, for api_key fairness.
+func tagFairClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), fairClientKey{}, clientKey(c))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// fairKey is the sub-queue an upstream call for chatID waits in under by.
+// Calls with no chat_id, or outside any request, share one sub-queue.
+func fairKey(ctx context.Context, by, chatID string) string {
+	if by == fairByAPIKey {
+		key, _ := ctx.Value(fairClientKey{}).(string)
+		return key
+	}
+	return chatID
+}
+
+// fairQueue shares the slots of an upstreamLimiter round-robin over the
+// keys of the calls waiting for them: a freed slot goes to the oldest call
+// of the next key in turn, and that key goes to the back of the line. A key
+// flooding the limiter therefore gets one slot per round like any other,
+// however many calls it has queued.
+//
+// Each priority level has its own round of keys, and a slot goes to the
+// most urgent level that has calls waiting. A call that has waited aging at
+// one level moves up to the next, so low priority calls are still served
+// while higher ones keep arriving.
+type fairQueue struct {
+	mu     sync.Mutex
+	free   int
+	aging  time.Duration
+	levels [priorityLevels]fairLevel
+}
+
+// fairLevel holds the calls waiting at one priority, in per-key FIFO order.
+type fairLevel struct {
+	waiters map[string][]*fairWaiter
+	turns   []string
+}
+
+type fairWaiter struct {
+	ready   chan struct{}
+	granted bool
+	level   int
+	since   time.Time
+}
+
+func newFairQueue(slots int, aging time.Duration) *fairQueue {
+	q := &fairQueue{free: slots, aging: aging}
+	for i := range q.levels {
+		q.levels[i].waiters = make(map[string][]*fairWaiter)
+	}
+	return q
+}
+
+// acquire takes a slot for key at the given priority level, or with reject
+// set fails at once when none is free. Otherwise it waits up to timeout or
+// until ctx is done.
+func (q *fairQueue) acquire(ctx context.Context, key string, level int, reject bool, timeout time.Duration) error {
+	q.mu.Lock()
+	if q.free > 0 && !q.waitingLocked() {
+		q.free--
+		q.mu.Unlock()
+		return nil
+	}
+	if reject {
+		q.mu.Unlock()
+		return errUpstreamBusy
+	}
+	w := &fairWaiter{ready: make(chan struct{}), level: level, since: time.Now()}
+	q.enqueue(key, w)
+	q.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-t.C:
+		err = errUpstreamBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.granted {
+		// The slot arrived as we gave up; pass it on.
+		q.handOff()
+		return err
+	}
+	q.remove(key, w)
+	q.updateGauges()
+	return err
+}
+
+func (q *fairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handOff()
+}
+
+func (q *fairQueue) waitingLocked() bool {
+	for i := range q.levels {
+		if len(q.levels[i].turns) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue puts w at the back of key's line at w.level.
+func (q *fairQueue) enqueue(key string, w *fairWaiter) {
+	l := &q.levels[w.level]
+	if len(l.waiters[key]) == 0 {
+		l.turns = append(l.turns, key)
+	}
+	l.waiters[key] = append(l.waiters[key], w)
+	q.updateGauges()
+}
+
+// remove takes w out of key's line at w.level.
+func (q *fairQueue) remove(key string, w *fairWaiter) {
+	l := &q.levels[w.level]
+	l.waiters[key] = slices.DeleteFunc(l.waiters[key], func(o *fairWaiter) bool { return o == w })
+	if len(l.waiters[key]) == 0 {
+		delete(l.waiters, key)
+		l.turns = slices.DeleteFunc(l.turns, func(k string) bool { return k == key })
+	}
+}
+
+// promote moves the calls that have waited aging at their level up one,
+// oldest first, to the back of their key's line there.
+func (q *fairQueue) promote(now time.Time) {
+	for level := 1; level < priorityLevels; level++ {
+		l := &q.levels[level]
+		for _, key := range slices.Clone(l.turns) {
+			for _, w := range slices.Clone(l.waiters[key]) {
+				if now.Sub(w.since) < q.aging {
+					break
+				}
+				q.remove(key, w)
+				w.level--
+				w.since = now
+				q.enqueue(key, w)
+				priorityPromotions.Inc()
+			}
+		}
+	}
+}
+
+// handOff gives a freed slot to the next key in turn at the most urgent
+// level with calls waiting, or returns it to the pool if nobody is.
+func (q *fairQueue) handOff() {
+	q.promote(time.Now())
+	for i := range q.levels {
+		l := &q.levels[i]
+		if len(l.turns) == 0 {
+			continue
+		}
+		key := l.turns[0]
+		l.turns = l.turns[1:]
+		ws := l.waiters[key]
+		w := ws[0]
+		if len(ws) == 1 {
+			delete(l.waiters, key)
+		} else {
+			l.waiters[key] = ws[1:]
+			l.turns = append(l.turns, key)
+		}
+		q.updateGauges()
+		w.granted = true
+		close(w.ready)
+		return
+	}
+	q.free++
+}
+
+func (q *fairQueue) updateGauges() {
+	keys := 0
+	for i := range q.levels {
+		l := &q.levels[i]
+		keys += len(l.turns)
+		n := 0
+		for _, ws := range l.waiters {
+			n += len(ws)
+		}
+		upstreamQueueWaiting.WithLabelValues(priorityName(i)).Set(float64(n))
+	}
+	fairQueueKeys.Set(float64(keys))
+}
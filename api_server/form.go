@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// promptFileField is the multipart file field that may carry user_prompt.
+const promptFileField = "user_prompt_file"
+
+// unsupportedMediaTypeError is a body whose Content-Type the route cannot
+// decode; bindError answers it with 415 and the types that are accepted.
+type unsupportedMediaTypeError struct {
+	mediaType string
+	want      string
+}
+
+func (e *unsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("Content-Type %q is not supported; use %s", e.mediaType, e.want)
+}
+
+const mimeNDJSON = "application/x-ndjson"
+
+// chatResponseTypes reads INFER_CHAT_CONTENT_TYPE, the body /chat answers
+// with when the client's Accept header allows either, and returns the types
+// /chat offers, that one first.
+func chatResponseTypes() ([]string, error) {
+	switch raw := os.Getenv("INFER_CHAT_CONTENT_TYPE"); raw {
+	case "", binding.MIMEJSON:
+		return []string{binding.MIMEJSON, binding.MIMEPlain}, nil
+	case binding.MIMEPlain:
+		return []string{binding.MIMEPlain, binding.MIMEJSON}, nil
+	default:
+		return nil, fmt.Errorf("INFER_CHAT_CONTENT_TYPE %q: must be %s or %s", raw, binding.MIMEJSON, binding.MIMEPlain)
+	}
+}
+
+// acceptedType picks the first of offers the Accept header allows, going
+// by the order of the header's entries; no header, or */*, gets offers[0].
+// If none is allowed it answers 406 and reports false.
+func acceptedType(c *gin.Context, offers ...string) (string, bool) {
+	if t := c.NegotiateFormat(offers...); t != "" {
+		return t, true
+	}
+	abortWithError(c, codeNotAcceptable,
+		fmt.Sprintf("Accept %q is not supported; use %s", c.GetHeader("Accept"), strings.Join(offers, " or ")), nil)
+	return "", false
+}
+
+// acceptOnly answers 406 before the handler runs when the client accepts
+// none of offers.
+func acceptOnly(offers ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := acceptedType(c, offers...); ok {
+			c.Next()
+		}
+	}
+}
+
+// bindJSON decodes a JSON body into obj. A body declared as anything other
+// than application/json is refused before it is parsed; a missing
+// Content-Type is read as JSON, as it is for /chat.
+func bindJSON(c *gin.Context, obj any) error {
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	if mediaType != "" && mediaType != binding.MIMEJSON {
+		return &unsupportedMediaTypeError{mediaType: mediaType, want: binding.MIMEJSON}
+	}
+	return c.ShouldBindJSON(obj)
+}
+
+// bindChatRequest decodes req from JSON or, for form and multipart bodies,
+// from form fields; a multipart upload in user_prompt_file replaces
+// user_prompt. Any other content type gets 415. It writes the error
+// response itself when binding fails.
+func bindChatRequest(c *gin.Context, req *ChatRequest) bool {
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	var err error
+	switch mediaType {
+	case "", binding.MIMEJSON:
+		err = c.ShouldBindJSON(req)
+	case binding.MIMEPOSTForm:
+		err = c.ShouldBindWith(req, binding.Form)
+	case binding.MIMEMultipartPOSTForm:
+		if err = c.ShouldBindWith(req, binding.FormMultipart); err == nil {
+			err = readPromptFile(c, req)
+		}
+	default:
+		err = &unsupportedMediaTypeError{
+			mediaType: mediaType,
+			want:      "application/json, application/x-www-form-urlencoded or multipart/form-data",
+		}
+	}
+	if err != nil {
+		writeError(c, bindError(err))
+		return false
+	}
+	return true
+}
+
+func readPromptFile(c *gin.Context, req *ChatRequest) error {
+	fh, err := c.FormFile(promptFileField)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	req.UserPrompt = string(data)
+	return nil
+}
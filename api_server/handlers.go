@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"golang.org/x/sync/singleflight"
+)
+
+type ChatRequest struct {
+	ChatID       string `json:"chat_id" form:"chat_id"`
+	SystemPrompt string `json:"system_prompt" form:"system_prompt"`
+	UserPrompt   string `json:"user_prompt" form:"user_prompt"`
+
+	// Optional generation parameters, forwarded only when set so the model
+	// host's defaults apply otherwise.
+	Temperature *float64 `json:"temperature,omitempty" form:"temperature"`
+	MaxTokens   *int     `json:"max_tokens,omitempty" form:"max_tokens"`
+	TopP        *float64 `json:"top_p,omitempty" form:"top_p"`
+	Stop        []string `json:"stop,omitempty" form:"stop"`
+
+	// MaxResponseChars cuts the response to at most this many characters
+	// after it comes back; the full response is what gets cached.
+	MaxResponseChars *int `json:"max_response_chars,omitempty" form:"max_response_chars"`
+
+	// RawPrompt sends UserPrompt upstream without the server's prompt
+	// template.
+	RawPrompt bool `json:"raw_prompt,omitempty" form:"raw_prompt"`
+
+	// SkipFilters returns the response without the configured redaction
+	// filters; it is honored only for API keys allowed to bypass them.
+	SkipFilters bool `json:"skip_filters,omitempty" form:"skip_filters"`
+
+	// ResponseFormat "json" asks the model host for JSON and rejects
+	// responses that do not parse; it is sent upstream as a hint.
+	ResponseFormat string `json:"response_format,omitempty" form:"response_format"`
+
+	// RepairJSON lets a JSON-mode response that fails to parse be cleaned
+	// up, by dropping markdown fences and surrounding prose, before it
+	// counts as a failed try.
+	RepairJSON bool `json:"repair_json,omitempty" form:"repair_json"`
+
+	// RawOutput returns the model's text without the configured whitespace
+	// and special-token cleanup.
+	RawOutput bool `json:"raw_output,omitempty" form:"raw_output"`
+
+	// Priority is high, normal (the default) or low. Higher priority
+	// queries are dispatched first within a batch and take freed upstream
+	// slots first.
+	Priority string `json:"priority,omitempty" form:"priority"`
+}
+
+const (
+	truncatedHeader       = "X-Response-Truncated"
+	upstreamLatencyHeader = "X-Upstream-Latency-Ms"
+)
+
+// responseMeta reports how a response was produced. Upstream is whatever
+// extra metadata the model host returned, and is absent for cache hits.
+type responseMeta struct {
+	UpstreamMS int64          `json:"upstream_ms"`
+	TotalMS    int64          `json:"total_ms,omitempty"`
+	Cached     bool           `json:"cached"`
+	Upstream   map[string]any `json:"upstream,omitempty"`
+	Degraded   bool           `json:"degraded,omitempty"`
+}
+
+// server holds the settings the chat handlers need, resolved once in main.
+// Settings a reload can change live in liveConfig instead.
+type server struct {
+	model            Inferencer
+	maxBatchSize     int
+	maxPromptChars   int
+	cache            ResponseCache
+	history          HistoryStore
+	moderator        Moderator
+	jobs             *jobStore
+	callbackSigner   *callbackSigner
+	callbacks        *callbackPolicy
+	callbackAttempts int
+	embeddingsURL    string
+	embeddingsBatch  int
+	upstreamDetail   upstreamDetail
+	flights          singleflight.Group
+	prompt           *promptTemplate
+	filters          *responseFilters
+	dryRunLatency    time.Duration
+	budget           promptBudget
+	loadTestMax      int
+	audit            *auditLogger
+	chatTypes        []string
+	chunkSize        int
+	maxBodyBytes     int
+	wsOrigins        wsOrigins
+	shadow           *shadowTester
+	quota            *quotaTracker
+	degraded         *degradedResponse
+}
+
+// infer answers req from the cache when possible and otherwise calls the
+// upstream. Concurrent identical requests share one upstream call.
+// Responses are moderated, and only successful, allowed responses are
+// cached. Dry-run requests skip the cache and sharing entirely, so their
+// echoes never reach real callers.
+func (s *server) infer(ctx context.Context, req ChatRequest) (resp string, cached bool, err error) {
+	start := time.Now()
+	defer func() { s.audit.record(ctx, req, resp, start, cached, false, err) }()
+	if isDryRun(ctx) {
+		resp, err := s.model.Infer(ctx, req)
+		return resp, false, err
+	}
+	key := cacheKey(req)
+	if resp, ok := s.cache.Get(ctx, key); ok {
+		stats.cacheHit(len(resp))
+		return resp, true, nil
+	}
+	stats.cacheMiss()
+	for {
+		// Only the caller whose function runs makes the call; r.Shared is
+		// set for every caller once a second one joins.
+		var leader bool
+		ch := s.flights.DoChan(key, func() (any, error) {
+			leader = true
+			resp, err := s.model.Infer(ctx, req)
+			if err != nil {
+				return "", err
+			}
+			resp, allowed := s.moderateOutput(ctx, req, resp)
+			if allowed {
+				s.cache.Put(ctx, key, resp)
+			}
+			return resp, nil
+		})
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case r := <-ch:
+			// The shared call runs under the context of whichever caller
+			// started it; if that caller went away, try again under ours.
+			if r.Shared && ctx.Err() == nil && errors.Is(r.Err, context.Canceled) {
+				continue
+			}
+			if r.Shared && !leader && r.Err == nil {
+				stats.coalesced(coalescedSingleflight, 1, len(r.Val.(string)))
+			}
+			return r.Val.(string), false, r.Err
+		}
+	}
+}
+
+// setBackendHeader reports which backend served the request, if any, and
+// whether it was the fallback.
+func setBackendHeader(c *gin.Context, info *callInfo) {
+	if b := info.Backend(); b != "" {
+		c.Header(backendHeader, b)
+		c.Header(fallbackHeader, strconv.FormatBool(info.UsedFallback()))
+		addLogAttrs(c, "backend", b, "fallback", info.UsedFallback())
+	}
+}
+
+// checkChat applies /chat's validation and prompt budget to req, writing
+// the error response itself when req is rejected. It also settles
+// skip_filters for the caller's API key.
+func (s *server) checkChat(c *gin.Context, req *ChatRequest) bool {
+	addLogAttrs(c, chatLogAttrs(*req)...)
+	s.filters.allowBypass(c, req)
+
+	errs := validateChatRequest(*req, s.maxPromptChars)
+	if req.ResponseFormat == responseFormatJSON && strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		errs = append(errs, fieldError{"response_format", "json cannot be streamed; it is checked once the whole response is in"})
+	}
+	if len(errs) > 0 {
+		abortWithError(c, codeValidationFailed, "invalid request", gin.H{"fields": errs})
+		return false
+	}
+	return s.checkBudget(c, *req, nil)
+}
+
+// upstreamChatRequest is what /chat sends upstream for req: the system
+// prompt defaults and preamble and the prompt template applied, and the
+// conversation history prepended.
+func (s *server) upstreamChatRequest(c *gin.Context, req ChatRequest) (ChatRequest, bool) {
+	upstreamReq, err := s.prompt.apply(liveFrom(c.Request.Context()).systemPrompt.apply(req))
+	if err != nil {
+		abortWithError(c, codePromptTemplate, err.Error(), nil)
+		return upstreamReq, false
+	}
+	return withHistory(upstreamReq, s.history.Get(c.Request.Context(), req.ChatID)), true
+}
+
+func (s *server) handleChat(c *gin.Context) {
+	handlerStart := time.Now()
+	responseType := binding.MIMEJSON
+	if !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		var ok bool
+		if responseType, ok = acceptedType(c, s.chatTypes...); !ok {
+			return
+		}
+	}
+	var req ChatRequest
+	if !bindChatRequest(c, &req) {
+		return
+	}
+	if !s.checkChat(c, &req) {
+		return
+	}
+	if !s.moderateInput(c, req, nil) {
+		return
+	}
+	upstreamReq, ok := s.upstreamChatRequest(c, req)
+	if !ok {
+		return
+	}
+
+	if c.Query("raw") == "true" {
+		s.rawChat(c, req, upstreamReq)
+		return
+	}
+	if strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		if resp, ok := s.streamChat(c, upstreamReq); ok {
+			s.history.Append(c.Request.Context(), req.ChatID, turn{User: req.UserPrompt, Assistant: resp})
+		}
+		return
+	}
+
+	start := time.Now()
+	ctx, info := withCallInfo(c.Request.Context())
+	shadow := s.shadow.start(ctx, upstreamReq)
+	resp, cached, err := s.infer(ctx, upstreamReq)
+	shadow(resp, err)
+	upstreamMS := time.Since(start).Milliseconds()
+	recordUpstreamMS(c, upstreamMS)
+	addLogAttrs(c, "cached", cached)
+	c.Header(upstreamLatencyHeader, strconv.FormatInt(upstreamMS, 10))
+	setBackendHeader(c, info)
+	if err != nil && s.degraded.use(c, err) {
+		if responseType == binding.MIMEPlain {
+			c.Data(s.degraded.status, "text/plain; charset=utf-8", []byte(s.degraded.message))
+			return
+		}
+		c.JSON(s.degraded.status, gin.H{"response": s.degraded.message, "meta": responseMeta{
+			UpstreamMS: upstreamMS,
+			TotalMS:    time.Since(handlerStart).Milliseconds(),
+			Upstream:   info.Meta(),
+			Degraded:   true,
+		}})
+		return
+	}
+	if err != nil {
+		writeError(c, s.upstreamError(c, err))
+		return
+	}
+
+	if cached {
+		c.Header("X-Cache", "HIT")
+	} else {
+		c.Header("X-Cache", "MISS")
+	}
+	resp, truncated := limitResponse(req, s.filters.apply(req, resp))
+	if truncated {
+		c.Header(truncatedHeader, "true")
+	}
+	s.history.Append(c.Request.Context(), req.ChatID, turn{User: req.UserPrompt, Assistant: resp})
+
+	if responseType == binding.MIMEPlain {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(resp))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"response": resp, "meta": responseMeta{
+		UpstreamMS: upstreamMS,
+		TotalMS:    time.Since(handlerStart).Milliseconds(),
+		Cached:     cached,
+		Upstream:   info.Meta(),
+	}})
+}
+
+// handleValidateChat runs a /chat request through the same binding,
+// validation, budget and prompt building as /chat, and returns the request
+// that would be sent upstream instead of sending it. Moderation, which may
+// call out, is not run.
+func (s *server) handleValidateChat(c *gin.Context) {
+	var req ChatRequest
+	if !bindChatRequest(c, &req) {
+		return
+	}
+	if !s.checkChat(c, &req) {
+		return
+	}
+	upstreamReq, ok := s.upstreamChatRequest(c, req)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"valid": true, "upstream_request": upstreamReq})
+}
+
+// rawChat answers /chat?raw=true with the model host's own JSON body instead
+// of {"response": ...}. The body has already been parsed to find the
+// answer, so it is valid JSON. It is passed on as received, so only clients
+// trusted with upstream details (INFER_UPSTREAM_DETAIL) may ask for it:
+// response filters, output moderation, stop sequences and
+// max_response_chars cannot apply. It always calls upstream, skipping the
+// cache and shared calls, which do not keep bodies.
+func (s *server) rawChat(c *gin.Context, req, upstreamReq ChatRequest) {
+	if !s.upstreamDetail.allowed(c) {
+		abortWithError(c, codeRawNotAllowed, "raw upstream responses are not enabled for this client", nil)
+		return
+	}
+	if strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		abortWithError(c, codeValidationFailed, "invalid request", gin.H{"fields": []fieldError{
+			{"raw", "raw responses cannot be streamed"},
+		}})
+		return
+	}
+	addLogAttrs(c, "raw", true)
+	start := time.Now()
+	ctx, info := withCallInfo(c.Request.Context())
+	resp, err := s.model.Infer(ctx, upstreamReq)
+	upstreamMS := time.Since(start).Milliseconds()
+	recordUpstreamMS(c, upstreamMS)
+	c.Header(upstreamLatencyHeader, strconv.FormatInt(upstreamMS, 10))
+	setBackendHeader(c, info)
+	if err != nil {
+		s.audit.record(ctx, upstreamReq, "", start, false, false, err)
+		writeError(c, s.upstreamError(c, err))
+		return
+	}
+	body := info.Raw()
+	if body == nil {
+		// A dry run has no upstream body; build the one the host would send.
+		fields := map[string]any{"response": resp}
+		for k, v := range info.Meta() {
+			fields[k] = v
+		}
+		body, _ = json.Marshal(fields)
+	}
+	s.audit.record(ctx, upstreamReq, resp, start, false, false, nil)
+	c.Header("X-Cache", "BYPASS")
+	s.history.Append(c.Request.Context(), req.ChatID, turn{User: req.UserPrompt, Assistant: resp})
+	c.Data(http.StatusOK, "application/json", body)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func TestHandleChat(t *testing.T) {
+	valid := map[string]any{"chat_id": "c1", "user_prompt": "hello"}
+	tests := []struct {
+		name      string
+		body      any
+		err       error // returned by the model, if any, as callModelAPI would
+		status    int
+		code      string // error code; "" for a successful answer
+		wantCalls int
+	}{
+		{name: "ok", body: valid, status: http.StatusOK, wantCalls: 1},
+		{name: "missing chat_id", body: map[string]any{"user_prompt": "hello"},
+			status: http.StatusBadRequest, code: codeValidationFailed},
+		{name: "missing prompt", body: map[string]any{"chat_id": "c1", "user_prompt": "  "},
+			status: http.StatusBadRequest, code: codeValidationFailed},
+		{name: "temperature out of range", body: map[string]any{"chat_id": "c1", "user_prompt": "hello", "temperature": 9},
+			status: http.StatusBadRequest, code: codeValidationFailed},
+		{name: "malformed body", body: `{"chat_id":`, status: http.StatusBadRequest, code: codeInvalidBody},
+		{name: "upstream 500", body: valid, err: &UpstreamStatusError{StatusCode: 500, Body: "boom"},
+			status: http.StatusBadGateway, code: codeUpstreamStatus, wantCalls: 1},
+		{name: "upstream 4xx passed on", body: valid, err: &UpstreamStatusError{StatusCode: 422, Body: "bad"},
+			status: http.StatusUnprocessableEntity, code: codeUpstreamStatus, wantCalls: 1},
+		{name: "upstream 429", body: valid, err: &UpstreamStatusError{StatusCode: 429},
+			status: http.StatusTooManyRequests, code: codeUpstreamRateLimited, wantCalls: 1},
+		{name: "circuit open", body: valid, err: errCircuitOpen,
+			status: http.StatusServiceUnavailable, code: codeCircuitOpen, wantCalls: 1},
+		{name: "upstream timeout", body: valid, err: fmt.Errorf("calling upstream: %w", context.DeadlineExceeded),
+			status: http.StatusGatewayTimeout, code: codeUpstreamTimeout, wantCalls: 1},
+		{name: "connection refused", body: valid, err: fmt.Errorf("dial: %w", syscall.ECONNREFUSED),
+			status: http.StatusBadGateway, code: codeConnectionRefused, wantCalls: 1},
+		{name: "empty response", body: valid, err: errEmptyResponse,
+			status: http.StatusBadGateway, code: codeEmptyResponse, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := &fakeInferencer{}
+			if tt.err != nil {
+				model.answer = func(context.Context, ChatRequest) (string, error) { return "", classifyUpstream(tt.err) }
+			}
+			r, _ := newTestRouter(t, model, nil)
+
+			w := postJSON(t, r, "/chat", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+			}
+			if got := model.callCount(); got != tt.wantCalls {
+				t.Errorf("model called %d times, want %d", got, tt.wantCalls)
+			}
+			if tt.code != "" {
+				if got := errorCode(t, w); got != tt.code {
+					t.Errorf("error code = %q, want %q", got, tt.code)
+				}
+				return
+			}
+			var body struct {
+				Response string `json:"response"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if body.Response != "echo: hello" {
+				t.Errorf("response = %q, want %q", body.Response, "echo: hello")
+			}
+		})
+	}
+}
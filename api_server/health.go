@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	readinessTimeout  = 3 * time.Second
+	readinessCacheTTL = 5 * time.Second
+)
+
+type readinessResult struct {
+	Ready     bool
+	LatencyMS int64
+	Err       string
+	CheckedAt time.Time
+}
+
+// readinessChecker probes the live pool's health routes and caches the
+// outcome so load balancer probes don't hammer them. The service is ready
+// when any backend answers.
+type readinessChecker struct {
+	mu   sync.Mutex
+	last readinessResult
+}
+
+func (rc *readinessChecker) check(ctx context.Context) readinessResult {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.last.CheckedAt.IsZero() && time.Since(rc.last.CheckedAt) < readinessCacheTTL {
+		return rc.last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	result := readinessResult{CheckedAt: start}
+	var err error
+	for _, b := range liveFrom(ctx).pool.backends {
+		if err = probe(ctx, b.url); err == nil {
+			break
+		}
+	}
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Err = err.Error()
+	} else {
+		result.Ready = true
+	}
+	rc.last = result
+	return result
+}
+
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "circuit": breaker.currentState().String()})
+}
+
+func (rc *readinessChecker) handler(c *gin.Context) {
+	result := rc.check(c.Request.Context())
+	body := gin.H{"upstream_latency_ms": result.LatencyMS}
+	if !result.Ready {
+		body = newAPIError(codeUpstreamUnavailable, result.Err, nil).body(c)
+		body["status"] = "unavailable"
+		body["upstream_latency_ms"] = result.LatencyMS
+		c.JSON(http.StatusServiceUnavailable, body)
+		return
+	}
+	body["status"] = "ok"
+	c.JSON(http.StatusOK, body)
+}
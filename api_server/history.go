@@ -0,0 +1,253 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultHistoryMaxTurns = 10
+	defaultHistoryTTL      = 30 * time.Minute
+	defaultHistoryMaxChats = 10000
+	defaultHistoryMaxBytes = 64 << 20
+)
+
+// Backends for INFER_HISTORY_STORE.
+const (
+	historyStoreMemory = "memory"
+	historyStoreRedis  = "redis"
+)
+
+// turn is one completed user/assistant exchange.
+type turn struct {
+	User      string `json:"user"`
+	Assistant string `json:"assistant"`
+}
+
+// HistoryStore keeps the most recent turns per chat_id. Get and Append
+// never fail the request: a store that cannot be reached behaves as if the
+// chat had no history. Clear reports failures so a client asking to forget
+// a chat learns it did not happen.
+type HistoryStore interface {
+	Get(ctx context.Context, chatID string) []turn
+	Append(ctx context.Context, chatID string, t turn)
+	Clear(ctx context.Context, chatID string) error
+}
+
+// noHistory keeps nothing; it is used when INFER_HISTORY_MAX_TURNS is 0.
+type noHistory struct{}
+
+func (noHistory) Get(context.Context, string) []turn   { return nil }
+func (noHistory) Append(context.Context, string, turn) {}
+func (noHistory) Clear(context.Context, string) error  { return nil }
+
+// loadHistoryStore builds the store named by INFER_HISTORY_STORE. The
+// memory store also reads its caps, INFER_HISTORY_MAX_CHATS and
+// INFER_HISTORY_MAX_BYTES.
+func loadHistoryStore(maxTurns int, ttl time.Duration) (HistoryStore, error) {
+	kind := os.Getenv("INFER_HISTORY_STORE")
+	if maxTurns <= 0 {
+		return noHistory{}, nil
+	}
+	switch kind {
+	case "", historyStoreMemory:
+		maxChats, err := nonNegativeIntEnv("INFER_HISTORY_MAX_CHATS", defaultHistoryMaxChats)
+		if err != nil {
+			return nil, err
+		}
+		maxBytes, err := nonNegativeIntEnv("INFER_HISTORY_MAX_BYTES", defaultHistoryMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		return newMemoryHistory(maxTurns, ttl, maxChats, maxBytes), nil
+	case historyStoreRedis:
+		client, err := redisClient()
+		if err != nil {
+			return nil, err
+		}
+		return newRedisHistory(client, maxTurns, ttl), nil
+	}
+	return nil, fmt.Errorf("INFER_HISTORY_STORE %q: must be memory or redis", kind)
+}
+
+// Estimated bookkeeping cost of a tracked chat and of each turn, on top of
+// the text they hold, for INFER_HISTORY_MAX_BYTES.
+const (
+	historyChatOverhead = 128
+	historyTurnOverhead = 32
+)
+
+// Reasons a chat leaves the in-memory store, for qna_history_evictions_total.
+const (
+	evictIdle   = "ttl"
+	evictLRU    = "max_chats"
+	evictMemory = "max_bytes"
+)
+
+type conversation struct {
+	id        string
+	turns     []turn
+	bytes     int
+	updatedAt time.Time
+}
+
+// size estimates the memory conv holds.
+func (conv *conversation) size() int {
+	n := historyChatOverhead + len(conv.id)
+	for _, t := range conv.turns {
+		n += historyTurnOverhead + len(t.User) + len(t.Assistant)
+	}
+	return n
+}
+
+// memoryHistory keeps history in process memory. A chat idle for longer
+// than ttl is forgotten. Beyond maxChats chats or maxBytes estimated bytes
+// (0 means no cap), the least recently used chats are evicted, but never
+// the one just written. An evicted chat starts fresh on its next request.
+type memoryHistory struct {
+	maxTurns int
+	ttl      time.Duration
+	maxChats int
+	maxBytes int
+
+	mu        sync.Mutex
+	ll        *list.List // of *conversation, most recently used first
+	chats     map[string]*list.Element
+	bytes     int
+	lastSweep time.Time
+}
+
+func newMemoryHistory(maxTurns int, ttl time.Duration, maxChats, maxBytes int) *memoryHistory {
+	return &memoryHistory{
+		maxTurns:  maxTurns,
+		ttl:       ttl,
+		maxChats:  maxChats,
+		maxBytes:  maxBytes,
+		ll:        list.New(),
+		chats:     make(map[string]*list.Element),
+		lastSweep: time.Now(),
+	}
+}
+
+func (h *memoryHistory) Get(_ context.Context, chatID string) []turn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	el, ok := h.chats[chatID]
+	if !ok {
+		return nil
+	}
+	conv := el.Value.(*conversation)
+	if time.Since(conv.updatedAt) > h.ttl {
+		h.remove(el, evictIdle)
+		h.report()
+		return nil
+	}
+	h.ll.MoveToFront(el)
+	return append([]turn(nil), conv.turns...)
+}
+
+func (h *memoryHistory) Append(_ context.Context, chatID string, t turn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if now.Sub(h.lastSweep) > h.ttl {
+		for _, el := range h.chats {
+			if now.Sub(el.Value.(*conversation).updatedAt) > h.ttl {
+				h.remove(el, evictIdle)
+			}
+		}
+		h.lastSweep = now
+	}
+	el, ok := h.chats[chatID]
+	if ok && now.Sub(el.Value.(*conversation).updatedAt) > h.ttl {
+		h.remove(el, evictIdle)
+		ok = false
+	}
+	if !ok {
+		el = h.ll.PushFront(&conversation{id: chatID})
+		h.chats[chatID] = el
+	}
+	h.ll.MoveToFront(el)
+	conv := el.Value.(*conversation)
+	conv.turns = append(conv.turns, t)
+	if over := len(conv.turns) - h.maxTurns; over > 0 {
+		conv.turns = append([]turn(nil), conv.turns[over:]...)
+	}
+	conv.updatedAt = now
+	h.bytes -= conv.bytes
+	conv.bytes = conv.size()
+	h.bytes += conv.bytes
+
+	for h.ll.Len() > 1 {
+		switch {
+		case h.maxChats > 0 && h.ll.Len() > h.maxChats:
+			h.remove(h.ll.Back(), evictLRU)
+		case h.maxBytes > 0 && h.bytes > h.maxBytes:
+			h.remove(h.ll.Back(), evictMemory)
+		default:
+			h.report()
+			return
+		}
+	}
+	h.report()
+}
+
+func (h *memoryHistory) Clear(_ context.Context, chatID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if el, ok := h.chats[chatID]; ok {
+		h.remove(el, "")
+		h.report()
+	}
+	return nil
+}
+
+// remove drops a chat, counting it as an eviction unless reason is empty.
+// The caller holds h.mu.
+func (h *memoryHistory) remove(el *list.Element, reason string) {
+	conv := h.ll.Remove(el).(*conversation)
+	delete(h.chats, conv.id)
+	h.bytes -= conv.bytes
+	if reason != "" {
+		historyEvictionsTotal.WithLabelValues(reason).Inc()
+	}
+}
+
+// report publishes the store's size. The caller holds h.mu.
+func (h *memoryHistory) report() {
+	historyChats.Set(float64(h.ll.Len()))
+	historyBytes.Set(float64(h.bytes))
+}
+
+// withHistory prepends prior turns to the user prompt, since the model host
+// only accepts a single system and user prompt.
+func withHistory(req ChatRequest, turns []turn) ChatRequest {
+	if len(turns) == 0 {
+		return req
+	}
+	var b strings.Builder
+	b.WriteString("Previous conversation:\n")
+	for _, t := range turns {
+		b.WriteString("User: " + t.User + "\n")
+		b.WriteString("Assistant: " + t.Assistant + "\n")
+	}
+	b.WriteString("\n" + req.UserPrompt)
+	req.UserPrompt = b.String()
+	return req
+}
+
+func (s *server) handleClearHistory(c *gin.Context) {
+	if err := s.history.Clear(c.Request.Context(), c.Param("id")); err != nil {
+		abortWithError(c, codeHistoryUnavailable, "history store unavailable", nil)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
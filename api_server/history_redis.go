@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisHistoryPrefix = "qna:history:"
+	redisOpTimeout     = 500 * time.Millisecond
+)
+
+// redisClient connects to INFER_REDIS_URL, e.g. redis://:pass@host:6379/0.
+// The connection is made lazily, so a Redis that is down at startup only
+// costs history until it comes back.
+func redisClient() (*redis.Client, error) {
+	raw := os.Getenv("INFER_REDIS_URL")
+	if raw == "" {
+		return nil, fmt.Errorf("INFER_REDIS_URL is required by the redis store")
+	}
+	opts, err := redis.ParseURL(raw)
+	if err != nil {
+		return nil, fmt.Errorf("INFER_REDIS_URL: %w", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+// redisHistory keeps each chat's turns in a Redis list keyed by chat_id, so
+// every replica sees the same history. The list is trimmed to maxTurns and
+// expires ttl after the last append. Errors are logged and counted, and the
+// request carries on without history.
+type redisHistory struct {
+	client   *redis.Client
+	maxTurns int
+	ttl      time.Duration
+}
+
+func newRedisHistory(client *redis.Client, maxTurns int, ttl time.Duration) *redisHistory {
+	return &redisHistory{client: client, maxTurns: maxTurns, ttl: ttl}
+}
+
+func (h *redisHistory) Get(ctx context.Context, chatID string) []turn {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	raw, err := h.client.LRange(ctx, redisHistoryPrefix+chatID, 0, -1).Result()
+	if err != nil {
+		historyStoreFailed("get", chatID, err)
+		return nil
+	}
+	turns := make([]turn, 0, len(raw))
+	for _, r := range raw {
+		var t turn
+		if err := json.Unmarshal([]byte(r), &t); err != nil {
+			historyStoreFailed("get", chatID, err)
+			return nil
+		}
+		turns = append(turns, t)
+	}
+	return turns
+}
+
+func (h *redisHistory) Append(ctx context.Context, chatID string, t turn) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		historyStoreFailed("append", chatID, err)
+		return
+	}
+	// The response has already been sent, so the write should not be cut
+	// short by the client going away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), redisOpTimeout)
+	defer cancel()
+	key := redisHistoryPrefix + chatID
+	_, err = h.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.RPush(ctx, key, data)
+		p.LTrim(ctx, key, int64(-h.maxTurns), -1)
+		p.Expire(ctx, key, h.ttl)
+		return nil
+	})
+	if err != nil {
+		historyStoreFailed("append", chatID, err)
+	}
+}
+
+func (h *redisHistory) Clear(ctx context.Context, chatID string) error {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	if err := h.client.Del(ctx, redisHistoryPrefix+chatID).Err(); err != nil {
+		historyStoreFailed("clear", chatID, err)
+		return fmt.Errorf("clearing history: %w", err)
+	}
+	return nil
+}
+
+func historyStoreFailed(op, chatID string, err error) {
+	historyStoreErrorsTotal.WithLabelValues(op).Inc()
+	slog.Warn("history store unavailable", "op", op, "chat_id", chatID, "error", err.Error())
+}
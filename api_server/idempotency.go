@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyHeader       = "Idempotency-Key"
+	idempotencyReplayHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLen    = 255
+	defaultIdempotencyKeys  = 10000
+	defaultIdempotencyTTL   = 24 * time.Hour
+)
+
+type idempotencyEntry struct {
+	key       string
+	bodyHash  string
+	done      bool
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// idempotencyStore remembers the response to each Idempotency-Key so a
+// retried request is answered without calling upstream again. It is a
+// size-bounded LRU with a fixed TTL; a nil *idempotencyStore ignores keys.
+type idempotencyStore struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// newIdempotencyStore returns nil when size is zero, disabling the header.
+func newIdempotencyStore(size int, ttl time.Duration) *idempotencyStore {
+	if size <= 0 {
+		return nil
+	}
+	return &idempotencyStore{size: size, ttl: ttl, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// begin returns the entry already recorded for key, or records a pending
+// one and returns nil.
+func (st *idempotencyStore) begin(key, bodyHash string) *idempotencyEntry {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if el, ok := st.items[key]; ok {
+		entry := el.Value.(*idempotencyEntry)
+		if time.Now().Before(entry.expiresAt) {
+			st.ll.MoveToFront(el)
+			copied := *entry
+			return &copied
+		}
+		st.ll.Remove(el)
+		delete(st.items, key)
+	}
+	st.items[key] = st.ll.PushFront(&idempotencyEntry{key: key, bodyHash: bodyHash, expiresAt: time.Now().Add(st.ttl)})
+	for st.ll.Len() > st.size {
+		oldest := st.ll.Back()
+		st.ll.Remove(oldest)
+		delete(st.items, oldest.Value.(*idempotencyEntry).key)
+	}
+	return nil
+}
+
+// finish stores the response for a pending key, or forgets the key when
+// the response is not worth replaying, so the client may retry it.
+func (st *idempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	if !replayable(status, header) {
+		st.forget(key)
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	el, ok := st.items[key]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*idempotencyEntry)
+	entry.done, entry.status, entry.header, entry.body = true, status, header, body
+}
+
+// forget drops key, pending or not.
+func (st *idempotencyStore) forget(key string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if el, ok := st.items[key]; ok {
+		st.ll.Remove(el)
+		delete(st.items, key)
+	}
+}
+
+// replayable reports whether a response would be the same if the request
+// were sent again: a success or a 4xx about the request itself. Server
+// errors, rate limiting, client disconnects and the degraded response are
+// all worth retrying.
+func replayable(status int, header http.Header) bool {
+	switch {
+	case status >= http.StatusInternalServerError,
+		status == http.StatusTooManyRequests,
+		status == statusClientClosed,
+		header.Get(degradedHeader) != "":
+		return false
+	}
+	return true
+}
+
+// middleware replays the stored response for a repeated Idempotency-Key.
+// Keys are scoped per client, and reusing one with a different body is
+// rejected with 422.
+func (st *idempotencyStore) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader(idempotencyHeader)
+		if st == nil || raw == "" {
+			c.Next()
+			return
+		}
+		if len(raw) > maxIdempotencyKeyLen {
+			abortWithError(c, codeInvalidHeader, "Idempotency-Key must be at most 255 characters", nil)
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			writeError(c, bindError(err))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(sum[:])
+		key := clientKey(c) + "\x00" + c.FullPath() + "\x00" + raw
+		addLogAttrs(c, "idempotency_key", raw)
+
+		if prior := st.begin(key, bodyHash); prior != nil {
+			switch {
+			case prior.bodyHash != bodyHash:
+				abortWithError(c, codeIdempotencyMismatch, "Idempotency-Key was already used with a different request body", nil)
+			case !prior.done:
+				abortWithError(c, codeIdempotencyPending, "a request with this Idempotency-Key is still in progress", nil)
+			default:
+				for name, values := range prior.header {
+					c.Writer.Header()[name] = values
+				}
+				c.Header(idempotencyReplayHeader, "true")
+				c.Data(prior.status, prior.header.Get("Content-Type"), prior.body)
+				c.Abort()
+			}
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = rec
+		completed := false
+		defer func() {
+			if !completed {
+				// The handler panicked and recoverPanics answers for it;
+				// the key must not stay in progress.
+				st.forget(key)
+				return
+			}
+			header := rec.Header().Clone()
+			// Encoding is negotiated again for each replay.
+			for _, name := range []string{"Content-Encoding", "Content-Length", "Vary"} {
+				header.Del(name)
+			}
+			st.finish(key, rec.Status(), header, rec.buf.Bytes())
+		}()
+		c.Next()
+		completed = true
+	}
+}
+
+// recordingWriter keeps a copy of everything written to the response.
+type recordingWriter struct {
+	gin.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.buf.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
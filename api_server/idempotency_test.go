@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// postWithKey sends body to path with an Idempotency-Key.
+func postWithKey(t *testing.T, r http.Handler, path, key string, body any) *http.Response {
+	t.Helper()
+	req := jsonRequest(t, path, body)
+	req.Header.Set(idempotencyHeader, key)
+	return serve(r, req).Result()
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	model := &fakeInferencer{}
+	r, _ := newTestRouter(t, model, nil)
+	body := map[string]any{"chat_id": "c1", "user_prompt": "hello"}
+
+	first := postWithKey(t, r, "/chat", "k1", body)
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first status = %d, want 200", first.StatusCode)
+	}
+	again := postWithKey(t, r, "/chat", "k1", body)
+	if again.StatusCode != http.StatusOK || again.Header.Get(idempotencyReplayHeader) != "true" {
+		t.Errorf("repeat = %d with %s %q, want a 200 replay", again.StatusCode, idempotencyReplayHeader, again.Header.Get(idempotencyReplayHeader))
+	}
+	if got := model.callCount(); got != 1 {
+		t.Errorf("model called %d times, want 1", got)
+	}
+
+	other := postWithKey(t, r, "/chat", "k1", map[string]any{"chat_id": "c1", "user_prompt": "bye"})
+	if other.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("same key, other body: status = %d, want 422", other.StatusCode)
+	}
+}
+
+func TestIdempotencyForgetsRetryableResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		body   any
+		status int // of the first, failed response
+		answer func(ctx context.Context, req ChatRequest) (string, error)
+	}{
+		{
+			name:   "upstream 429",
+			path:   "/chat",
+			body:   map[string]any{"chat_id": "c1", "user_prompt": "hello"},
+			status: http.StatusTooManyRequests,
+			answer: func(context.Context, ChatRequest) (string, error) {
+				return "", classifyUpstream(&UpstreamStatusError{StatusCode: 429})
+			},
+		},
+		{
+			name:   "upstream 500",
+			path:   "/chat",
+			body:   map[string]any{"chat_id": "c1", "user_prompt": "hello"},
+			status: http.StatusBadGateway,
+			answer: func(context.Context, ChatRequest) (string, error) {
+				return "", classifyUpstream(&UpstreamStatusError{StatusCode: 500})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing := true
+			model := &fakeInferencer{answer: func(ctx context.Context, req ChatRequest) (string, error) {
+				if failing {
+					failing = false
+					return tt.answer(ctx, req)
+				}
+				return "echo: " + req.UserPrompt, nil
+			}}
+			r, _ := newTestRouter(t, model, nil)
+
+			if resp := postWithKey(t, r, tt.path, "k1", tt.body); resp.StatusCode != tt.status {
+				t.Fatalf("first status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			retry := postWithKey(t, r, tt.path, "k1", tt.body)
+			if retry.StatusCode != http.StatusOK || retry.Header.Get(idempotencyReplayHeader) != "" {
+				t.Errorf("retry = %d, replayed %q; want a fresh 200", retry.StatusCode, retry.Header.Get(idempotencyReplayHeader))
+			}
+		})
+	}
+}
+
+// panicOnce is a Moderator whose first check panics, in the handler's own
+// goroutine.
+type panicOnce struct{ panicked bool }
+
+func (m *panicOnce) Moderate(context.Context, string) (Verdict, error) {
+	if !m.panicked {
+		m.panicked = true
+		panic("moderator exploded")
+	}
+	return Verdict{Allowed: true}, nil
+}
+
+func TestIdempotencyForgetsPanickedRequest(t *testing.T) {
+	r, srv := newTestRouter(t, &fakeInferencer{}, nil)
+	srv.moderator = &panicOnce{}
+	body := map[string]any{"chat_id": "c1", "user_prompt": "hello"}
+
+	if resp := postWithKey(t, r, "/chat", "k1", body); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("first status = %d, want 500", resp.StatusCode)
+	}
+	retry := postWithKey(t, r, "/chat", "k1", body)
+	if retry.StatusCode != http.StatusOK {
+		t.Errorf("retry status = %d, want 200 rather than a key stuck in progress", retry.StatusCode)
+	}
+}
+
+func TestIdempotencyForgetsDisconnectedBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	model := &fakeInferencer{answer: func(qctx context.Context, req ChatRequest) (string, error) {
+		if ctx.Err() == nil {
+			// The client goes away while the batch is running.
+			cancel()
+			return "", context.Canceled
+		}
+		return "echo: " + req.UserPrompt, nil
+	}}
+	r, _ := newTestRouter(t, model, nil)
+	body := BatchRequest{Queries: batchOf("a")}
+
+	req := jsonRequest(t, "/chat/batched", body).WithContext(ctx)
+	req.Header.Set(idempotencyHeader, "k1")
+	if w := serve(r, req); w.Code != statusClientClosed {
+		t.Fatalf("first status = %d, want %d", w.Code, statusClientClosed)
+	}
+	retry := postWithKey(t, r, "/chat/batched", "k1", body)
+	if retry.StatusCode != http.StatusOK || retry.Header.Get(idempotencyReplayHeader) != "" {
+		t.Errorf("retry = %d, replayed %q; want a fresh 200", retry.StatusCode, retry.Header.Get(idempotencyReplayHeader))
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "context"
+
+// Inferencer produces a model response for a single query. The handlers
+// depend on it rather than on the HTTP client so the backend can be swapped.
+type Inferencer interface {
+	Infer(ctx context.Context, req ChatRequest) (string, error)
+}
+
+// InferFunc adapts an ordinary function to Inferencer.
+type InferFunc func(ctx context.Context, req ChatRequest) (string, error)
+
+func (f InferFunc) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	return f(ctx, req)
+}
+
+// httpInferencer calls the /infer endpoint of the backends in the live pool.
+type httpInferencer struct{}
+
+func (httpInferencer) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	return callModelAPI(ctx, liveFrom(ctx).pool, req)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultJobRetention = time.Hour
+
+const (
+	jobStatusPending = "pending"
+	jobStatusRunning = "running"
+	jobStatusDone    = "done"
+
+	// jobStatusCancelled is set by DELETE /jobs/:id. The job keeps the
+	// results of queries that finished first.
+	jobStatusCancelled = "cancelled"
+)
+
+// job is a batch submitted through POST /jobs and run in the background.
+type job struct {
+	ID         string        `json:"job_id"`
+	Status     string        `json:"status"`
+	Size       int           `json:"batch_size"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	CacheHits  int64         `json:"cache_hits"`
+	Results    []batchResult `json:"results,omitempty"`
+	Summary    *batchSummary `json:"summary,omitempty"`
+
+	CallbackURL    string `json:"callback_url,omitempty"`
+	CallbackStatus string `json:"callback_status,omitempty"`
+
+	// cancel stops the job's context; it is nil once the job has finished.
+	cancel context.CancelFunc
+}
+
+// jobRequest is a batch plus an optional URL to POST the finished job to.
+type jobRequest struct {
+	BatchRequest
+	CallbackURL string `json:"callback_url"`
+}
+
+// jobStore holds jobs in memory. Finished jobs are dropped once they are
+// older than retention.
+type jobStore struct {
+	retention time.Duration
+
+	mu        sync.Mutex
+	jobs      map[string]*job
+	lastSweep time.Time
+}
+
+func newJobStore(retention time.Duration) *jobStore {
+	return &jobStore{retention: retention, jobs: make(map[string]*job), lastSweep: time.Now()}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "job-" + hex.EncodeToString(b)
+}
+
+func (js *jobStore) expired(j *job, now time.Time) bool {
+	return j.FinishedAt != nil && now.Sub(*j.FinishedAt) > js.retention
+}
+
+func (js *jobStore) create(size int, callbackURL string, cancel context.CancelFunc) *job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	now := time.Now()
+	if now.Sub(js.lastSweep) > js.retention {
+		for id, j := range js.jobs {
+			if js.expired(j, now) {
+				delete(js.jobs, id)
+			}
+		}
+		js.lastSweep = now
+	}
+	j := &job{ID: newJobID(), Status: jobStatusPending, Size: size, CreatedAt: now, CallbackURL: callbackURL, cancel: cancel}
+	js.jobs[j.ID] = j
+	return j
+}
+
+// get returns a snapshot of the job, so callers can read it without the lock.
+func (js *jobStore) get(id string) (job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	j, ok := js.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	if js.expired(j, time.Now()) {
+		delete(js.jobs, id)
+		return job{}, false
+	}
+	return *j, true
+}
+
+// update applies fn to the job under the lock and returns the result.
+func (js *jobStore) update(id string, fn func(*job)) job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	j, ok := js.jobs[id]
+	if !ok {
+		return job{}
+	}
+	fn(j)
+	return *j
+}
+
+// handleSubmitJob accepts a batch, answers 202 with the job ID and runs the
+// batch after the request has returned.
+func (s *server) handleSubmitJob(c *gin.Context) {
+	var jobReq jobRequest
+	if err := bindJSON(c, &jobReq); err != nil {
+		writeError(c, bindError(err))
+		return
+	}
+	if jobReq.CallbackURL != "" {
+		if err := s.callbacks.check(jobReq.CallbackURL); err != nil {
+			abortWithError(c, codeValidationFailed, err.Error(), gin.H{"fields": []fieldError{{"callback_url", err.Error()}}})
+			return
+		}
+	}
+	if !s.checkBatch(c, jobReq.BatchRequest, nil) {
+		return
+	}
+	batchReq := jobReq.BatchRequest
+
+	// The job outlives the request, including any X-Request-Timeout-Ms
+	// deadline; only the request ID is carried over. DELETE /jobs/:id
+	// cancels it.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+	j := s.jobs.create(len(batchReq.Queries), jobReq.CallbackURL, cancel)
+	addLogAttrs(c, "job_id", j.ID)
+	go s.runJob(ctx, j.ID, batchReq.Queries, batchReq.FailFast)
+
+	c.Header("Location", "/jobs/"+j.ID)
+	c.JSON(http.StatusAccepted, gin.H{"job_id": j.ID, "status": j.Status})
+}
+
+func (s *server) runJob(ctx context.Context, id string, queries []ChatRequest, failFast bool) {
+	s.jobs.update(id, func(j *job) {
+		if j.Status == jobStatusPending {
+			j.Status = jobStatusRunning
+		}
+	})
+	start := time.Now()
+	bctx, ff := withFailFast(ctx, failFast)
+	results, cacheHits := s.runBatch(bctx, queries, nil)
+	ff.stop()
+	done := s.jobs.update(id, func(j *job) {
+		now := time.Now()
+		if j.Status != jobStatusCancelled {
+			j.Status = jobStatusDone
+		}
+		j.cancel()
+		j.cancel = nil
+		j.FinishedAt = &now
+		j.CacheHits = cacheHits
+		j.Results = results
+		sum := summarize(results)
+		sum.Aborted = ff.aborted()
+		j.Summary = &sum
+	})
+	slog.Info("job finished", "job_id", id, "request_id", requestIDFrom(ctx), "status", done.Status,
+		"batch_size", len(queries), "duration_ms", time.Since(start).Milliseconds())
+
+	if done.CallbackURL == "" {
+		return
+	}
+	status := callbackDelivered
+	// A cancelled job still reports to its callback.
+	if err := s.deliverCallback(context.WithoutCancel(ctx), done.CallbackURL, done); err != nil {
+		slog.Error("job callback failed", "job_id", id, "error", err.Error())
+		status = callbackFailed
+	}
+	s.jobs.update(id, func(j *job) { j.CallbackStatus = status })
+}
+
+func (s *server) handleGetJob(c *gin.Context) {
+	j, ok := s.jobs.get(c.Param("id"))
+	if !ok {
+		abortWithError(c, codeNotFound, "unknown or expired job", nil)
+		return
+	}
+	c.JSON(http.StatusOK, j)
+}
+
+// handleCancelJob stops a pending or running job. Queries not yet started
+// are skipped and in-flight upstream calls are aborted, freeing their slots
+// at once. The job is reported as cancelled straight away and gets its
+// results, including those of queries that had already finished, once the
+// batch has unwound. Cancelling a cancelled job again is a no-op.
+func (s *server) handleCancelJob(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := s.jobs.get(id); !ok {
+		abortWithError(c, codeNotFound, "unknown or expired job", nil)
+		return
+	}
+	j := s.jobs.update(id, func(j *job) {
+		if j.Status == jobStatusDone {
+			return
+		}
+		j.Status = jobStatusCancelled
+		if j.cancel != nil {
+			j.cancel()
+		}
+	})
+	addLogAttrs(c, "job_id", id)
+	if j.Status == jobStatusDone {
+		abortWithError(c, codeJobFinished, "job already finished", gin.H{"job_id": id, "status": j.Status})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job_id": id, "status": j.Status})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Values for ChatRequest.ResponseFormat. The empty string means text.
+const (
+	responseFormatText = "text"
+	responseFormatJSON = "json"
+)
+
+const defaultJSONModeAttempts = 2
+
+// maxJSONRepairStarts bounds how many opening brackets repairJSON tries, so
+// a long response full of them cannot make it quadratic.
+const maxJSONRepairStarts = 16
+
+var jsonRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qna_json_repairs_total",
+	Help: "Invalid JSON-mode responses with repair_json, by whether repair found valid JSON.",
+}, []string{"outcome"})
+
+// InvalidJSONError is returned when a JSON-mode query got a response that
+// does not parse as JSON on every one of Attempts tries.
+type InvalidJSONError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *InvalidJSONError) Error() string {
+	return fmt.Sprintf("model response is not valid JSON after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *InvalidJSONError) Unwrap() error { return e.Err }
+
+// jsonModeInferencer checks that JSON-mode responses parse, asking next
+// again up to attempts times in all. Other queries pass straight through.
+// The model host gets the response_format hint with every try.
+type jsonModeInferencer struct {
+	next     Inferencer
+	attempts int
+}
+
+func (j jsonModeInferencer) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	if req.ResponseFormat != responseFormatJSON {
+		return j.next.Infer(ctx, req)
+	}
+	var invalid error
+	for attempt := 1; attempt <= j.attempts; attempt++ {
+		resp, err := j.next.Infer(ctx, req)
+		if err != nil {
+			return "", err
+		}
+		if invalid = checkJSON(resp); invalid == nil {
+			return resp, nil
+		}
+		if req.RepairJSON {
+			if fixed, repairs, ok := repairJSON(resp); ok {
+				jsonRepairs.WithLabelValues("repaired").Inc()
+				slog.Info("repaired model JSON",
+					"request_id", requestIDFrom(ctx), "chat_id", req.ChatID, "attempt", attempt, "repairs", repairs,
+					"removed_bytes", len(resp)-len(fixed))
+				return fixed, nil
+			}
+			jsonRepairs.WithLabelValues("failed").Inc()
+		}
+		slog.Warn("model response is not valid JSON",
+			"request_id", requestIDFrom(ctx), "chat_id", req.ChatID, "attempt", attempt, "max_attempts", j.attempts, "error", invalid.Error())
+	}
+	return "", &InvalidJSONError{Attempts: j.attempts, Err: invalid}
+}
+
+// checkJSON reports why resp, ignoring surrounding whitespace, is not a
+// single JSON value.
+func checkJSON(resp string) error {
+	var v any
+	return json.Unmarshal([]byte(resp), &v)
+}
+
+// repairJSON recovers the JSON in a near-valid JSON-mode response: one in a
+// markdown fence, or with prose before or after it. It returns the fenced
+// value if that parses, or else the first object or array that does, with
+// what had to be removed to find it ("fence", "prose"). It reports false if
+// there is no such value.
+func repairJSON(resp string) (string, []string, bool) {
+	text := strings.TrimSpace(resp)
+	var repairs []string
+	if inner, prose, ok := fencedBlock(text); ok {
+		text = inner
+		repairs = append(repairs, "fence")
+		if checkJSON(text) == nil {
+			if prose {
+				repairs = append(repairs, "prose")
+			}
+			return text, repairs, true
+		}
+	}
+	rest := text
+	for tries := 0; tries < maxJSONRepairStarts; tries++ {
+		i := strings.IndexAny(rest, "{[")
+		if i < 0 {
+			break
+		}
+		start := len(text) - len(rest) + i
+		dec := json.NewDecoder(strings.NewReader(text[start:]))
+		var v json.RawMessage
+		if dec.Decode(&v) == nil {
+			end := start + int(dec.InputOffset())
+			if strings.TrimSpace(text[:start]) != "" || strings.TrimSpace(text[end:]) != "" {
+				repairs = append(repairs, "prose")
+			}
+			return text[start:end], repairs, true
+		}
+		rest = rest[i+1:]
+	}
+	return "", nil, false
+}
+
+// fencedBlock returns the contents of the first ``` fence in text, without
+// its language tag, and whether there is text outside the fence. An
+// unclosed fence runs to the end of text.
+func fencedBlock(text string) (inner string, prose, ok bool) {
+	before, after, ok := strings.Cut(text, "```")
+	if !ok {
+		return "", false, false
+	}
+	// The opening fence's line holds at most a language tag, such as json.
+	if tag, body, ok := strings.Cut(after, "\n"); ok && !strings.ContainsAny(tag, "{[") {
+		after = body
+	}
+	inner, rest, _ := strings.Cut(after, "```")
+	return strings.TrimSpace(inner), strings.TrimSpace(before+rest) != "", true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultHTTP2MaxStreams   = 250
+)
+
+// listenerSettings tunes the HTTP server in front of the router. A zero
+// read or write timeout means none, which is the default for both so that
+// long streams are not cut off.
+type listenerSettings struct {
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	keepAlives        bool
+	http2             bool
+	h2c               bool
+	maxStreams        int
+}
+
+// loadListenerSettings reads the INFER_*_TIMEOUT, INFER_KEEPALIVES and
+// INFER_HTTP2* settings. h2c is plaintext HTTP/2, so it needs HTTP/2 on and
+// TLS off (tlsOn).
+func loadListenerSettings(tlsOn bool) (listenerSettings, error) {
+	var l listenerSettings
+	var err error
+	if l.readTimeout, err = durationEnv("INFER_READ_TIMEOUT", 0); err != nil {
+		return l, err
+	}
+	if l.readHeaderTimeout, err = durationEnv("INFER_READ_HEADER_TIMEOUT", defaultReadHeaderTimeout); err != nil {
+		return l, err
+	}
+	if l.writeTimeout, err = durationEnv("INFER_WRITE_TIMEOUT", 0); err != nil {
+		return l, err
+	}
+	if l.idleTimeout, err = durationEnv("INFER_IDLE_TIMEOUT", defaultIdleTimeout); err != nil {
+		return l, err
+	}
+	if l.keepAlives, err = boolEnv("INFER_KEEPALIVES", true); err != nil {
+		return l, err
+	}
+	if l.http2, err = boolEnv("INFER_HTTP2", true); err != nil {
+		return l, err
+	}
+	if l.h2c, err = boolEnv("INFER_H2C", false); err != nil {
+		return l, err
+	}
+	if l.maxStreams, err = positiveIntEnv("INFER_HTTP2_MAX_STREAMS", defaultHTTP2MaxStreams); err != nil {
+		return l, err
+	}
+	switch {
+	case l.h2c && !l.http2:
+		return l, errors.New("INFER_H2C needs INFER_HTTP2")
+	case l.h2c && tlsOn:
+		return l, errors.New("INFER_H2C is for plaintext listeners; TLS already offers HTTP/2")
+	}
+	return l, nil
+}
+
+// newHTTPServer builds the server for handler. With TLS, HTTP/2 is offered
+// through ALPN unless disabled; with h2c, plaintext connections may upgrade
+// or open with the HTTP/2 preface. Either way HTTP/1.1 stays available.
+func newHTTPServer(addr string, handler http.Handler, tlsConfig *tls.Config, l listenerSettings) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       l.readTimeout,
+		ReadHeaderTimeout: l.readHeaderTimeout,
+		WriteTimeout:      l.writeTimeout,
+		IdleTimeout:       l.idleTimeout,
+	}
+	srv.SetKeepAlivesEnabled(l.keepAlives)
+	if !l.http2 {
+		// A non-nil, empty map stops net/http from adding h2 to ALPN.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return srv, nil
+	}
+	h2s := &http2.Server{MaxConcurrentStreams: uint32(l.maxStreams), IdleTimeout: l.idleTimeout}
+	// ConfigureServer also hooks h2s into Shutdown, so h2c connections get
+	// a GOAWAY on drain like TLS ones.
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		// ConfigureServer fills in an empty TLSConfig, which would make
+		// serveUntilSignal try to serve HTTPS.
+		srv.TLSConfig = nil
+	}
+	if l.h2c {
+		srv.Handler = h2c.NewHandler(handler, h2s)
+	}
+	return srv, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLoadTestMaxRequests = 1000
+	defaultLoadTestConcurrency = 8
+	maxLoadTestConcurrency     = 64
+	defaultLoadTestPrompt      = "Say OK."
+)
+
+// loadTestSettings controls POST /loadtest, which is off unless
+// INFER_LOADTEST=true.
+type loadTestSettings struct {
+	enabled     bool
+	maxRequests int
+}
+
+// loadLoadTestSettings reads INFER_LOADTEST and INFER_LOADTEST_MAX_REQUESTS.
+// The route sends real traffic to the model host, so it also needs
+// INFER_DEV_MODE=true, is refused with GIN_MODE=release, and cannot be
+// turned on by a SIGHUP reload.
+func loadLoadTestSettings() (loadTestSettings, error) {
+	var l loadTestSettings
+	var err error
+	if l.enabled, err = boolEnv("INFER_LOADTEST", false); err != nil {
+		return l, err
+	}
+	if l.maxRequests, err = positiveIntEnv("INFER_LOADTEST_MAX_REQUESTS", defaultLoadTestMaxRequests); err != nil {
+		return l, err
+	}
+	if !l.enabled {
+		return l, nil
+	}
+	dev, err := devModeEnv()
+	if err != nil {
+		return l, err
+	}
+	if !dev {
+		return l, errors.New("INFER_LOADTEST is for development and needs INFER_DEV_MODE=true")
+	}
+	if os.Getenv(gin.EnvGinMode) == gin.ReleaseMode {
+		return l, errors.New("INFER_LOADTEST is for development and cannot be used with GIN_MODE=release")
+	}
+	return l, nil
+}
+
+// LoadTestRequest is the body of POST /loadtest. Every synthetic query
+// uses the same prompts; missing fields take the defaults.
+type LoadTestRequest struct {
+	Requests     int    `json:"requests"`
+	Concurrency  int    `json:"concurrency"`
+	SystemPrompt string `json:"system_prompt"`
+	UserPrompt   string `json:"user_prompt"`
+}
+
+// latencySummary is in milliseconds.
+type latencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+type loadTestReport struct {
+	Requests          int            `json:"requests"`
+	Concurrency       int            `json:"concurrency"`
+	Succeeded         int            `json:"succeeded"`
+	Failed            int            `json:"failed"`
+	Errors            map[string]int `json:"errors"`
+	DurationMS        int64          `json:"duration_ms"`
+	RequestsPerSecond float64        `json:"requests_per_second"`
+	LatencyMS         latencySummary `json:"latency_ms"`
+}
+
+// handleLoadTest fires Requests synthetic queries at the live upstream,
+// Concurrency at a time, through the same inference chain as /chat minus
+// the cache, and reports throughput and latency percentiles. Failures are
+// counted by error code. Disconnecting stops the run.
+func (s *server) handleLoadTest(c *gin.Context) {
+	var req LoadTestRequest
+	if err := bindJSON(c, &req); err != nil {
+		writeError(c, bindError(err))
+		return
+	}
+	if req.Requests == 0 {
+		req.Requests = 1
+	}
+	if req.Concurrency == 0 {
+		req.Concurrency = min(defaultLoadTestConcurrency, req.Requests)
+	}
+	if req.UserPrompt == "" {
+		req.UserPrompt = defaultLoadTestPrompt
+	}
+	var errs []fieldError
+	if req.Requests < 0 || req.Requests > s.loadTestMax {
+		errs = append(errs, fieldError{"requests", fmt.Sprintf("must be between 1 and %d", s.loadTestMax)})
+	}
+	if req.Concurrency < 0 || req.Concurrency > maxLoadTestConcurrency {
+		errs = append(errs, fieldError{"concurrency", fmt.Sprintf("must be between 1 and %d", maxLoadTestConcurrency)})
+	}
+	if len(errs) > 0 {
+		abortWithError(c, codeValidationFailed, "invalid request", gin.H{"fields": errs})
+		return
+	}
+	addLogAttrs(c, "loadtest_requests", req.Requests, "loadtest_concurrency", req.Concurrency)
+
+	ctx := c.Request.Context()
+	parentID := requestIDFrom(ctx)
+	latencies := make([]time.Duration, 0, req.Requests)
+	report := loadTestReport{Requests: req.Requests, Concurrency: req.Concurrency, Errors: map[string]int{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for range req.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				q := ChatRequest{ChatID: fmt.Sprintf("loadtest-%d", i), SystemPrompt: req.SystemPrompt, UserPrompt: req.UserPrompt}
+				start := time.Now()
+				_, err := s.model.Infer(withRequestID(ctx, fmt.Sprintf("%s-%d", parentID, i)), q)
+				elapsed := time.Since(start)
+				mu.Lock()
+				if err != nil {
+					report.Failed++
+					report.Errors[upstreamErrorCode(err)]++
+				} else {
+					report.Succeeded++
+					latencies = append(latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	start := time.Now()
+	for i := 0; i < req.Requests && ctx.Err() == nil; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+	if clientGone(c) {
+		return
+	}
+
+	report.DurationMS = elapsed.Milliseconds()
+	if elapsed > 0 {
+		report.RequestsPerSecond = float64(report.Succeeded+report.Failed) / elapsed.Seconds()
+	}
+	report.LatencyMS = summarizeLatencies(latencies)
+	c.JSON(http.StatusOK, report)
+}
+
+// summarizeLatencies reports nearest-rank percentiles of the successful
+// calls; it is all zeros when none succeeded.
+func summarizeLatencies(d []time.Duration) latencySummary {
+	if len(d) == 0 {
+		return latencySummary{}
+	}
+	slices.Sort(d)
+	ms := func(v time.Duration) float64 { return float64(v.Microseconds()) / 1000 }
+	at := func(p float64) float64 { return ms(d[max(0, int(math.Ceil(p*float64(len(d))))-1)]) }
+	var total time.Duration
+	for _, v := range d {
+		total += v
+	}
+	return latencySummary{
+		Min:  ms(d[0]),
+		Mean: ms(total / time.Duration(len(d))),
+		P50:  at(0.50),
+		P90:  at(0.90),
+		P99:  at(0.99),
+		Max:  ms(d[len(d)-1]),
+	}
+}
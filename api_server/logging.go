@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prompt logging modes for INFER_LOG_PROMPTS. Prompts are omitted by default
+// so user content doesn't end up in logs.
+const (
+	promptLogNone      = "none"
+	promptLogTruncated = "truncated"
+	promptLogFull      = "full"
+)
+
+const promptLogMaxChars = 64
+
+const logAttrsKey = "log_attrs"
+
+// promptLogMode is set from INFER_LOG_PROMPTS in main.
+var promptLogMode = promptLogNone
+
+// logLevel is the minimum level written, set from INFER_LOG_LEVEL in main.
+var logLevel = new(slog.LevelVar)
+
+// slowRequestThreshold is set from INFER_SLOW_REQUEST_THRESHOLD in main.
+// When set, successful requests and batch queries are logged at WARN if
+// their upstream latency exceeds it and at DEBUG otherwise.
+var slowRequestThreshold time.Duration
+
+const upstreamMSKey = "upstream_ms"
+
+func parseLogLevel() (slog.Level, error) {
+	var level slog.Level
+	raw := os.Getenv("INFER_LOG_LEVEL")
+	if raw == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(raw)); err != nil {
+		return 0, fmt.Errorf("INFER_LOG_LEVEL %q: must be debug, info, warn or error", raw)
+	}
+	return level, nil
+}
+
+func logPromptMode() (string, error) {
+	raw := os.Getenv("INFER_LOG_PROMPTS")
+	switch raw {
+	case "":
+		return promptLogNone, nil
+	case promptLogNone, promptLogTruncated, promptLogFull:
+		return raw, nil
+	}
+	return "", fmt.Errorf("INFER_LOG_PROMPTS %q: must be one of none, truncated, full", raw)
+}
+
+// chatLogAttrs describes a query for logging, including prompt content only
+// when promptLogMode allows it.
+func chatLogAttrs(req ChatRequest) []any {
+	attrs := []any{
+		"chat_id", req.ChatID,
+		"system_prompt_len", len(req.SystemPrompt),
+		"user_prompt_len", len(req.UserPrompt),
+	}
+	switch promptLogMode {
+	case promptLogTruncated:
+		attrs = append(attrs,
+			"system_prompt", truncate(req.SystemPrompt, promptLogMaxChars),
+			"user_prompt", truncate(req.UserPrompt, promptLogMaxChars))
+	case promptLogFull:
+		attrs = append(attrs, "system_prompt", req.SystemPrompt, "user_prompt", req.UserPrompt)
+	}
+	return attrs
+}
+
+// recordUpstreamMS logs the time c spent upstream and keeps it for the
+// slow request check.
+func recordUpstreamMS(c *gin.Context, ms int64) {
+	c.Set(upstreamMSKey, ms)
+	addLogAttrs(c, "upstream_ms", ms)
+}
+
+// latencyLevel picks the level for a successful request or batch query that
+// spent ms upstream, and reports whether it was slow.
+func latencyLevel(ms int64) (slog.Level, bool) {
+	switch {
+	case slowRequestThreshold <= 0:
+		return slog.LevelInfo, false
+	case time.Duration(ms)*time.Millisecond > slowRequestThreshold:
+		return slog.LevelWarn, true
+	default:
+		return slog.LevelDebug, false
+	}
+}
+
+// addLogAttrs attaches key/value pairs to the access log line for c.
+func addLogAttrs(c *gin.Context, attrs ...any) {
+	prev, _ := c.Get(logAttrsKey)
+	existing, _ := prev.([]any)
+	c.Set(logAttrsKey, append(existing, attrs...))
+}
+
+// requestLogger emits one structured line per request once the handler has
+// finished, with any attributes the handler recorded via addLogAttrs. With a
+// slow request threshold, successful requests are logged as "slow request"
+// at WARN or as "request" at DEBUG; routes that record no upstream latency,
+// such as batches, count as fast.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.FullPath(),
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}
+		if extra, ok := c.Get(logAttrsKey); ok {
+			attrs = append(attrs, extra.([]any)...)
+		}
+		msg := "request"
+		var level slog.Level
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		default:
+			v, _ := c.Get(upstreamMSKey)
+			ms, _ := v.(int64)
+			var slow bool
+			if level, slow = latencyLevel(ms); slow {
+				msg = "slow request"
+				attrs = append(attrs, "slow_threshold_ms", slowRequestThreshold.Milliseconds())
+			}
+		}
+		slog.Log(c.Request.Context(), level, msg, attrs...)
+	}
+}
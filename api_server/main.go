@@ -1,94 +1,222 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
-	"sync"
+	"os"
+	"slices"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const HF_SPACE_URL = "https://trinitysoul-infer-tifin.hf.space/infer"
-
-type ChatRequest struct {
-	ChatID       string `json:"chat_id"`
-	SystemPrompt string `json:"system_prompt"`
-	UserPrompt   string `json:"user_prompt"`
-}
+const (
+	defaultBatchConcurrency = 16
+	defaultMaxBatchSize     = 100
+)
 
-type BatchRequest struct {
-	Queries []ChatRequest `json:"queries"`
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err.Error())
+	os.Exit(1)
 }
 
-type ModelResponse struct {
-	Response string `json:"response"`
-}
+func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
 
-func callModelAPI(req ChatRequest) (string, error) {
-	body, _ := json.Marshal(req)
-	resp, err := http.Post(HF_SPACE_URL, "application/json", bytes.NewBuffer(body))
+	cfgFile, err := loadConfigFile()
 	if err != nil {
-		fmt.Printf("Error: %s", err)
-		return "", err
+		fatal("invalid configuration", err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+	defer shutdownTracing(context.Background())
+	transport := newUpstreamTransport(max(upstreamMaxIdleConnsPerHost, cfg.batchConcurrency))
+	installConfig(cfg, transport)
+	go reloadOnSignal(cfgFile, transport)
+	slog.Info("using inference upstream", "urls", cfg.upstreams, "fallback", cfg.fallbackURL, "timeout", cfg.timeout.String(),
+		"chat_timeout", cfg.chatTimeout.String(), "batch_timeout", cfg.batchTimeout.String())
+	if len(cfg.upstreamHeaders) > 0 {
+		names := make([]string, 0, len(cfg.upstreamHeaders))
+		for name := range cfg.upstreamHeaders {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		slog.Info("sending upstream headers", "names", names)
+	}
+	if len(cfg.apiKeys) == 0 {
+		slog.Warn("no API keys configured; authentication is disabled")
 	}
 
-	defer resp.Body.Close()
+	go watchBackends(context.Background())
+	if cfg.warmup && !cfg.dryRun {
+		go warmBackends(context.Background(), cfg.keepAliveInterval)
+	}
 
-	data, _ := io.ReadAll(resp.Body)
-	var modelResp ModelResponse
-	json.Unmarshal(data, &modelResp)
-	return modelResp.Response, nil
+	srv, err := newServer(cfg, httpInferencer{})
+	if err != nil {
+		fatal("opening audit log", err)
+	}
+	r, err := newRouter(cfg, srv)
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+	if srv.degraded != nil {
+		slog.Info("degraded responses on; /chat answers with INFER_DEGRADED_RESPONSE while the upstream is unavailable", "status", srv.degraded.status)
+	}
+	if srv.quota != nil {
+		slog.Info("daily quotas on", "default", cfg.quota.daily, "per_key", len(srv.quota.perKey), "mode", cfg.quota.mode,
+			"next_reset", srv.quota.nextReset())
+	}
+	if srv.shadow != nil {
+		slog.Info("shadow testing on", "url", cfg.shadow.url, "sample_rate", cfg.shadow.rate, "max_inflight", cfg.shadow.maxInflight)
+	}
+	if upstreamDebug != nil {
+		slog.Warn("upstream debug logging is on; upstream request and response bodies are logged", "max_bytes", cfg.upstreamDebug.maxBytes)
+	}
+	if cfg.loadTest.enabled {
+		slog.Warn("load-test mode is on; POST /loadtest sends synthetic traffic upstream", "max_requests", cfg.loadTest.maxRequests)
+	}
 
+	httpServer, err := newHTTPServer(cfg.listenAddr, r, cfg.tls, cfg.listener)
+	if err != nil {
+		fatal("configuring listener", err)
+	}
+	slog.Info("listening", "addr", cfg.listenAddr, "tls", cfg.tls != nil, "http2", cfg.listener.http2, "h2c", cfg.listener.h2c)
+	err = serveUntilSignal(httpServer, cfg.shutdownTimeout)
+	srv.audit.close()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("server stopped", err)
+	}
 }
 
-func main() {
-	r := gin.Default()
-
-	r.POST("/chat", func(c *gin.Context) {
-		var req ChatRequest
-		if err := c.BindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+// installConfig publishes cfg as the live configuration and sets the
+// package-level upstream settings the handlers read.
+func installConfig(cfg config, transport http.RoundTripper) {
+	live.Store(newLiveConfig(cfg, transport, nil))
+	maxAttempts = cfg.maxAttempts
+	maxUpstreamResponseBytes = int64(cfg.maxUpstreamBytes)
+	rejectEmptyResponses = cfg.rejectEmpty
+	promptLogMode = cfg.promptLogMode
+	logLevel.Set(cfg.logLevel)
+	slowRequestThreshold = cfg.slowThreshold
+	upstreamGzip = cfg.upstreamGzip
+	upstreamHeaders = cfg.upstreamHeaders
+	upstreamDebug = newUpstreamDebugLogger(cfg.upstreamDebug, cfg.filters)
+	upstreamSlots = newUpstreamLimiter(cfg.upstreamConcurrency, cfg.upstreamLimitPolicy, cfg.upstreamQueueTimeout, cfg.fairBy, cfg.priorityAging)
+	adaptive = newAdaptiveLimiter(cfg.adaptiveEnabled, cfg.adaptiveMin, cfg.adaptiveMax, cfg.adaptiveTarget)
+	breaker = newCircuitBreaker(cfg.breakerThreshold, cfg.breakerCooldown)
+}
 
-		resp, err := callModelAPI(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+// newServer wraps base in the configured inference layers and builds the
+// handlers' server around it.
+func newServer(cfg config, base Inferencer) (*server, error) {
+	model := base
+	if cfg.chunkSize > 0 {
+		model = chunkInferencer{next: model}
+	}
+	if cfg.microBatch {
+		model = newMicroBatcher(model, cfg.microBatchWait, cfg.microBatchSize)
+	}
+	model = cleanupInferencer{next: model, cleanup: cfg.cleanup}
+	srv := &server{
+		model:            dryRunInferencer{next: jsonModeInferencer{next: model, attempts: cfg.jsonAttempts}, latency: cfg.dryRunLatency},
+		dryRunLatency:    cfg.dryRunLatency,
+		maxBatchSize:     cfg.maxBatchSize,
+		maxPromptChars:   cfg.maxPromptChars,
+		cache:            cfg.cache,
+		history:          cfg.history,
+		moderator:        cfg.moderator,
+		jobs:             newJobStore(cfg.jobRetention),
+		callbackSigner:   newCallbackSigner(cfg.callbackSecret),
+		callbacks:        newCallbackPolicy(cfg.callbackHosts),
+		callbackAttempts: cfg.callbackAttempts,
+		embeddingsURL:    cfg.embeddingsURL,
+		embeddingsBatch:  cfg.embeddingsBatch,
+		upstreamDetail:   cfg.upstreamDetail,
+		prompt:           cfg.prompt,
+		filters:          cfg.filters,
+		budget:           cfg.budget,
+		loadTestMax:      cfg.loadTest.maxRequests,
+		chatTypes:        cfg.chatTypes,
+		chunkSize:        cfg.chunkSize,
+		maxBodyBytes:     cfg.maxBodyBytes,
+		wsOrigins:        cfg.corsOrigins,
+		shadow:           newShadowTester(cfg.shadow, cfg.cleanup, cfg.filters),
+		quota:            newQuotaTracker(cfg.quota, cfg.apiKeys),
+		degraded:         newDegradedResponse(cfg.degraded),
+	}
+	var err error
+	if srv.audit, err = newAuditLogger(cfg.audit); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
 
-		c.JSON(http.StatusOK, gin.H{"response": resp})
-	})
+// newRouter registers the middleware and routes for srv.
+func newRouter(cfg config, srv *server) (*gin.Engine, error) {
+	readiness := &readinessChecker{}
 
-	r.POST("/chat/batched", func(c *gin.Context) {
-		var batchReq BatchRequest
-		if err := c.BindJSON(&batchReq); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	r := gin.New()
+	r.Use(requestID(), pinLive(), traceRequests(), trackInflight(), requestLogger(), metricsMiddleware(), recoverPanics())
+	if len(cfg.corsOrigins) > 0 {
+		r.Use(corsMiddleware(cfg.corsOrigins))
+	}
+	r.Use(compressResponses(cfg.gzipMinBytes))
 
-		var wg sync.WaitGroup
-		responses := make([]string, len(batchReq.Queries))
-
-		for i, q := range batchReq.Queries {
-			wg.Add(1)
-			go func(i int, q ChatRequest) {
-				defer wg.Done()
-				resp, err := callModelAPI(q)
-				if err != nil {
-					responses[i] = "Error: " + err.Error()
-				} else {
-					responses[i] = resp
-				}
-			}(i, q)
-		}
+	r.NoRoute(notFound)
+	r.GET("/healthz", healthzHandler)
+	r.GET("/readyz", readiness.handler)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-		wg.Wait()
-		c.JSON(http.StatusOK, gin.H{"responses": responses})
-	})
+	api := r.Group("/")
+	if len(cfg.apiKeys) > 0 {
+		api.Use(requireAPIKey(cfg.apiKeys))
+	}
+	api.Use(limitBody(int64(cfg.maxBodyBytes)), decompressBody(int64(cfg.maxBodyBytes)), handlerTimeout(cfg.handlerTimeout), requestDeadline(), dryRun(cfg.dryRun))
+	if cfg.fairBy == fairByAPIKey {
+		api.Use(tagFairClient())
+	}
 
-	r.Run(":8080")
+	single := api.Group("/", rateLimitRequests(false))
+	batched := api.Group("/", rateLimitRequests(true))
+	idempotent := newIdempotencyStore(cfg.idempotencyKeys, cfg.idempotencyTTL).middleware()
+	queued := newRequestQueue(cfg.queueWorkers, cfg.queueDepth, cfg.queueRetryAfter).middleware()
+	// Only the routes that call the model count against the daily quota.
+	// /chat/ws charges each chat on the connection instead.
+	metered, meteredBatch := srv.quota.middleware(false), srv.quota.middleware(true)
+	single.POST("/chat", metered, idempotent, queued, srv.handleChat)
+	single.POST("/chat/validate", srv.handleValidateChat)
+	// The handshake is not a chat; each message on the connection takes its
+	// own rate-limit token instead.
+	api.GET("/chat/ws", srv.handleChatWS)
+	// Batches answer with several results, which text/plain cannot carry.
+	jsonOnly := acceptOnly(binding.MIMEJSON)
+	batched.POST("/chat/batched", jsonOnly, meteredBatch, idempotent, queued, srv.handleBatch)
+	batched.POST("/chat/batched/v2", jsonOnly, meteredBatch, idempotent, queued, srv.handleBatchV2)
+	batched.POST("/chat/batched/stream", acceptOnly(mimeNDJSON, binding.MIMEJSON), meteredBatch, queued, srv.handleBatchStream)
+	batched.POST("/chat/batched/resume", jsonOnly, meteredBatch, queued, srv.handleBatchResume)
+	single.DELETE("/chat/:id/history", srv.handleClearHistory)
+	batched.POST("/jobs", meteredBatch, idempotent, srv.handleSubmitJob)
+	single.GET("/jobs/:id", srv.handleGetJob)
+	single.DELETE("/jobs/:id", srv.handleCancelJob)
+	single.POST("/v1/chat/completions", metered, idempotent, queued, srv.handleOpenAIChat)
+	single.POST("/embeddings", metered, queued, srv.handleEmbeddings)
+	single.GET("/backends", handleBackends)
+	single.GET("/stats", handleStats)
+	if cfg.loadTest.enabled {
+		single.POST("/loadtest", srv.handleLoadTest)
+	}
+	if err := cfg.handlerTimeout.checkRoutes(r.Routes()); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// fakeInferencer answers queries in process instead of calling a model
+// host. answer, when set, decides the response to each query; otherwise
+// the query's user prompt is echoed back.
+type fakeInferencer struct {
+	answer func(ctx context.Context, req ChatRequest) (string, error)
+
+	mu    sync.Mutex
+	calls []ChatRequest
+}
+
+func (f *fakeInferencer) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, req)
+	f.mu.Unlock()
+	if f.answer == nil {
+		return "echo: " + req.UserPrompt, nil
+	}
+	return f.answer(ctx, req)
+}
+
+// callCount reports how many queries reached the fake.
+func (f *fakeInferencer) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+// testConfig loads the configuration from the environment plus env. The
+// upstream URL defaults to one nothing listens on.
+func testConfig(t testing.TB, env map[string]string) config {
+	t.Helper()
+	t.Setenv("INFER_UPSTREAM_URL", "http://127.0.0.1:1/infer")
+	t.Setenv("INFER_WARMUP", "false")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+// newTestRouter builds the server and routes main would, from the
+// environment plus env, with model in place of the HTTP upstream.
+func newTestRouter(t testing.TB, model Inferencer, env map[string]string) (*gin.Engine, *server) {
+	t.Helper()
+	cfg := testConfig(t, env)
+	installConfig(cfg, newUpstreamTransport(max(upstreamMaxIdleConnsPerHost, cfg.batchConcurrency)))
+	return newTestRouterFor(t, cfg, model)
+}
+
+// newTestRouterFor builds the server and routes for cfg, which must
+// already be installed.
+func newTestRouterFor(t testing.TB, cfg config, model Inferencer) (*gin.Engine, *server) {
+	t.Helper()
+	srv, err := newServer(cfg, model)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	r, err := newRouter(cfg, srv)
+	if err != nil {
+		t.Fatalf("newRouter: %v", err)
+	}
+	return r, srv
+}
+
+// jsonRequest builds a POST of body to path. A string body is sent as it
+// is; anything else is encoded as JSON.
+func jsonRequest(t testing.TB, path string, body any) *http.Request {
+	t.Helper()
+	raw, ok := body.(string)
+	if !ok {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encoding request: %v", err)
+		}
+		raw = string(b)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(raw))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// serve sends req to r and returns the recorded response.
+func serve(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// postJSON sends body to path on r and returns the recorded response.
+func postJSON(t testing.TB, r http.Handler, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(r, jsonRequest(t, path, body))
+}
+
+// errorCode returns the code of an error response body, or "" if the body
+// is not one.
+func errorCode(t testing.TB, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	return body.Error.Code
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_http_requests_total",
+		Help: "HTTP requests handled, by route and status code.",
+	}, []string{"route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qna_http_request_duration_seconds",
+		Help:    "Total handler time, by route.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"route"})
+
+	upstreamDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "qna_upstream_request_duration_seconds",
+		Help:    "Time spent in callModelAPI, including retries.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+
+	upstreamErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_upstream_errors_total",
+		Help: "Failed upstream calls, by error class.",
+	}, []string{"class"})
+
+	backendRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_backend_requests_total",
+		Help: "Calls to each model host, by backend URL and outcome (ok, rejected or error).",
+	}, []string{"backend", "outcome"})
+
+	backendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qna_backend_request_duration_seconds",
+		Help:    "Time spent in one call to a model host, by backend URL.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"backend"})
+
+	backendUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qna_backend_up",
+		Help: "Whether each pool backend is in rotation (1) or not (0).",
+	}, []string{"backend"})
+
+	circuitState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_upstream_circuit_state",
+		Help: "Upstream circuit breaker state: 0 closed, 1 half-open, 2 open.",
+	})
+
+	batchInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_batch_inflight_queries",
+		Help: "Batch queries currently being answered.",
+	})
+
+	upstreamInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_upstream_inflight",
+		Help: "Upstream calls holding a slot of the server-wide limit.",
+	})
+
+	upstreamLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_upstream_concurrency_limit",
+		Help: "Configured server-wide upstream concurrency limit (0 means unlimited).",
+	})
+
+	fairQueueKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_fair_queue_keys",
+		Help: "Fairness keys with upstream calls waiting for a slot.",
+	})
+
+	upstreamQueueWaiting = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qna_upstream_queue_waiting",
+		Help: "Upstream calls waiting for a slot, by current priority.",
+	}, []string{"priority"})
+
+	priorityPromotions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qna_upstream_priority_promotions_total",
+		Help: "Queued upstream calls moved up a priority level after waiting INFER_PRIORITY_AGING.",
+	})
+
+	adaptiveLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_adaptive_concurrency_limit",
+		Help: "Current adaptive upstream concurrency limit (0 means adaptive limiting is off).",
+	})
+
+	historyStoreErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_history_store_errors_total",
+		Help: "History store operations that failed and were skipped, by operation.",
+	}, []string{"op"})
+
+	cacheStoreErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_cache_store_errors_total",
+		Help: "Response cache operations that failed and were treated as misses, by operation.",
+	}, []string{"op"})
+
+	historyChats = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_history_chats",
+		Help: "Chats with history in the in-memory store.",
+	})
+
+	historyBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_history_bytes",
+		Help: "Estimated memory held by the in-memory history store.",
+	})
+
+	historyEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_history_evictions_total",
+		Help: "Chats dropped from the in-memory history store, by reason.",
+	}, []string{"reason"})
+
+	queueWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_queue_workers",
+		Help: "Configured request queue workers (0 means the queue is off).",
+	})
+
+	queueBusyWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_queue_busy_workers",
+		Help: "Inference requests currently holding a queue worker.",
+	})
+
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qna_queue_depth",
+		Help: "Inference requests waiting for a queue worker.",
+	})
+
+	queueRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qna_queue_rejected_total",
+		Help: "Inference requests turned away because the queue was full.",
+	})
+)
+
+// upstreamErrorClass buckets err for the upstream error counter: "4xx" or
+// "5xx" for status errors, otherwise the type from upstreamErrorStatus.
+func upstreamErrorClass(err error) string {
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		return strconv.Itoa(statusErr.StatusCode/100) + "xx"
+	}
+	_, errType := upstreamErrorStatus(err)
+	return errType
+}
+
+// dropBackendMetrics forgets a backend removed by a reload.
+func dropBackendMetrics(url string) {
+	backendUp.DeleteLabelValues(url)
+	backendDuration.DeleteLabelValues(url)
+	backendRequestsTotal.DeletePartialMatch(prometheus.Labels{"backend": url})
+}
+
+// observeUpstream records the outcome of one callModelAPI call.
+func observeUpstream(start time.Time, err error) {
+	upstreamDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		upstreamErrorsTotal.WithLabelValues(upstreamErrorClass(err)).Inc()
+	}
+}
+
+// metricsMiddleware counts requests and times handlers per route.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestsTotal.WithLabelValues(route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultMicroBatchWait = 10 * time.Millisecond
+	defaultMicroBatchSize = 8
+)
+
+var (
+	microBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "qna_microbatch_size",
+		Help:    "Single queries sent upstream together by the micro-batcher.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 7),
+	})
+
+	microBatchFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qna_microbatch_fallbacks_total",
+		Help: "Micro-batches that failed and were retried as single calls.",
+	})
+)
+
+// batchInferURL is the batched counterpart of an /infer URL.
+func batchInferURL(upstream string) string {
+	return strings.TrimSuffix(upstream, "/") + "/batch"
+}
+
+// upstreamBatch is the body of an /infer/batch call and its reply. Each
+// entry of Responses has the same shape as an /infer response.
+type upstreamBatch struct {
+	Queries   []ChatRequest     `json:"queries,omitempty"`
+	Responses []json.RawMessage `json:"responses,omitempty"`
+}
+
+// microBatcher coalesces single queries that arrive within maxWait of each
+// other into one /infer/batch call of up to maxSize queries. Only queries
+// with the same generation parameters, pinned to the same live snapshot,
+// share a call. Batch-route queries, which already run concurrently, go
+// straight to next, as does a query that finds itself alone when the wait
+// is over. If a batch call fails, each of its queries is retried through
+// next on its own.
+type microBatcher struct {
+	next    Inferencer
+	maxWait time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	pending map[string]*microBatch
+}
+
+type microBatch struct {
+	lc    *liveConfig
+	calls []*batchedCall
+	timer *time.Timer
+}
+
+type batchedCall struct {
+	ctx  context.Context
+	req  ChatRequest
+	done chan struct{}
+	resp string
+	err  error
+}
+
+func newMicroBatcher(next Inferencer, maxWait time.Duration, maxSize int) *microBatcher {
+	return &microBatcher{next: next, maxWait: maxWait, maxSize: maxSize, pending: make(map[string]*microBatch)}
+}
+
+func (m *microBatcher) Infer(ctx context.Context, req ChatRequest) (string, error) {
+	if ctx.Value(batchPathKey{}) != nil {
+		return m.next.Infer(ctx, req)
+	}
+	call := &batchedCall{ctx: ctx, req: req, done: make(chan struct{})}
+	lc := liveFrom(ctx)
+	key := fmt.Sprintf("%p/%s", lc, generationParams(req))
+
+	m.mu.Lock()
+	mb := m.pending[key]
+	if mb == nil {
+		mb = &microBatch{lc: lc}
+		m.pending[key] = mb
+		mb.timer = time.AfterFunc(m.maxWait, func() { m.flush(key, mb) })
+	}
+	mb.calls = append(mb.calls, call)
+	full := len(mb.calls) >= m.maxSize
+	m.mu.Unlock()
+	if full {
+		go m.flush(key, mb)
+	}
+
+	select {
+	case <-call.done:
+		return call.resp, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// flush takes mb out of pending, if the timer and a full batch have not
+// both tried, and sends it.
+func (m *microBatcher) flush(key string, mb *microBatch) {
+	m.mu.Lock()
+	if m.pending[key] != mb {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.pending, key)
+	mb.timer.Stop()
+	m.mu.Unlock()
+
+	// Callers that gave up while waiting are not sent.
+	calls := mb.calls[:0]
+	for _, call := range mb.calls {
+		if call.ctx.Err() == nil {
+			calls = append(calls, call)
+		}
+	}
+	if len(calls) == 0 {
+		return
+	}
+	microBatchSize.Observe(float64(len(calls)))
+	if len(calls) == 1 {
+		m.single(calls[0])
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), liveKey{}, mb.lc)
+	reqs := make([]ChatRequest, len(calls))
+	for i, call := range calls {
+		reqs[i] = call.req
+	}
+	backend, entries, err := callModelBatch(ctx, mb.lc.pool, reqs)
+	if err != nil {
+		microBatchFallbacks.Inc()
+		slog.Warn("upstream batch failed, retrying queries singly", "size", len(calls), "error", err.Error())
+		for _, call := range calls {
+			go m.single(call)
+		}
+		return
+	}
+	deliverBatch(backend, entries, mb.lc.responseField, calls)
+}
+
+// deliverBatch hands each call its entry of a successful /infer/batch
+// reply, decoded as an /infer response would be.
+func deliverBatch(backend string, entries []json.RawMessage, field string, calls []*batchedCall) {
+	for i, call := range calls {
+		info := callInfoFrom(call.ctx)
+		info.setBackend(backend)
+		if call.resp, call.err = decodeModelResponse(entries[i], field); call.err == nil {
+			info.setMeta(upstreamMeta(entries[i], field))
+			info.setRaw(entries[i])
+		}
+		close(call.done)
+	}
+}
+
+func (m *microBatcher) single(call *batchedCall) {
+	call.resp, call.err = m.next.Infer(call.ctx, call.req)
+	close(call.done)
+}
+
+// callModelBatch sends reqs to one backend from pool in a single
+// /infer/batch call and returns the backend and one raw response per query,
+// in order. It is not retried; the caller falls back to single calls.
+func callModelBatch(ctx context.Context, pool *backendPool, reqs []ChatRequest) (backend string, _ []json.RawMessage, err error) {
+	release, err := upstreamSlots.acquire(ctx, "", highestPriority(reqs))
+	if err != nil {
+		return "", nil, err
+	}
+	defer release()
+	if err := breaker.allow(); err != nil {
+		return "", nil, err
+	}
+	b := pool.pick()
+	url := batchInferURL(b.url)
+	start := time.Now()
+	ctx, span := startUpstreamSpan(ctx, "upstream.infer_batch", url)
+	status := 0
+	defer func() {
+		endUpstreamSpan(span, status, err)
+		breaker.record(err)
+		b.record(err, time.Since(start))
+		observeUpstream(start, err)
+	}()
+	defer func() { err = classifyUpstream(err) }()
+
+	httpReq, err := newUpstreamRequest(ctx, url, upstreamBatch{Queries: reqs})
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := inferenceClient(ctx).Do(httpReq)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+
+	data, err := readUpstreamBody(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	upstreamDebug.response(ctx, url, "", resp.StatusCode, data)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", nil, newUpstreamStatusError(resp, data)
+	}
+	var out upstreamBatch
+	if err := json.Unmarshal(data, &out); err != nil {
+		return "", nil, fmt.Errorf("decoding upstream response: %w (body: %q)", err, truncate(string(data), maxDecodeSnippetBytes))
+	}
+	if len(out.Responses) != len(reqs) {
+		return "", nil, &UpstreamError{Kind: kindDecode, Err: fmt.Errorf("upstream returned %d responses for %d queries", len(out.Responses), len(reqs))}
+	}
+	return b.url, out.Responses, nil
+}
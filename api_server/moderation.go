@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blockedResponsePlaceholder replaces model output that fails moderation.
+const blockedResponsePlaceholder = "[response withheld by content policy]"
+
+// Verdict is a moderation decision; Reason explains a block.
+type Verdict struct {
+	Allowed bool
+	Reason  string
+}
+
+// Moderator screens prompts before they reach the model and responses
+// before they reach the client.
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (Verdict, error)
+}
+
+// noopModerator allows everything; it is used when no blocklist is set.
+type noopModerator struct{}
+
+func (noopModerator) Moderate(context.Context, string) (Verdict, error) {
+	return Verdict{Allowed: true}, nil
+}
+
+// keywordModerator blocks text containing any listed term, ignoring case.
+type keywordModerator struct {
+	terms []string
+}
+
+func (m keywordModerator) Moderate(_ context.Context, text string) (Verdict, error) {
+	lower := strings.ToLower(text)
+	for _, term := range m.terms {
+		if strings.Contains(lower, term) {
+			return Verdict{Reason: fmt.Sprintf("contains blocked term %q", term)}, nil
+		}
+	}
+	return Verdict{Allowed: true}, nil
+}
+
+// moderateInput screens the user prompt, writing a 400 when it is blocked or
+// a 503 when the moderator fails. It reports whether the request may go on.
+func (s *server) moderateInput(c *gin.Context, req ChatRequest, extra gin.H) bool {
+	v, err := s.moderator.Moderate(c.Request.Context(), req.UserPrompt)
+	if err != nil {
+		abortWithError(c, codeModerationFailed, "moderation unavailable: "+err.Error(), nil)
+		return false
+	}
+	if !v.Allowed {
+		addLogAttrs(c, "moderation", "input_blocked", "moderation_reason", v.Reason)
+		details := gin.H{"reason": v.Reason}
+		for k, val := range extra {
+			details[k] = val
+		}
+		abortWithError(c, codePromptBlocked, "prompt blocked by moderation", details)
+		return false
+	}
+	return true
+}
+
+// moderateOutput returns resp, or the placeholder if the moderator blocks it
+// or cannot decide.
+func (s *server) moderateOutput(ctx context.Context, req ChatRequest, resp string) (string, bool) {
+	v, err := s.moderator.Moderate(ctx, resp)
+	if err == nil && v.Allowed {
+		return resp, true
+	}
+	reason := v.Reason
+	if err != nil {
+		reason = "moderation unavailable: " + err.Error()
+	}
+	slog.Warn("response blocked by moderation",
+		"request_id", requestIDFrom(ctx), "chat_id", req.ChatID, "reason", reason)
+	return blockedResponsePlaceholder, false
+}
+
+// loadModerator builds a keywordModerator from INFER_BLOCKLIST_FILE (one term
+// per line, # comments), or a noopModerator when it is unset.
+func loadModerator() (Moderator, error) {
+	path := os.Getenv("INFER_BLOCKLIST_FILE")
+	if path == "" {
+		return noopModerator{}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("INFER_BLOCKLIST_FILE: %w", err)
+	}
+	defer f.Close()
+	var terms []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			terms = append(terms, strings.ToLower(line))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("INFER_BLOCKLIST_FILE: %w", err)
+	}
+	return keywordModerator{terms: terms}, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const openAIDefaultModel = "SmolLM2-135M-Instruct"
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []openAIMessage `json:"messages"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+// openAIResponseFormat is {"type": "text"} or {"type": "json_object"}.
+type openAIResponseFormat struct {
+	Type string `json:"type"`
+}
+
+type openAIChoice struct {
+	Index        int           `json:"index"`
+	Message      openAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+type openAIChatResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+}
+
+// openAIError sends e in the OpenAI error shape, with its stable code and
+// details alongside the OpenAI errType.
+func openAIError(c *gin.Context, e apiError, errType string) {
+	body := e.body(c)
+	body["error"].(gin.H)["type"] = errType
+	c.AbortWithStatusJSON(e.httpStatus(), body)
+}
+
+func newCompletionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
+
+// toChatRequest joins all system messages into the system prompt and uses
+// the last user message as the user prompt; earlier turns are dropped. A
+// json_object response format turns on JSON mode.
+func (r openAIChatRequest) toChatRequest(id string) ChatRequest {
+	var system []string
+	var user string
+	for _, m := range r.Messages {
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+		case "user":
+			user = m.Content
+		}
+	}
+	req := ChatRequest{
+		ChatID:       id,
+		SystemPrompt: strings.Join(system, "\n"),
+		UserPrompt:   user,
+		Temperature:  r.Temperature,
+		MaxTokens:    r.MaxTokens,
+		TopP:         r.TopP,
+	}
+	if r.ResponseFormat != nil {
+		switch r.ResponseFormat.Type {
+		case "json_object":
+			req.ResponseFormat = responseFormatJSON
+		case "text":
+		default:
+			// Left for validation to reject.
+			req.ResponseFormat = r.ResponseFormat.Type
+		}
+	}
+	return req
+}
+
+// handleOpenAIChat serves a single, non-streaming completion in the OpenAI
+// chat completions format.
+func (s *server) handleOpenAIChat(c *gin.Context) {
+	var oreq openAIChatRequest
+	if err := bindJSON(c, &oreq); err != nil {
+		openAIError(c, bindError(err), "invalid_request_error")
+		return
+	}
+
+	id := newCompletionID()
+	req := oreq.toChatRequest(id)
+	addLogAttrs(c, chatLogAttrs(req)...)
+	if errs := validateChatRequest(req, s.maxPromptChars); len(errs) > 0 {
+		msg := "invalid request"
+		for _, fe := range errs {
+			msg += "; " + fe.Field + ": " + fe.Reason
+		}
+		openAIError(c, newAPIError(codeValidationFailed, msg, gin.H{"fields": errs}), "invalid_request_error")
+		return
+	}
+	if n, over := s.budget.exceeded(req); over {
+		addLogAttrs(c, "prompt_size", n, "prompt_budget", s.budget.max)
+		openAIError(c, newAPIError(codePromptTooLong, s.budget.message(n), nil), "context_length_exceeded")
+		return
+	}
+	if v, err := s.moderator.Moderate(c.Request.Context(), req.UserPrompt); err != nil {
+		openAIError(c, newAPIError(codeModerationFailed, err.Error(), nil), "moderation_unavailable")
+		return
+	} else if !v.Allowed {
+		addLogAttrs(c, "moderation", "input_blocked", "moderation_reason", v.Reason)
+		openAIError(c, newAPIError(codePromptBlocked, v.Reason, nil), "content_policy_violation")
+		return
+	}
+
+	start := time.Now()
+	upstreamReq, err := s.prompt.apply(liveFrom(c.Request.Context()).systemPrompt.apply(req))
+	if err != nil {
+		openAIError(c, newAPIError(codePromptTemplate, err.Error(), nil), "prompt_template")
+		return
+	}
+	resp, cached, err := s.infer(c.Request.Context(), upstreamReq)
+	recordUpstreamMS(c, time.Since(start).Milliseconds())
+	addLogAttrs(c, "cached", cached)
+	status := http.StatusOK
+	switch {
+	case err == nil:
+		resp = s.filters.apply(req, resp)
+	case s.degraded.use(c, err):
+		status, resp = s.degraded.status, s.degraded.message
+	default:
+		e := s.upstreamError(c, err)
+		openAIError(c, e, e.code)
+		return
+	}
+
+	model := oreq.Model
+	if model == "" {
+		model = openAIDefaultModel
+	}
+	c.JSON(status, openAIChatResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openAIChoice{{
+			Message:      openAIMessage{Role: "assistant", Content: resp},
+			FinishReason: "stop",
+		}},
+	})
+}
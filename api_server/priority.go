@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// Query priorities. An empty priority is normal.
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// priorityLevels is the number of priorities; level 0 is served first.
+const priorityLevels = 3
+
+// defaultPriorityAging is how long a queued upstream call waits before it
+// moves up a priority level, so a busy server still gets to low priority
+// work.
+const defaultPriorityAging = 500 * time.Millisecond
+
+// priorityLevel ranks p for scheduling; unknown values rank as normal, as
+// validation has already refused them.
+func priorityLevel(p string) int {
+	switch p {
+	case priorityHigh:
+		return 0
+	case priorityLow:
+		return 2
+	}
+	return 1
+}
+
+func priorityName(level int) string {
+	return [priorityLevels]string{priorityHigh, priorityNormal, priorityLow}[level]
+}
+
+// highestPriority is the level of the most urgent of reqs, which is what a
+// call carrying all of them waits at.
+func highestPriority(reqs []ChatRequest) int {
+	level := priorityLevels - 1
+	for _, r := range reqs {
+		level = min(level, priorityLevel(r.Priority))
+	}
+	return level
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultQueueDepth      = 64
+	defaultQueueRetryAfter = time.Second
+)
+
+// requestQueue admits at most workers inference requests at a time, with up
+// to depth more waiting their turn. A request that finds the queue full is
+// turned away at once with a 503 rather than left to pile up. A nil
+// *requestQueue admits everything.
+type requestQueue struct {
+	workers    chan struct{}
+	waiting    chan struct{}
+	retryAfter time.Duration
+}
+
+// newRequestQueue returns nil when workers is zero, disabling the queue.
+func newRequestQueue(workers, depth int, retryAfter time.Duration) *requestQueue {
+	queueWorkers.Set(float64(workers))
+	if workers <= 0 {
+		return nil
+	}
+	return &requestQueue{
+		workers:    make(chan struct{}, workers),
+		waiting:    make(chan struct{}, depth),
+		retryAfter: retryAfter,
+	}
+}
+
+// middleware holds a worker for the rest of the handler chain.
+func (q *requestQueue) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if q == nil {
+			c.Next()
+			return
+		}
+		select {
+		case q.workers <- struct{}{}:
+		default:
+			if !q.wait(c) {
+				return
+			}
+		}
+		queueBusyWorkers.Inc()
+		defer func() {
+			queueBusyWorkers.Dec()
+			<-q.workers
+		}()
+		c.Next()
+	}
+}
+
+// wait queues c for a worker, aborting it if the queue is full or the client
+// goes away first.
+func (q *requestQueue) wait(c *gin.Context) bool {
+	select {
+	case q.waiting <- struct{}{}:
+	default:
+		queueRejectedTotal.Inc()
+		addLogAttrs(c, "queue_rejected", true)
+		secs := retryAfterSeconds(q.retryAfter)
+		c.Header("Retry-After", strconv.Itoa(secs))
+		abortWithError(c, codeQueueFull, "request queue is full", gin.H{"retry_after_seconds": secs})
+		return false
+	}
+	queueDepth.Inc()
+	defer func() {
+		queueDepth.Dec()
+		<-q.waiting
+	}()
+	select {
+	case q.workers <- struct{}{}:
+		return true
+	case <-c.Request.Context().Done():
+		if !clientGone(c) {
+			abortWithError(c, codeQueueTimeout, "request deadline passed while queued", nil)
+		}
+		return false
+	}
+}
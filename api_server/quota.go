@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// quotaUnlimited is the quota of a key whose entry ends in
+// ":quota=unlimited", which exempts it from INFER_DAILY_QUOTA.
+const quotaUnlimited = -1
+
+// quotaSuffix introduces a per-key quota at the end of an API key entry.
+const quotaSuffix = ":quota="
+
+const quotaPeriod = 24 * time.Hour
+
+// Headers telling a client how much of its quota is left.
+const (
+	quotaLimitHeader     = "X-Quota-Limit"
+	quotaRemainingHeader = "X-Quota-Remaining"
+	quotaResetHeader     = "X-Quota-Reset"
+)
+
+var quotaExceededTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qna_quota_exceeded_total",
+	Help: "Requests rejected because their client's daily quota was used up.",
+})
+
+// parseKeyQuota reads the value of a key entry's ":quota=" suffix.
+func parseKeyQuota(raw string) (int, error) {
+	if raw == "unlimited" {
+		return quotaUnlimited, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("quota %q: must be a positive integer or unlimited", raw)
+	}
+	return n, nil
+}
+
+// quotaSettings controls the daily quotas, which are off unless
+// INFER_DAILY_QUOTA or a key's own quota is set.
+type quotaSettings struct {
+	daily int
+	mode  string
+	// resetAt is how long after UTC midnight the quotas reset.
+	resetAt time.Duration
+}
+
+// loadQuotaSettings reads INFER_DAILY_QUOTA, INFER_QUOTA_MODE (request or
+// query, like INFER_RATE_LIMIT_MODE) and INFER_QUOTA_RESET_AT, a UTC time
+// of day such as "06:30".
+func loadQuotaSettings() (quotaSettings, error) {
+	var q quotaSettings
+	var err error
+	if q.daily, err = nonNegativeIntEnv("INFER_DAILY_QUOTA", 0); err != nil {
+		return q, err
+	}
+	switch q.mode = os.Getenv("INFER_QUOTA_MODE"); q.mode {
+	case "":
+		q.mode = rateLimitPerRequest
+	case rateLimitPerRequest, rateLimitPerQuery:
+	default:
+		return q, fmt.Errorf("INFER_QUOTA_MODE %q: must be request or query", q.mode)
+	}
+	if raw := os.Getenv("INFER_QUOTA_RESET_AT"); raw != "" {
+		t, err := time.Parse("15:04", raw)
+		if err != nil {
+			return q, fmt.Errorf("INFER_QUOTA_RESET_AT %q: must be a UTC time of day such as 00:00", raw)
+		}
+		q.resetAt = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return q, nil
+}
+
+// quotaTracker counts each client's requests, or queries, since the last
+// reset against its daily quota. Clients are told by API key label, or by
+// IP when auth is off, as for the rate limiter. The counts live in memory,
+// so each replica keeps its own and a restart clears them.
+type quotaTracker struct {
+	daily   int
+	perKey  map[string]int
+	mode    string
+	resetAt time.Duration
+
+	mu     sync.Mutex
+	window time.Time
+	used   map[string]int
+}
+
+// newQuotaTracker returns nil when no quota is set; a nil *quotaTracker
+// allows everything.
+func newQuotaTracker(cfg quotaSettings, keys []apiKey) *quotaTracker {
+	perKey := make(map[string]int)
+	for _, k := range keys {
+		if k.quota != 0 {
+			perKey[k.label] = k.quota
+		}
+	}
+	if cfg.daily == 0 && len(perKey) == 0 {
+		return nil
+	}
+	return &quotaTracker{
+		daily:   cfg.daily,
+		perKey:  perKey,
+		mode:    cfg.mode,
+		resetAt: cfg.resetAt,
+		used:    make(map[string]int),
+	}
+}
+
+func (q *quotaTracker) perQuery() bool {
+	return q != nil && q.mode == rateLimitPerQuery
+}
+
+// windowStart is the last reset at or before now.
+func (q *quotaTracker) windowStart(now time.Time) time.Time {
+	start := now.UTC().Truncate(quotaPeriod).Add(q.resetAt)
+	if start.After(now) {
+		start = start.Add(-quotaPeriod)
+	}
+	return start
+}
+
+// nextReset is when the current counts will be cleared.
+func (q *quotaTracker) nextReset() time.Time {
+	return q.windowStart(time.Now()).Add(quotaPeriod)
+}
+
+// limit is the quota of the client identified by c, or 0 for none.
+func (q *quotaTracker) limit(c *gin.Context) int {
+	if label, ok := c.Get(apiKeyLabelKey); ok {
+		if n, ok := q.perKey[label.(string)]; ok {
+			return max(n, 0)
+		}
+	}
+	return q.daily
+}
+
+// quotaCharge is the state of a client's quota after a charge.
+type quotaCharge struct {
+	limit, used int
+	reset       time.Time
+}
+
+// allow charges n to the client identified by c and sets the X-Quota-*
+// headers, or writes a 429 if the charge would go over its quota. A
+// rejected request is not charged.
+func (q *quotaTracker) allow(c *gin.Context, n int) bool {
+	qc, e, ok := q.take(c, n)
+	if qc.limit == 0 {
+		return true
+	}
+	c.Header(quotaLimitHeader, strconv.Itoa(qc.limit))
+	c.Header(quotaRemainingHeader, strconv.Itoa(qc.limit-qc.used))
+	c.Header(quotaResetHeader, strconv.FormatInt(qc.reset.Unix(), 10))
+	if ok {
+		return true
+	}
+	addLogAttrs(c, "quota_exceeded", qc.limit)
+	if secs, ok := e.details["retry_after_seconds"].(int); ok {
+		c.Header("Retry-After", strconv.Itoa(secs))
+	}
+	writeError(c, e)
+	return false
+}
+
+// take is allow without the response, for callers that report the error
+// themselves, such as a WebSocket chat. The charge has a zero limit when
+// the client has no quota.
+func (q *quotaTracker) take(c *gin.Context, n int) (quotaCharge, apiError, bool) {
+	if q == nil {
+		return quotaCharge{}, apiError{}, true
+	}
+	qc := quotaCharge{limit: q.limit(c)}
+	if qc.limit == 0 {
+		return qc, apiError{}, true
+	}
+	key := clientKey(c)
+	now := time.Now()
+	q.mu.Lock()
+	if start := q.windowStart(now); !start.Equal(q.window) {
+		// Counts from the previous day are of no further use.
+		q.window = start
+		clear(q.used)
+	}
+	qc.used = q.used[key]
+	ok := qc.used+n <= qc.limit
+	if ok {
+		qc.used += n
+		q.used[key] = qc.used
+	}
+	qc.reset = q.window.Add(quotaPeriod)
+	q.mu.Unlock()
+	if ok {
+		return qc, apiError{}, true
+	}
+
+	quotaExceededTotal.Inc()
+	details := gin.H{"limit": qc.limit, "used": qc.used, "reset_at": qc.reset.Format(time.RFC3339)}
+	if n > qc.limit {
+		return qc, newAPIError(codeQuotaExceeded, fmt.Sprintf("request needs %d queries but the daily quota is %d", n, qc.limit), details), false
+	}
+	details["retry_after_seconds"] = retryAfterSeconds(qc.reset.Sub(now))
+	return qc, newAPIError(codeQuotaExceeded, "daily quota exhausted", details), false
+}
+
+// middleware charges one request to the quota. Batch routes are skipped in
+// per-query mode, where checkBatch charges them once the query count is
+// known.
+func (q *quotaTracker) middleware(batch bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batch && q.perQuery() {
+			c.Next()
+			return
+		}
+		if !q.allow(c, 1) {
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuotaHeadersAndReset(t *testing.T) {
+	r, srv := newTestRouter(t, &fakeInferencer{}, map[string]string{"INFER_DAILY_QUOTA": "2"})
+	body := map[string]any{"chat_id": "c1", "user_prompt": "hello"}
+	wantReset := strconv.FormatInt(srv.quota.nextReset().Unix(), 10)
+
+	for _, remaining := range []string{"1", "0"} {
+		w := postJSON(t, r, "/chat", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200; body %s", w.Code, w.Body)
+		}
+		if got := w.Header().Get(quotaLimitHeader); got != "2" {
+			t.Errorf("%s = %q, want 2", quotaLimitHeader, got)
+		}
+		if got := w.Header().Get(quotaRemainingHeader); got != remaining {
+			t.Errorf("%s = %q, want %s", quotaRemainingHeader, got, remaining)
+		}
+		if got := w.Header().Get(quotaResetHeader); got != wantReset {
+			t.Errorf("%s = %q, want %s", quotaResetHeader, got, wantReset)
+		}
+	}
+	w := postJSON(t, r, "/chat", body)
+	if w.Code != http.StatusTooManyRequests || errorCode(t, w) != codeQuotaExceeded {
+		t.Fatalf("over quota: status = %d, body %s; want 429 quota_exceeded", w.Code, w.Body)
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs <= 0 || secs > int(quotaPeriod/time.Second) {
+		t.Errorf("Retry-After = %q, want the seconds until the reset", w.Header().Get("Retry-After"))
+	}
+	// Free routes are not charged, even once the quota is used up.
+	if w := postJSON(t, r, "/chat/validate", body); w.Code != http.StatusOK || w.Header().Get(quotaLimitHeader) != "" {
+		t.Errorf("/chat/validate = %d with %s %q, want an uncharged 200", w.Code, quotaLimitHeader, w.Header().Get(quotaLimitHeader))
+	}
+
+	// The day turns over: the counts from the one before are cleared.
+	srv.quota.mu.Lock()
+	srv.quota.window = srv.quota.window.Add(-quotaPeriod)
+	srv.quota.mu.Unlock()
+	w = postJSON(t, r, "/chat", body)
+	if w.Code != http.StatusOK || w.Header().Get(quotaRemainingHeader) != "1" {
+		t.Errorf("after the reset: status = %d, %s %q; want 200 with 1 left", w.Code, quotaRemainingHeader, w.Header().Get(quotaRemainingHeader))
+	}
+}
+
+func TestQuotaPerKey(t *testing.T) {
+	r, _ := newTestRouter(t, &fakeInferencer{}, map[string]string{
+		"INFER_DAILY_QUOTA": "5",
+		"INFER_API_KEYS":    "ops:k1:quota=unlimited,batch:k2:quota=1",
+	})
+	chat := func(key string) (int, string) {
+		req := jsonRequest(t, "/chat", map[string]any{"chat_id": "c1", "user_prompt": "hello"})
+		req.Header.Set("X-API-Key", key)
+		w := serve(r, req)
+		return w.Code, w.Header().Get(quotaLimitHeader)
+	}
+	if status, limit := chat("k2"); status != http.StatusOK || limit != "1" {
+		t.Errorf("first k2 chat = %d with limit %q, want 200 with 1", status, limit)
+	}
+	if status, _ := chat("k2"); status != http.StatusTooManyRequests {
+		t.Errorf("second k2 chat = %d, want 429", status)
+	}
+	for range 3 {
+		if status, limit := chat("k1"); status != http.StatusOK || limit != "" {
+			t.Errorf("unlimited k1 chat = %d with limit %q, want 200 and no quota headers", status, limit)
+		}
+	}
+}
+
+func TestQuotaWindowStart(t *testing.T) {
+	q := &quotaTracker{resetAt: 6*time.Hour + 30*time.Minute}
+	day := time.Date(2026, 3, 14, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now, want time.Time
+	}{
+		{day.Add(6*time.Hour + 29*time.Minute), day.Add(-quotaPeriod + 6*time.Hour + 30*time.Minute)},
+		{day.Add(6*time.Hour + 30*time.Minute), day.Add(6*time.Hour + 30*time.Minute)},
+		{day.Add(23 * time.Hour), day.Add(6*time.Hour + 30*time.Minute)},
+	}
+	for _, tt := range tests {
+		if got := q.windowStart(tt.now); !got.Equal(tt.want) {
+			t.Errorf("windowStart(%s) = %s, want %s", tt.now, got, tt.want)
+		}
+	}
+}
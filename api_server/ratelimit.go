@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Rate limit modes for INFER_RATE_LIMIT_MODE: a batch costs one token per
+// request or one per query.
+const (
+	rateLimitPerRequest = "request"
+	rateLimitPerQuery   = "query"
+)
+
+const (
+	defaultRateLimitBurst = 10
+	limiterIdleTTL        = 10 * time.Minute
+	limiterSweepInterval  = time.Minute
+)
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter applies a token bucket per client (API key label, or IP when
+// auth is off) and, optionally, one shared bucket across all clients.
+type rateLimiter struct {
+	rps    rate.Limit
+	burst  int
+	mode   string
+	global *rate.Limiter
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+// newRateLimiter returns nil when neither a per-client nor a global rate is
+// set; a nil *rateLimiter allows everything.
+func newRateLimiter(rps float64, burst int, mode string, globalRPS float64, globalBurst int) *rateLimiter {
+	if rps <= 0 && globalRPS <= 0 {
+		return nil
+	}
+	rl := &rateLimiter{
+		rps:       rate.Limit(rps),
+		burst:     burst,
+		mode:      mode,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+	if globalRPS > 0 {
+		rl.global = rate.NewLimiter(rate.Limit(globalRPS), globalBurst)
+	}
+	return rl
+}
+
+func (rl *rateLimiter) perQuery() bool {
+	return rl != nil && rl.mode == rateLimitPerQuery
+}
+
+// clientBucket returns key's limiter, creating it on first use and dropping
+// buckets idle for longer than limiterIdleTTL.
+func (rl *rateLimiter) clientBucket(key string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > limiterSweepInterval {
+		for k, cl := range rl.clients {
+			if now.Sub(cl.lastSeen) > limiterIdleTTL {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+	cl, ok := rl.clients[key]
+	if !ok {
+		cl = &clientLimiter{limiter: rate.NewLimiter(rl.rps, rl.burst)}
+		rl.clients[key] = cl
+	}
+	cl.lastSeen = now
+	return cl.limiter
+}
+
+// reserve takes n tokens from l now, or reports how long to wait. ok is
+// false with a zero wait when n can never fit in the bucket.
+func reserve(l *rate.Limiter, n int) (*rate.Reservation, time.Duration, bool) {
+	r := l.ReserveN(time.Now(), n)
+	if !r.OK() {
+		return nil, 0, false
+	}
+	if d := r.Delay(); d > 0 {
+		r.Cancel()
+		return nil, d, false
+	}
+	return r, 0, true
+}
+
+// allow charges n tokens to the client identified by c and to the global
+// bucket, writing a 429 with Retry-After if either is exhausted.
+func (rl *rateLimiter) allow(c *gin.Context, n int) bool {
+	e, ok := rl.take(c, n)
+	if !ok {
+		addLogAttrs(c, "rate_limited", e.details["scope"])
+		if secs, ok := e.details["retry_after_seconds"].(int); ok {
+			c.Header("Retry-After", strconv.Itoa(secs))
+		}
+		writeError(c, e)
+	}
+	return ok
+}
+
+// take is allow without the response, for callers that report the error
+// themselves, such as a WebSocket chat.
+func (rl *rateLimiter) take(c *gin.Context, n int) (apiError, bool) {
+	if rl == nil {
+		return apiError{}, true
+	}
+	var clientRes *rate.Reservation
+	if rl.rps > 0 {
+		res, wait, ok := reserve(rl.clientBucket(clientKey(c)), n)
+		if !ok {
+			return rateLimitedError("client", wait, n, rl.burst), false
+		}
+		clientRes = res
+	}
+	if rl.global != nil {
+		if _, wait, ok := reserve(rl.global, n); !ok {
+			if clientRes != nil {
+				clientRes.Cancel()
+			}
+			return rateLimitedError("global", wait, n, rl.global.Burst()), false
+		}
+	}
+	return apiError{}, true
+}
+
+// rateLimitRequests charges one token per request to the live limiter.
+// Batch routes are skipped in per-query mode, where checkBatch charges them
+// once the query count is known.
+func rateLimitRequests(batch bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rl := liveFrom(c.Request.Context()).limiter
+		if batch && rl.perQuery() {
+			c.Next()
+			return
+		}
+		if !rl.allow(c, 1) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// retryAfterSeconds rounds wait up to whole seconds for Retry-After.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+func clientKey(c *gin.Context) string {
+	if label, ok := c.Get(apiKeyLabelKey); ok {
+		return "key:" + label.(string)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func rateLimitedError(scope string, wait time.Duration, n, burst int) apiError {
+	if wait == 0 {
+		return newAPIError(codeRateLimited, fmt.Sprintf("request needs %d tokens but the %s burst is %d", n, scope, burst), gin.H{"scope": scope})
+	}
+	secs := retryAfterSeconds(wait)
+	return newAPIError(codeRateLimited, "rate limit exceeded", gin.H{"scope": scope, "retry_after_seconds": secs})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// chatFrom posts a chat from the client at remoteAddr.
+func chatFrom(t *testing.T, r http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := jsonRequest(t, "/chat", map[string]any{"chat_id": "c1", "user_prompt": "hello"})
+	req.RemoteAddr = remoteAddr
+	return serve(r, req)
+}
+
+// rateLimitScope returns the scope detail of a rate_limited response.
+func rateLimitScope(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error struct {
+			Scope string `json:"scope"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	return body.Error.Scope
+}
+
+func TestRateLimitPerClient(t *testing.T) {
+	r, _ := newTestRouter(t, &fakeInferencer{}, map[string]string{
+		"INFER_RATE_LIMIT_RPS":   "0.5",
+		"INFER_RATE_LIMIT_BURST": "1",
+	})
+	if w := chatFrom(t, r, "192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("first status = %d, want 200; body %s", w.Code, w.Body)
+	}
+	w := chatFrom(t, r, "192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests || errorCode(t, w) != codeRateLimited {
+		t.Fatalf("second status = %d, body %s; want 429 rate_limited", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2 at 0.5 requests a second", got)
+	}
+	if got := rateLimitScope(t, w); got != "client" {
+		t.Errorf("scope = %q, want client", got)
+	}
+	// Another client has its own bucket.
+	if w := chatFrom(t, r, "192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("other client status = %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimitGlobal(t *testing.T) {
+	r, _ := newTestRouter(t, &fakeInferencer{}, map[string]string{
+		"INFER_GLOBAL_RATE_LIMIT_RPS":   "1",
+		"INFER_GLOBAL_RATE_LIMIT_BURST": "1",
+	})
+	chatFrom(t, r, "192.0.2.1:1234")
+	w := chatFrom(t, r, "192.0.2.2:1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("other client status = %d, Retry-After %q; want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := rateLimitScope(t, w); got != "global" {
+		t.Errorf("scope = %q, want global", got)
+	}
+}
+
+func TestRateLimitPerQuery(t *testing.T) {
+	model := &fakeInferencer{}
+	r, _ := newTestRouter(t, model, map[string]string{
+		"INFER_RATE_LIMIT_RPS":   "1",
+		"INFER_RATE_LIMIT_BURST": "2",
+		"INFER_RATE_LIMIT_MODE":  rateLimitPerQuery,
+	})
+	// Three queries can never fit a burst of two, so waiting would not help.
+	w := postJSON(t, r, "/chat/batched", BatchRequest{Queries: batchOf("a", "b", "c")})
+	if w.Code != http.StatusTooManyRequests || errorCode(t, w) != codeRateLimited {
+		t.Fatalf("status = %d, body %s; want 429 rate_limited", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q for a batch larger than the burst, want none", got)
+	}
+	if w := postJSON(t, r, "/chat/batched", BatchRequest{Queries: batchOf("a", "b")}); w.Code != http.StatusOK {
+		t.Errorf("batch within the burst: status = %d, want 200", w.Code)
+	}
+	if got := model.callCount(); got != 2 {
+		t.Errorf("model called %d times, want 2", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// filterRule is one entry of INFER_RESPONSE_FILTERS_FILE. Replacement may
+// refer to capture groups as $1 or ${name}.
+type filterRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// responseFilters rewrites model output before it is returned, applying each
+// rule in file order. A nil *responseFilters leaves responses as is.
+type responseFilters struct {
+	rules  []filterRule
+	bypass map[string]bool
+}
+
+// loadResponseFilters reads and compiles INFER_RESPONSE_FILTERS_FILE, a JSON
+// array of rules, returning nil when it is unset. INFER_FILTER_BYPASS_LABELS
+// lists the API key labels allowed to skip the filters.
+func loadResponseFilters() (*responseFilters, error) {
+	path := os.Getenv("INFER_RESPONSE_FILTERS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("INFER_RESPONSE_FILTERS_FILE: %w", err)
+	}
+	f := &responseFilters{bypass: make(map[string]bool)}
+	if err := json.Unmarshal(data, &f.rules); err != nil {
+		return nil, fmt.Errorf("INFER_RESPONSE_FILTERS_FILE: %w", err)
+	}
+	for i := range f.rules {
+		if f.rules[i].Pattern == "" {
+			return nil, fmt.Errorf("INFER_RESPONSE_FILTERS_FILE: rule %d: pattern is required", i)
+		}
+		if f.rules[i].re, err = regexp.Compile(f.rules[i].Pattern); err != nil {
+			return nil, fmt.Errorf("INFER_RESPONSE_FILTERS_FILE: rule %d: %w", i, err)
+		}
+	}
+	for _, label := range strings.Split(os.Getenv("INFER_FILTER_BYPASS_LABELS"), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			f.bypass[label] = true
+		}
+	}
+	return f, nil
+}
+
+// apply runs every rule over resp unless req skips filtering.
+func (f *responseFilters) apply(req ChatRequest, resp string) string {
+	if f == nil || req.SkipFilters {
+		return resp
+	}
+	for _, rule := range f.rules {
+		resp = rule.re.ReplaceAllString(resp, rule.Replacement)
+	}
+	return resp
+}
+
+// allowBypass clears req.SkipFilters unless c's API key may skip filtering.
+func (f *responseFilters) allowBypass(c *gin.Context, req *ChatRequest) {
+	if !req.SkipFilters || f == nil {
+		return
+	}
+	label, ok := c.Get(apiKeyLabelKey)
+	if !ok || !f.bypass[label.(string)] {
+		req.SkipFilters = false
+		return
+	}
+	addLogAttrs(c, "filters_skipped", true)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reloadableSettings are the INFER_* variables a SIGHUP may change. Any
+// other change in the config file is logged and ignored until restart.
+var reloadableSettings = map[string]bool{
+	"INFER_UPSTREAM_URL":            true,
+	"INFER_TIMEOUT":                 true,
+	"INFER_CHAT_TIMEOUT":            true,
+	"INFER_BATCH_TIMEOUT":           true,
+	"INFER_BATCH_CONCURRENCY":       true,
+	"INFER_RATE_LIMIT_RPS":          true,
+	"INFER_RATE_LIMIT_BURST":        true,
+	"INFER_RATE_LIMIT_MODE":         true,
+	"INFER_GLOBAL_RATE_LIMIT_RPS":   true,
+	"INFER_GLOBAL_RATE_LIMIT_BURST": true,
+	"INFER_UPSTREAM_RESPONSE_FIELD": true,
+	"INFER_DEFAULT_SYSTEM_PROMPT":   true,
+	"INFER_SYSTEM_PREAMBLE":         true,
+}
+
+// loadLiveSettings reads the reloadableSettings into cfg. A reload reads
+// only these, so it never rebuilds stores or rereads files for settings
+// that need a restart.
+func loadLiveSettings(cfg *config) error {
+	var err error
+	if cfg.upstreams, err = upstreamURLs(); err != nil {
+		return err
+	}
+	if cfg.timeout, err = durationEnv("INFER_TIMEOUT", defaultUpstreamTimeout); err != nil {
+		return err
+	}
+	if cfg.chatTimeout, err = durationEnv("INFER_CHAT_TIMEOUT", cfg.timeout); err != nil {
+		return err
+	}
+	if cfg.batchTimeout, err = durationEnv("INFER_BATCH_TIMEOUT", cfg.timeout); err != nil {
+		return err
+	}
+	if cfg.batchConcurrency, err = positiveIntEnv("INFER_BATCH_CONCURRENCY", defaultBatchConcurrency); err != nil {
+		return err
+	}
+	if cfg.rateLimitRPS, err = nonNegativeFloatEnv("INFER_RATE_LIMIT_RPS", 0); err != nil {
+		return err
+	}
+	if cfg.rateLimitBurst, err = positiveIntEnv("INFER_RATE_LIMIT_BURST", defaultRateLimitBurst); err != nil {
+		return err
+	}
+	switch cfg.rateLimitMode = os.Getenv("INFER_RATE_LIMIT_MODE"); cfg.rateLimitMode {
+	case "":
+		cfg.rateLimitMode = rateLimitPerRequest
+	case rateLimitPerRequest, rateLimitPerQuery:
+	default:
+		return fmt.Errorf("INFER_RATE_LIMIT_MODE %q: must be request or query", cfg.rateLimitMode)
+	}
+	if cfg.globalRateLimitRPS, err = nonNegativeFloatEnv("INFER_GLOBAL_RATE_LIMIT_RPS", 0); err != nil {
+		return err
+	}
+	if cfg.globalRateLimitBurst, err = positiveIntEnv("INFER_GLOBAL_RATE_LIMIT_BURST", defaultRateLimitBurst); err != nil {
+		return err
+	}
+	if cfg.responseField = strings.TrimSpace(os.Getenv("INFER_UPSTREAM_RESPONSE_FIELD")); cfg.responseField == "" {
+		cfg.responseField = defaultResponseField
+	}
+	cfg.systemPrompt = loadSystemPrompt()
+	return nil
+}
+
+// rateSettings is the rate limit configuration a rateLimiter was built from.
+type rateSettings struct {
+	rps         float64
+	burst       int
+	mode        string
+	globalRPS   float64
+	globalBurst int
+}
+
+// liveConfig holds the settings that can change at runtime. A reload builds
+// a complete new snapshot and publishes it with one atomic store, and each
+// request pins the snapshot current when it arrived, so it never sees a mix
+// of old and new settings.
+type liveConfig struct {
+	client           *http.Client
+	pool             *backendPool
+	limiter          *rateLimiter
+	rates            rateSettings
+	batchConcurrency int
+	responseField    string
+	chatTimeout      time.Duration
+	batchTimeout     time.Duration
+	systemPrompt     systemPrompt
+}
+
+var live atomic.Pointer[liveConfig]
+
+type liveKey struct{}
+
+// newLiveConfig builds a snapshot from cfg. Parts that did not change are
+// carried over from prev, if set, so backend health and rate limit buckets
+// survive a reload; the client shares transport so idle upstream
+// connections are kept.
+func newLiveConfig(cfg config, transport http.RoundTripper, prev *liveConfig) *liveConfig {
+	lc := &liveConfig{
+		client: &http.Client{Timeout: cfg.timeout, Transport: transport},
+		rates: rateSettings{cfg.rateLimitRPS, cfg.rateLimitBurst, cfg.rateLimitMode,
+			cfg.globalRateLimitRPS, cfg.globalRateLimitBurst},
+		batchConcurrency: cfg.batchConcurrency,
+		responseField:    cfg.responseField,
+		chatTimeout:      cfg.chatTimeout,
+		batchTimeout:     cfg.batchTimeout,
+		systemPrompt:     cfg.systemPrompt,
+	}
+	if prev == nil {
+		lc.pool = newBackendPool(cfg.upstreams, cfg.fallbackURL, cfg.routing)
+	} else {
+		lc.pool = prev.pool.withURLs(cfg.upstreams)
+	}
+	if prev != nil && prev.rates == lc.rates {
+		lc.limiter = prev.limiter
+	} else {
+		r := lc.rates
+		lc.limiter = newRateLimiter(r.rps, r.burst, r.mode, r.globalRPS, r.globalBurst)
+	}
+	return lc
+}
+
+// pinLive stores the current snapshot in the request context.
+func pinLive() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), liveKey{}, live.Load())
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// liveFrom returns the snapshot pinned in ctx, or the current one for work
+// that did not start from a request.
+func liveFrom(ctx context.Context) *liveConfig {
+	if lc, ok := ctx.Value(liveKey{}).(*liveConfig); ok {
+		return lc
+	}
+	return live.Load()
+}
+
+// configFile tracks the INFER_CONFIG_FILE entries currently applied and the
+// environment they replaced, so an entry removed from the file reverts.
+type configFile struct {
+	path    string
+	applied map[string]string
+	base    map[string]*string
+}
+
+// loadConfigFile reads INFER_CONFIG_FILE, if set, into the environment,
+// where its entries take precedence over variables set at launch.
+func loadConfigFile() (*configFile, error) {
+	path := os.Getenv("INFER_CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cf := &configFile{path: path, applied: entries, base: make(map[string]*string)}
+	for k, v := range entries {
+		cf.setenv(k, &v)
+	}
+	return cf, nil
+}
+
+// readConfigFile parses KEY=VALUE lines, skipping blanks and # comments.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("INFER_CONFIG_FILE: %w", err)
+	}
+	defer f.Close()
+	entries := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if k = strings.TrimSpace(k); !ok || !strings.HasPrefix(k, "INFER_") {
+			return nil, fmt.Errorf("INFER_CONFIG_FILE %s:%d: want INFER_NAME=value", path, n)
+		}
+		entries[k] = strings.TrimSpace(v)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("INFER_CONFIG_FILE: %w", err)
+	}
+	return entries, nil
+}
+
+// setenv sets k to *v, or back to its launch value when v is nil.
+func (cf *configFile) setenv(k string, v *string) {
+	if _, seen := cf.base[k]; !seen {
+		if old, ok := os.LookupEnv(k); ok {
+			cf.base[k] = &old
+		} else {
+			cf.base[k] = nil
+		}
+	}
+	if v == nil {
+		v = cf.base[k]
+	}
+	if v == nil {
+		os.Unsetenv(k)
+		return
+	}
+	os.Setenv(k, *v)
+}
+
+// reload rereads the file and, if the result is valid, publishes a new
+// snapshot. On any error the running settings are left as they were.
+func (cf *configFile) reload(transport http.RoundTripper) {
+	entries, err := readConfigFile(cf.path)
+	if err != nil {
+		slog.Error("config reload failed", "error", err.Error())
+		return
+	}
+	keys := make([]string, 0, len(entries)+len(cf.applied))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	for k := range cf.applied {
+		if _, ok := entries[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	prev := cf.applied
+	next := make(map[string]string, len(entries))
+	for k, v := range prev {
+		next[k] = v
+	}
+	var changed []string
+	for _, k := range keys {
+		newV, inNew := entries[k]
+		oldV, inOld := prev[k]
+		if inNew == inOld && newV == oldV {
+			continue
+		}
+		if !reloadableSettings[k] {
+			slog.Warn("config setting needs a restart, ignoring change", "setting", k)
+			continue
+		}
+		changed = append(changed, k)
+		if inNew {
+			next[k] = newV
+			cf.setenv(k, &newV)
+		} else {
+			delete(next, k)
+			cf.setenv(k, nil)
+		}
+	}
+	if len(changed) == 0 {
+		slog.Info("config reloaded, nothing to change")
+		return
+	}
+
+	var cfg config
+	if err := loadLiveSettings(&cfg); err != nil {
+		for _, k := range changed {
+			if v, ok := prev[k]; ok {
+				cf.setenv(k, &v)
+			} else {
+				cf.setenv(k, nil)
+			}
+		}
+		slog.Error("config reload failed", "error", err.Error())
+		return
+	}
+	live.Store(newLiveConfig(cfg, transport, live.Load()))
+	cf.applied = next
+	slog.Info("config reloaded", "changed", changed, "urls", cfg.upstreams, "timeout", cfg.timeout.String())
+}
+
+// reloadOnSignal reloads cf on every SIGHUP. Without a config file there is
+// nothing that could have changed, so the signal is only logged.
+func reloadOnSignal(cf *configFile, transport http.RoundTripper) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if cf == nil {
+			slog.Warn("SIGHUP received but INFER_CONFIG_FILE is not set")
+			continue
+		}
+		cf.reload(transport)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadOnlyReadsReloadableSettings(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys")
+	if err := os.WriteFile(keysFile, []byte("ops:secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := filepath.Join(dir, "infer.env")
+	if err := os.WriteFile(cfgPath, []byte("INFER_TIMEOUT=5s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Registered with t.Setenv so the reload's own changes are undone.
+	t.Setenv("INFER_TIMEOUT", "")
+	t.Setenv("INFER_CONFIG_FILE", cfgPath)
+	t.Setenv("INFER_API_KEYS_FILE", keysFile)
+
+	cf, err := loadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, nil)
+	transport := newUpstreamTransport(upstreamMaxIdleConnsPerHost)
+	installConfig(cfg, transport)
+	if got := live.Load().client.Timeout; got != 5*time.Second {
+		t.Fatalf("timeout = %s, want 5s", got)
+	}
+
+	// A file behind a setting that needs a restart goes away; the reload
+	// must not care.
+	if err := os.Remove(keysFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfgPath, []byte("INFER_TIMEOUT=7s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cf.reload(transport)
+	if got := live.Load().client.Timeout; got != 7*time.Second {
+		t.Errorf("timeout after reload = %s, want 7s", got)
+	}
+
+	if err := os.WriteFile(cfgPath, []byte("INFER_TIMEOUT=soon\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cf.reload(transport)
+	if got := live.Load().client.Timeout; got != 7*time.Second {
+		t.Errorf("timeout after an invalid reload = %s, want 7s kept", got)
+	}
+	if got := os.Getenv("INFER_TIMEOUT"); got != "7s" {
+		t.Errorf("INFER_TIMEOUT after an invalid reload = %q, want 7s restored", got)
+	}
+}
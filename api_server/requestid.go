@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	requestIDHeader   = "X-Request-ID"
+	traceparentHeader = "traceparent"
+)
+
+// validRequestID limits inbound IDs to something safe to log and forward.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// validTraceparent matches a W3C trace context version-00 header.
+var validTraceparent = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+type requestIDKey struct{}
+type traceparentKey struct{}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func traceparentFrom(ctx context.Context) string {
+	tp, _ := ctx.Value(traceparentKey{}).(string)
+	return tp
+}
+
+// setTraceHeaders forwards the request ID and trace context carried by ctx
+// to an upstream request. With tracing on, the traceparent names the
+// current span rather than the inbound one.
+func setTraceHeaders(ctx context.Context, h http.Header) {
+	if id := requestIDFrom(ctx); id != "" {
+		h.Set(requestIDHeader, id)
+	}
+	if tracingEnabled {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+	} else if tp := traceparentFrom(ctx); tp != "" {
+		h.Set(traceparentHeader, tp)
+	}
+}
+
+// requestID honours a well-formed inbound X-Request-ID or generates one,
+// echoes it on the response and stores it, along with any valid
+// traceparent, in the request context for upstream calls.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Header(requestIDHeader, id)
+		ctx := withRequestID(c.Request.Context(), id)
+		if tp := c.GetHeader(traceparentHeader); validTraceparent.MatchString(tp) {
+			ctx = context.WithValue(ctx, traceparentKey{}, tp)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		addLogAttrs(c, "request_id", id)
+		c.Next()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ResumeRequest is an earlier batch plus the indices of the queries to run
+// again, typically summary.failed_indices from the first response.
+type ResumeRequest struct {
+	BatchRequest
+	Indices []int `json:"indices"`
+}
+
+// handleBatchResume re-runs only the listed queries of a batch and returns
+// their results keyed by index in the original batch.
+func (s *server) handleBatchResume(c *gin.Context) {
+	var req ResumeRequest
+	if err := bindJSON(c, &req); err != nil {
+		writeError(c, bindError(err))
+		return
+	}
+	if errs := validateIndices(req.Indices, len(req.Queries)); len(errs) > 0 {
+		abortWithError(c, codeValidationFailed, "invalid request", gin.H{"fields": errs})
+		return
+	}
+	if !s.checkBatch(c, req.BatchRequest, req.Indices) {
+		return
+	}
+	addLogAttrs(c, "resumed", len(req.Indices))
+
+	subset := make([]ChatRequest, len(req.Indices))
+	for k, i := range req.Indices {
+		subset[k] = req.Queries[i]
+	}
+	ctx, ff := withFailFast(c.Request.Context(), req.FailFast)
+	defer ff.stop()
+	results, cacheHits := s.runBatch(ctx, subset, nil)
+	if clientGone(c) {
+		return
+	}
+
+	byIndex := make(map[int]batchResult, len(results))
+	for k, r := range results {
+		byIndex[req.Indices[k]] = r
+	}
+	// The summary counts only the re-run queries but names their original
+	// positions.
+	summary := summarize(results)
+	for k, pos := range summary.FailedIndices {
+		summary.FailedIndices[k] = req.Indices[pos]
+	}
+	if summary.Aborted = ff.aborted(); summary.Aborted != nil {
+		summary.Aborted.Index = req.Indices[summary.Aborted.Index]
+	}
+
+	c.Header("X-Cache-Hits", strconv.FormatInt(cacheHits, 10))
+	setTruncatedCount(c, results)
+	c.JSON(http.StatusOK, gin.H{"results": byIndex, "summary": summary})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultShadowMaxInflight = 16
+	// shadowLogMaxBytes is how much of each response a shadow comparison
+	// logs with INFER_LOG_PROMPTS=full.
+	shadowLogMaxBytes = 1024
+)
+
+// Outcomes of a sampled shadow request.
+const (
+	shadowMatch        = "match"
+	shadowDiffer       = "differ"
+	shadowError        = "shadow_error"
+	shadowPrimaryError = "primary_error"
+	shadowSkipped      = "skipped"
+)
+
+var (
+	shadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_shadow_requests_total",
+		Help: "Sampled /chat requests copied to the shadow backend, by outcome.",
+	}, []string{"outcome"})
+	shadowSimilarity = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "qna_shadow_similarity",
+		Help:    "Word overlap between primary and shadow responses, from 0 to 1.",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	})
+)
+
+// shadowSettings controls shadow testing, which is off unless both
+// INFER_SHADOW_URL and INFER_SHADOW_SAMPLE_RATE are set.
+type shadowSettings struct {
+	url         string
+	rate        float64
+	maxInflight int
+}
+
+// loadShadowSettings reads INFER_SHADOW_URL, INFER_SHADOW_SAMPLE_RATE (the
+// fraction of requests copied, from 0 to 1) and INFER_SHADOW_MAX_INFLIGHT.
+func loadShadowSettings() (shadowSettings, error) {
+	var sh shadowSettings
+	var err error
+	if sh.url = os.Getenv("INFER_SHADOW_URL"); sh.url != "" {
+		if err = validateUpstreamURL("INFER_SHADOW_URL", sh.url); err != nil {
+			return sh, err
+		}
+	}
+	if sh.rate, err = nonNegativeFloatEnv("INFER_SHADOW_SAMPLE_RATE", 0); err != nil {
+		return sh, err
+	}
+	if sh.rate > 1 {
+		return sh, errors.New("INFER_SHADOW_SAMPLE_RATE must be between 0 and 1")
+	}
+	if sh.rate > 0 && sh.url == "" {
+		return sh, errors.New("INFER_SHADOW_SAMPLE_RATE needs INFER_SHADOW_URL")
+	}
+	if sh.maxInflight, err = positiveIntEnv("INFER_SHADOW_MAX_INFLIGHT", defaultShadowMaxInflight); err != nil {
+		return sh, err
+	}
+	return sh, nil
+}
+
+// shadowTester copies a sample of /chat requests to a second backend and
+// compares its answers with the primary's. The copy runs in the
+// background, outside the retries, breaker and concurrency limits, and its
+// answer never reaches the client. A nil *shadowTester copies nothing.
+type shadowTester struct {
+	model   Inferencer
+	url     string
+	rate    float64
+	slots   chan struct{}
+	filters *responseFilters
+}
+
+func newShadowTester(cfg shadowSettings, cleanup responseCleanup, filters *responseFilters) *shadowTester {
+	if cfg.url == "" || cfg.rate == 0 {
+		return nil
+	}
+	call := InferFunc(func(ctx context.Context, req ChatRequest) (string, error) {
+		return callModelOnce(ctx, cfg.url, req)
+	})
+	return &shadowTester{
+		model:   cleanupInferencer{next: call, cleanup: cleanup},
+		url:     cfg.url,
+		rate:    cfg.rate,
+		slots:   make(chan struct{}, cfg.maxInflight),
+		filters: filters,
+	}
+}
+
+// shadowResult is the primary call's outcome, handed to the comparison.
+type shadowResult struct {
+	resp string
+	err  error
+}
+
+// start samples req, which is about to be sent to the primary, and if it is
+// chosen sends a copy to the shadow backend at once. The caller passes the
+// primary's answer to the returned func, which never blocks. When every
+// shadow slot is busy the request is not copied, so a slow shadow backend
+// cannot pile up work.
+func (st *shadowTester) start(ctx context.Context, req ChatRequest) func(resp string, err error) {
+	noop := func(string, error) {}
+	if st == nil || isDryRun(ctx) || rand.Float64() >= st.rate {
+		return noop
+	}
+	select {
+	case st.slots <- struct{}{}:
+	default:
+		shadowRequests.WithLabelValues(shadowSkipped).Inc()
+		return noop
+	}
+	primary := make(chan shadowResult, 1)
+	go st.run(ctx, req, primary)
+	return func(resp string, err error) { primary <- shadowResult{resp, err} }
+}
+
+// run calls the shadow backend under a context of its own, so the client
+// going away does not cancel it, then waits for the primary's answer and
+// records the comparison.
+func (st *shadowTester) run(ctx context.Context, req ChatRequest, primary <-chan shadowResult) {
+	defer func() { <-st.slots }()
+	start := time.Now()
+	sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), liveFrom(ctx).chatTimeout)
+	defer cancel()
+	sctx, _ = withCallInfo(sctx)
+	shadowResp, shadowErr := st.model.Infer(sctx, req)
+	shadowMS := time.Since(start).Milliseconds()
+
+	var p shadowResult
+	select {
+	case p = <-primary:
+	case <-ctx.Done():
+		// The handler answers before it returns, which is what ends ctx.
+		select {
+		case p = <-primary:
+		default:
+			p.err = context.Cause(ctx)
+		}
+	}
+
+	attrs := []any{"request_id", requestIDFrom(ctx), "chat_id", req.ChatID, "shadow_url", st.url, "shadow_ms", shadowMS}
+	var outcome string
+	switch {
+	case shadowErr != nil:
+		outcome = shadowError
+		attrs = append(attrs, "error", shadowErr.Error())
+	case p.err != nil:
+		outcome = shadowPrimaryError
+		attrs = append(attrs, "error", p.err.Error())
+	default:
+		sim := textSimilarity(p.resp, shadowResp)
+		shadowSimilarity.Observe(sim)
+		outcome = shadowDiffer
+		if p.resp == shadowResp {
+			outcome = shadowMatch
+		}
+		attrs = append(attrs, "similarity", sim, "primary_chars", len(p.resp), "shadow_chars", len(shadowResp))
+		if n := shadowLogChars(); n > 0 {
+			attrs = append(attrs,
+				"primary", truncate(st.filters.apply(ChatRequest{}, p.resp), n),
+				"shadow", truncate(st.filters.apply(ChatRequest{}, shadowResp), n))
+		}
+	}
+	shadowRequests.WithLabelValues(outcome).Inc()
+	slog.Info("shadow comparison", append(attrs, "outcome", outcome)...)
+}
+
+// shadowLogChars is how much of each answer a shadow comparison logs:
+// none unless INFER_LOG_PROMPTS allows user content in the logs.
+func shadowLogChars() int {
+	switch promptLogMode {
+	case promptLogTruncated:
+		return promptLogMaxChars
+	case promptLogFull:
+		return shadowLogMaxBytes
+	}
+	return 0
+}
+
+// textSimilarity is the Jaccard overlap of the words of a and b: 1 when
+// they use the same words, 0 when they share none.
+func textSimilarity(a, b string) float64 {
+	wa, wb := strings.Fields(a), strings.Fields(b)
+	if len(wa) == 0 && len(wb) == 0 {
+		return 1
+	}
+	set := make(map[string]bool, len(wa))
+	for _, w := range wa {
+		set[w] = true
+	}
+	union := len(set)
+	shared := 0
+	seen := make(map[string]bool, len(wb))
+	for _, w := range wb {
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+		if set[w] {
+			shared++
+		} else {
+			union++
+		}
+	}
+	return float64(shared) / float64(union)
+}
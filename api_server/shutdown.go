@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// inflightRequests counts requests that have entered a handler and not yet
+// returned, so shutdown can report what was cut off.
+var inflightRequests atomic.Int64
+
+// trackInflight keeps inflightRequests, and the request total in /stats.
+func trackInflight() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats.requests.Add(1)
+		inflightRequests.Add(1)
+		defer inflightRequests.Add(-1)
+		c.Next()
+	}
+}
+
+// serveUntilSignal runs srv until SIGINT or SIGTERM, then stops accepting
+// connections and waits up to drain for in-flight requests to finish. srv
+// serves HTTPS when its TLSConfig carries a certificate.
+func serveUntilSignal(srv *http.Server, drain time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("shutting down", "inflight", inflightRequests.Load(), "drain_timeout", drain.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("drain timeout elapsed", "inflight", inflightRequests.Load())
+		}
+		return err
+	}
+	slog.Info("shutdown complete")
+	return nil
+}
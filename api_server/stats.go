@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Where a query was answered without a call of its own: by another
+// caller's identical in-flight call, or by an identical query in the same
+// batch.
+const (
+	coalescedSingleflight = "singleflight"
+	coalescedBatch        = "batch"
+)
+
+var (
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_cache_lookups_total",
+		Help: "Response cache lookups, by result.",
+	}, []string{"result"})
+	coalescedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qna_coalesced_queries_total",
+		Help: "Queries answered by an identical query's upstream call, by source.",
+	}, []string{"source"})
+	upstreamCallsSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qna_upstream_calls_saved_total",
+		Help: "Upstream calls avoided through the cache or coalescing.",
+	})
+	upstreamBytesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qna_upstream_bytes_saved_total",
+		Help: "Response bytes served through the cache or coalescing instead of upstream.",
+	})
+
+	// Resolved once, so the hot path does no label lookups.
+	cacheHitsTotal             = cacheLookups.WithLabelValues("hit")
+	cacheMissesTotal           = cacheLookups.WithLabelValues("miss")
+	coalescedSingleflightTotal = coalescedQueries.WithLabelValues(coalescedSingleflight)
+	coalescedBatchTotal        = coalescedQueries.WithLabelValues(coalescedBatch)
+)
+
+// serverStats backs GET /stats. Its counters are atomics bumped alongside
+// the Prometheus series, so reading them needs no scrape and counting them
+// takes no lock.
+type serverStats struct {
+	started      time.Time
+	requests     atomic.Int64
+	cacheHits    atomic.Int64
+	cacheMisses  atomic.Int64
+	singleflight atomic.Int64
+	batchDedup   atomic.Int64
+	bytesSaved   atomic.Int64
+	batchQueries atomic.Int64
+}
+
+var stats = &serverStats{started: time.Now()}
+
+// cacheHit counts a query answered from the cache with a response of n
+// bytes.
+func (st *serverStats) cacheHit(n int) {
+	st.cacheHits.Add(1)
+	cacheHitsTotal.Inc()
+	st.saved(1, n)
+}
+
+func (st *serverStats) cacheMiss() {
+	st.cacheMisses.Add(1)
+	cacheMissesTotal.Inc()
+}
+
+// coalesced counts queries that waited for an identical query's upstream
+// call instead of making their own; n is the bytes each of them got.
+func (st *serverStats) coalesced(source string, queries, n int) {
+	if queries == 0 {
+		return
+	}
+	if source == coalescedBatch {
+		st.batchDedup.Add(int64(queries))
+		coalescedBatchTotal.Add(float64(queries))
+	} else {
+		st.singleflight.Add(int64(queries))
+		coalescedSingleflightTotal.Add(float64(queries))
+	}
+	st.saved(queries, queries*n)
+}
+
+func (st *serverStats) saved(calls, bytes int) {
+	st.bytesSaved.Add(int64(bytes))
+	upstreamCallsSaved.Add(float64(calls))
+	upstreamBytesSaved.Add(float64(bytes))
+}
+
+// handleStats answers GET /stats with a summary of the counters for people;
+// /metrics has the full series.
+func handleStats(c *gin.Context) {
+	hits, misses := stats.cacheHits.Load(), stats.cacheMisses.Load()
+	hitRate := 0.0
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses)
+	}
+	singleflight, batchDedup := stats.singleflight.Load(), stats.batchDedup.Load()
+	c.JSON(http.StatusOK, gin.H{
+		"started_at":     stats.started.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(stats.started).Seconds()),
+		"requests": gin.H{
+			"total":     stats.requests.Load(),
+			"in_flight": inflightRequests.Load(),
+		},
+		"batch_queries_in_flight": stats.batchQueries.Load(),
+		"cache": gin.H{
+			"hits":     hits,
+			"misses":   misses,
+			"hit_rate": hitRate,
+		},
+		"coalesced": gin.H{
+			coalescedSingleflight: singleflight,
+			coalescedBatch:        batchDedup,
+		},
+		"saved": gin.H{
+			"upstream_calls": hits + singleflight + batchDedup,
+			"bytes":          stats.bytesSaved.Load(),
+		},
+	})
+}
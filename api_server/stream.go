@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const streamReadSize = 4096
+
+// Why a stream ended before its done event or line.
+const (
+	streamCauseClient   = "client_disconnected"
+	streamCauseUpstream = "upstream_error"
+	streamCauseDeadline = "deadline"
+)
+
+var streamsInterrupted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qna_streams_interrupted_total",
+	Help: "SSE, NDJSON and WebSocket streams that ended before completing, by format and cause.",
+}, []string{"format", "cause"})
+
+// streamProgress counts what a stream has written so an interruption can be
+// logged with how far it got.
+type streamProgress struct {
+	format string
+	start  time.Time
+	chunks int
+	bytes  int
+}
+
+func newStreamProgress(format string) *streamProgress {
+	return &streamProgress{format: format, start: time.Now()}
+}
+
+func (p *streamProgress) sent(n int) {
+	p.chunks++
+	p.bytes += n
+}
+
+// finished records the totals on the access log line.
+func (p *streamProgress) finished(c *gin.Context) {
+	addLogAttrs(c, "stream_chunks", p.chunks, "stream_bytes", p.bytes)
+}
+
+// interrupted logs a partial stream and counts it.
+func (p *streamProgress) interrupted(c *gin.Context, cause string, err error) {
+	p.finished(c)
+	addLogAttrs(c, "stream_interrupted", cause)
+	streamsInterrupted.WithLabelValues(p.format, cause).Inc()
+	attrs := []any{"request_id", requestIDFrom(c.Request.Context()), "format", p.format, "cause", cause,
+		"chunks", p.chunks, "bytes", p.bytes, "elapsed_ms", time.Since(p.start).Milliseconds()}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	slog.Warn("stream interrupted", attrs...)
+}
+
+// streamCause classifies an interruption: the client going away wins over
+// whatever error the read or write then saw.
+func streamCause(c *gin.Context, err error) string {
+	switch ctxErr := c.Request.Context().Err(); {
+	case errors.Is(ctxErr, context.Canceled):
+		return streamCauseClient
+	case ctxErr != nil || errors.Is(err, context.DeadlineExceeded):
+		return streamCauseDeadline
+	}
+	return streamCauseUpstream
+}
+
+// streamURL is the model host's incremental variant of the /infer route.
+func streamURL(upstream string) string {
+	return strings.TrimSuffix(upstream, "/") + "/stream"
+}
+
+// openModelStream starts a streaming inference and returns the raw body once
+// the upstream has accepted the request. The caller must close it.
+func openModelStream(ctx context.Context, pool *backendPool, req ChatRequest) (body io.ReadCloser, err error) {
+	release, err := upstreamSlots.acquire(ctx, req.ChatID, priorityLevel(req.Priority))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+	if err := breaker.allow(); err != nil {
+		return nil, err
+	}
+	b := pool.pickFor(req.ChatID, 1)
+	callInfoFrom(ctx).setBackend(b.url)
+	start := time.Now()
+	defer func() {
+		breaker.record(err)
+		// Until the headers arrive; the body is still streaming.
+		b.record(err, time.Since(start))
+	}()
+	defer func() { err = classifyUpstream(err) }()
+	url := streamURL(b.url)
+	httpReq, err := newUpstreamRequest(ctx, url, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := inferenceClient(ctx).Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		upstreamDebug.response(ctx, url, req.ChatID, resp.StatusCode, data)
+		return nil, newUpstreamStatusError(resp, data)
+	}
+	logged := upstreamDebug.stream(ctx, url, req.ChatID, resp.StatusCode, resp.Body)
+	return &releaseOnClose{ReadCloser: capBody(logged), release: release}, nil
+}
+
+// completeUTF8 returns the length of the longest prefix of b that does not
+// end in a partial rune, so multi-byte characters are never split across
+// events.
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// streamChat relays the upstream body to the client as SSE "message" events,
+// ending with a "done" event, or an "error" event if the read fails. The
+// upstream read is tied to the request context, so a client disconnect
+// aborts it, and is cancelled whenever the stream ends. Stop sequences and
+// max_response_chars end the stream early, which also closes the upstream
+// body. An interrupted stream is logged with how much was sent. It returns
+// the text sent and whether the stream completed.
+func (s *server) streamChat(c *gin.Context, req ChatRequest) (string, bool) {
+	start := time.Now()
+	defer func() { recordUpstreamMS(c, time.Since(start).Milliseconds()) }()
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	ctx, info := withCallInfo(ctx)
+	var body io.ReadCloser
+	var err error
+	if isDryRun(ctx) {
+		body, err = dryRunStream(ctx, req, s.dryRunLatency)
+	} else {
+		body, err = openModelStream(ctx, liveFrom(ctx).pool, req)
+	}
+	setBackendHeader(c, info)
+	if err != nil {
+		s.audit.record(ctx, req, "", start, false, true, err)
+		writeError(c, s.upstreamError(c, err))
+		return "", false
+	}
+	defer body.Close()
+
+	buf := make([]byte, streamReadSize)
+	var pending []byte
+	var full strings.Builder
+	cutter := newStreamCutter(req)
+	progress := newStreamProgress("sse")
+	send := func(text string) {
+		if text != "" {
+			full.WriteString(text)
+			c.SSEvent("message", text)
+			progress.sent(len(text))
+		}
+	}
+	done := false
+	var readErr error
+	gone := c.Stream(func(w io.Writer) bool {
+		n, err := body.Read(buf)
+		pending = append(pending, buf[:n]...)
+		if cut := completeUTF8(pending); cut > 0 {
+			out, stopped := cutter.push(string(pending[:cut]))
+			pending = append(pending[:0], pending[cut:]...)
+			send(out)
+			if stopped {
+				c.SSEvent("done", "[DONE]")
+				done = true
+				return false
+			}
+		}
+		if err == io.EOF {
+			out, _ := cutter.push(string(pending))
+			send(out + cutter.flush())
+			c.SSEvent("done", "[DONE]")
+			done = true
+			return false
+		}
+		if err != nil {
+			readErr = err
+			if streamCause(c, err) != streamCauseClient {
+				c.SSEvent("error", newAPIError(upstreamErrorCode(err), err.Error(), nil).body(c))
+			}
+			return false
+		}
+		return true
+	})
+	auditErr := readErr
+	if !done && auditErr == nil {
+		auditErr = context.Canceled
+	}
+	s.audit.record(ctx, req, full.String(), start, false, true, auditErr)
+	switch {
+	case done:
+		progress.finished(c)
+	case gone:
+		progress.interrupted(c, streamCauseClient, nil)
+	default:
+		progress.interrupted(c, streamCause(c, readErr), readErr)
+	}
+	return full.String(), done
+}
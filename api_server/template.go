@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// systemPrompt fills in and extends the system prompt sent upstream: a query
+// without one gets def, and preamble, if set, goes in front of whatever the
+// query ends up with. Both are part of the live config.
+type systemPrompt struct {
+	def      string
+	preamble string
+}
+
+// loadSystemPrompt reads INFER_DEFAULT_SYSTEM_PROMPT and
+// INFER_SYSTEM_PREAMBLE. Config file values are one line, so a literal \n
+// in either stands for a line break.
+func loadSystemPrompt() systemPrompt {
+	unescape := func(name string) string { return strings.ReplaceAll(os.Getenv(name), `\n`, "\n") }
+	return systemPrompt{def: unescape("INFER_DEFAULT_SYSTEM_PROMPT"), preamble: unescape("INFER_SYSTEM_PREAMBLE")}
+}
+
+// apply returns req with the default and preamble applied. A client's own
+// system prompt always wins over the default, but not over the preamble.
+func (sp systemPrompt) apply(req ChatRequest) ChatRequest {
+	if req.SystemPrompt == "" {
+		req.SystemPrompt = sp.def
+	}
+	switch {
+	case sp.preamble == "":
+	case req.SystemPrompt == "":
+		req.SystemPrompt = sp.preamble
+	default:
+		req.SystemPrompt = sp.preamble + "\n\n" + req.SystemPrompt
+	}
+	return req
+}
+
+// promptTemplate rewrites the user prompt sent upstream. The template sees
+// the incoming ChatRequest, so {{.UserPrompt}}, {{.SystemPrompt}} and
+// {{.ChatID}} are available. A nil *promptTemplate leaves prompts as is.
+type promptTemplate struct {
+	tmpl *template.Template
+}
+
+// loadPromptTemplate parses INFER_PROMPT_TEMPLATE_FILE, returning nil when
+// it is unset.
+func loadPromptTemplate() (*promptTemplate, error) {
+	path := os.Getenv("INFER_PROMPT_TEMPLATE_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("INFER_PROMPT_TEMPLATE_FILE: %w", err)
+	}
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("INFER_PROMPT_TEMPLATE_FILE: %w", err)
+	}
+	return &promptTemplate{tmpl: tmpl}, nil
+}
+
+// apply returns req with its user prompt rendered through the template,
+// unless req asks for its prompt to be sent raw.
+func (pt *promptTemplate) apply(req ChatRequest) (ChatRequest, error) {
+	if pt == nil || req.RawPrompt {
+		return req, nil
+	}
+	var b strings.Builder
+	if err := pt.tmpl.Execute(&b, req); err != nil {
+		return req, fmt.Errorf("rendering prompt template: %w", err)
+	}
+	req.UserPrompt = b.String()
+	return req, nil
+}
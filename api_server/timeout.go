@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errHandlerTimeout is the cause of the cancellation at the end of a
+// request's handler timeout.
+var errHandlerTimeout = errors.New("request exceeded the server's handler timeout")
+
+// streamingRoutes end when their stream does, so they get no handler
+// timeout; an SSE /chat is exempt the same way.
+var streamingRoutes = map[string]bool{
+	"/chat/batched/stream": true,
+	"/chat/ws":             true,
+}
+
+var handlerTimeoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qna_handler_timeouts_total",
+	Help: "Requests answered 504 because their handler outran its timeout, by route.",
+}, []string{"route"})
+
+// handlerTimeouts is the ceiling on how long a handler may take, on top of
+// any upstream or client deadline. Zero means no ceiling.
+type handlerTimeouts struct {
+	overall time.Duration
+	routes  map[string]time.Duration
+}
+
+// loadHandlerTimeouts reads INFER_HANDLER_TIMEOUT and
+// INFER_HANDLER_TIMEOUT_ROUTES, a comma-separated list of route=duration
+// overrides such as "/chat/batched=10m,/embeddings=30s". A duration of 0
+// takes the route out from under the ceiling.
+func loadHandlerTimeouts() (handlerTimeouts, error) {
+	t := handlerTimeouts{routes: make(map[string]time.Duration)}
+	var err error
+	if t.overall, err = durationEnv("INFER_HANDLER_TIMEOUT", 0); err != nil {
+		return t, err
+	}
+	for _, entry := range strings.Split(os.Getenv("INFER_HANDLER_TIMEOUT_ROUTES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		route, raw, ok := strings.Cut(entry, "=")
+		route = strings.TrimSpace(route)
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if !ok || !strings.HasPrefix(route, "/") || err != nil || d < 0 {
+			return t, fmt.Errorf("INFER_HANDLER_TIMEOUT_ROUTES: %q must be route=duration, e.g. /chat/batched=10m", entry)
+		}
+		if streamingRoutes[route] {
+			return t, fmt.Errorf("INFER_HANDLER_TIMEOUT_ROUTES: %s streams and has no handler timeout", route)
+		}
+		t.routes[route] = d
+	}
+	return t, nil
+}
+
+// checkRoutes reports an override for a route that is not registered, which
+// is most likely a typo.
+func (t handlerTimeouts) checkRoutes(routes gin.RoutesInfo) error {
+	known := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		known[r.Path] = true
+	}
+	for route := range t.routes {
+		if !known[route] {
+			return fmt.Errorf("INFER_HANDLER_TIMEOUT_ROUTES: no route %s", route)
+		}
+	}
+	return nil
+}
+
+func (t handlerTimeouts) forRoute(route string) time.Duration {
+	if d, ok := t.routes[route]; ok {
+		return d
+	}
+	return t.overall
+}
+
+// handlerTimeout cancels the request context once the route's timeout has
+// passed, which stops queued, upstream and batch work made for it. If the
+// handler has not started its response by then, the client is sent a 504
+// at once, with only the headers set before the handler ran; the handler
+// may still be running, as a slow path can ignore its context, and
+// whatever it writes afterwards is dropped. For a batch the ceiling covers
+// the whole batch. Streaming requests are left alone.
+func handlerTimeout(t handlerTimeouts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d := t.forRoute(c.FullPath())
+		if d <= 0 || streamingRoutes[c.FullPath()] || strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeoutCause(c.Request.Context(), d, errHandlerTimeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		tw := newTimeoutWriter(c.Writer)
+		e := newAPIError(codeHandlerTimeout, fmt.Sprintf("request did not finish within %s", d), nil)
+		body, _ := json.Marshal(e.envelope(requestIDFrom(ctx)))
+		done := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			defer close(done)
+			if errors.Is(context.Cause(ctx), errHandlerTimeout) {
+				tw.timeout(e.httpStatus(), body)
+			}
+		})
+		c.Writer = tw
+		c.Next()
+		if !stop() {
+			<-done
+		}
+		c.Writer = tw.ResponseWriter
+		if tw.timedOut() {
+			handlerTimeoutsTotal.WithLabelValues(c.FullPath()).Inc()
+			addLogAttrs(c, "handler_timeout_ms", d.Milliseconds())
+			c.Abort()
+		}
+	}
+}
+
+// timeoutWriter sits between a handler and the real response so
+// handlerTimeout can answer 504 while the handler is still running. The
+// handler's headers go to a map of its own, copied out when it sets a
+// status or writes, and each write holds mu, so the two never race. The
+// writer tracks that itself: the one below, such as a gzipWriter holding a
+// small body back, may not report the response as written yet. Once the
+// 504 is sent its status is 504 for good, so the idempotency store forgets
+// the key rather than replaying a response the client never saw.
+type timeoutWriter struct {
+	gin.ResponseWriter
+	header http.Header
+
+	mu      sync.Mutex
+	started bool
+	dropped bool
+}
+
+func newTimeoutWriter(w gin.ResponseWriter) *timeoutWriter {
+	return &timeoutWriter{ResponseWriter: w, header: w.Header().Clone()}
+}
+
+// timeout sends the 504 unless the handler's response has started. The
+// real headers are those set before the handler ran.
+func (w *timeoutWriter) timeout(status int, body []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started {
+		return
+	}
+	w.dropped = true
+	h := w.ResponseWriter.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write(body)
+	w.ResponseWriter.Flush()
+}
+
+func (w *timeoutWriter) timedOut() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// Header is the handler's own map until its response starts, and the real
+// one after, since gin sets some headers, such as Content-Type, after the
+// status.
+func (w *timeoutWriter) Header() http.Header {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+// start reports whether the handler may write, copying its headers out
+// the first time. It is called with mu held.
+func (w *timeoutWriter) start() bool {
+	if w.dropped {
+		return false
+	}
+	if !w.started {
+		w.started = true
+		h := w.ResponseWriter.Header()
+		clear(h)
+		for k, v := range w.header {
+			h[k] = v
+		}
+	}
+	return true
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.start() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *timeoutWriter) WriteHeaderNow() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.start() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.start() {
+		return 0, http.ErrHandlerTimeout
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *timeoutWriter) WriteString(s string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.start() {
+		return 0, http.ErrHandlerTimeout
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *timeoutWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.start() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *timeoutWriter) Written() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped || w.ResponseWriter.Written()
+}
+
+func (w *timeoutWriter) Status() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dropped {
+		return http.StatusGatewayTimeout
+	}
+	return w.ResponseWriter.Status()
+}
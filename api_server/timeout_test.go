@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTimeoutRouter puts handlerTimeout behind compressResponses, as
+// newRouter does, with a 50ms ceiling. The handlers ignore their context
+// and outlive it.
+func newTimeoutRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(compressResponses(defaultGzipMinBytes), handlerTimeout(handlerTimeouts{overall: 50 * time.Millisecond}))
+	r.GET("/rendered", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+		time.Sleep(150 * time.Millisecond)
+	})
+	r.GET("/stuck", func(c *gin.Context) {
+		c.Header("X-Handler", "set")
+		time.Sleep(150 * time.Millisecond)
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	return r
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	r := newTimeoutRouter()
+	for _, tt := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		// Rendered before the deadline, but still held back in the gzip
+		// buffer when it passes.
+		{path: "/rendered", status: http.StatusOK},
+		{path: "/stuck", status: http.StatusGatewayTimeout, code: codeHandlerTimeout},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := serve(r, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+			}
+			if !json.Valid(w.Body.Bytes()) {
+				t.Fatalf("body %q is not one JSON document", w.Body)
+			}
+			if tt.code == "" {
+				return
+			}
+			if got := errorCode(t, w); got != tt.code {
+				t.Errorf("error code = %q, want %q", got, tt.code)
+			}
+			if got := w.Header().Get("X-Handler"); got != "" {
+				t.Errorf("504 carries the handler's header X-Handler: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// loadTLSConfig reads INFER_TLS_CERT_FILE and INFER_TLS_KEY_FILE. With
+// neither set it returns nil and the server speaks plain HTTP; setting only
+// one, or files that do not load, is a startup error.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("INFER_TLS_CERT_FILE"), os.Getenv("INFER_TLS_KEY_FILE")
+	switch {
+	case certFile == "" && keyFile == "":
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("INFER_TLS_CERT_FILE and INFER_TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate %q and key %q: %w", certFile, keyFile, err)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
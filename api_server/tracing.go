@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracingServiceName = "qna_api"
+
+// tracer is backed by the global provider, a no-op until setupTracing
+// installs an exporter.
+var tracer = otel.Tracer(tracingServiceName)
+
+// tracingEnabled is set by setupTracing; when false, inbound traceparent
+// headers are still forwarded upstream as they arrived.
+var tracingEnabled bool
+
+// setupTracing exports spans over OTLP/HTTP to INFER_OTLP_ENDPOINT, a full
+// URL such as http://collector:4318/v1/traces. With no endpoint tracing
+// stays a no-op. The returned func flushes pending spans.
+func setupTracing() (func(context.Context) error, error) {
+	endpoint := os.Getenv("INFER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("INFER_OTLP_ENDPOINT %q: %w", endpoint, err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracingEnabled = true
+	return provider.Shutdown, nil
+}
+
+// spanAttrSkip keeps prompt text, which the access log carries only when
+// INFER_LOG_PROMPTS allows, out of spans.
+var spanAttrSkip = map[string]bool{"system_prompt": true, "user_prompt": true}
+
+// traceRequests starts a server span per request, continuing any inbound
+// trace context. Once the handler is done the span gets the route, status
+// and the attributes recorded via addLogAttrs.
+func traceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tracingEnabled {
+			c.Next()
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+			semconv.HTTPResponseStatusCode(status),
+		)
+		if extra, ok := c.Get(logAttrsKey); ok {
+			span.SetAttributes(spanAttributes(extra.([]any))...)
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// spanAttributes converts addLogAttrs key/value pairs to span attributes.
+func spanAttributes(kv []any) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok || spanAttrSkip[key] {
+			continue
+		}
+		switch v := kv[i+1].(type) {
+		case string:
+			attrs = append(attrs, attribute.String(key, v))
+		case bool:
+			attrs = append(attrs, attribute.Bool(key, v))
+		case int:
+			attrs = append(attrs, attribute.Int(key, v))
+		case int64:
+			attrs = append(attrs, attribute.Int64(key, v))
+		case float64:
+			attrs = append(attrs, attribute.Float64(key, v))
+		default:
+			attrs = append(attrs, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return attrs
+}
+
+// startUpstreamSpan starts a client span for one HTTP call to a model host.
+func startUpstreamSpan(ctx context.Context, name, url string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.URLFull(url)))
+}
+
+// endUpstreamSpan records the upstream status, if any, and err on span.
+func endUpstreamSpan(span trace.Span, status int, err error) {
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
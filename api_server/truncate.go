@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// cutAtStop returns resp up to the first occurrence of any stop sequence.
+// The model host is asked to stop there too, but may not honor it.
+func cutAtStop(stops []string, resp string) (string, bool) {
+	cut := -1
+	for _, stop := range stops {
+		if i := strings.Index(resp, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut < 0 {
+		return resp, false
+	}
+	return resp[:cut], true
+}
+
+// limitResponse cuts resp at req's stop sequences and then to
+// req.MaxResponseChars, reporting whether the character limit cut it.
+func limitResponse(req ChatRequest, resp string) (string, bool) {
+	resp, _ = cutAtStop(req.Stop, resp)
+	if req.MaxResponseChars == nil || utf8.RuneCountInString(resp) <= *req.MaxResponseChars {
+		return resp, false
+	}
+	return string([]rune(resp)[:*req.MaxResponseChars]), true
+}
+
+// streamCutter applies limitResponse to a stream of text. It holds back
+// enough of the tail to recognize a stop sequence split across chunks.
+type streamCutter struct {
+	req     ChatRequest
+	hold    int
+	pending string
+	sent    int
+}
+
+func newStreamCutter(req ChatRequest) *streamCutter {
+	hold := 0
+	for _, stop := range req.Stop {
+		hold = max(hold, len(stop)-1)
+	}
+	return &streamCutter{req: req, hold: hold}
+}
+
+// push adds text and returns what may be sent now, and whether the stream
+// should end because a stop sequence or the character limit was reached.
+func (sc *streamCutter) push(text string) (string, bool) {
+	sc.pending += text
+	if out, stopped := cutAtStop(sc.req.Stop, sc.pending); stopped {
+		sc.pending = ""
+		out, _ = sc.limit(out)
+		return out, true
+	}
+	cut := len(sc.pending) - sc.hold
+	for cut > 0 && cut < len(sc.pending) && !utf8.RuneStart(sc.pending[cut]) {
+		cut--
+	}
+	if cut <= 0 {
+		return "", false
+	}
+	out := sc.pending[:cut]
+	sc.pending = sc.pending[cut:]
+	return sc.limit(out)
+}
+
+// flush returns the held-back tail once the upstream stream has ended.
+func (sc *streamCutter) flush() string {
+	out, _ := sc.limit(sc.pending)
+	sc.pending = ""
+	return out
+}
+
+func (sc *streamCutter) limit(out string) (string, bool) {
+	if sc.req.MaxResponseChars == nil {
+		return out, false
+	}
+	left := *sc.req.MaxResponseChars - sc.sent
+	if n := utf8.RuneCountInString(out); n < left {
+		sc.sent += n
+		return out, false
+	}
+	sc.sent += left
+	return string([]rune(out)[:left]), true
+}
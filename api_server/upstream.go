@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const HF_SPACE_URL = "https://trinitysoul-infer-tifin.hf.space/infer"
+
+// HF_EMBEDDINGS_URL is the model host's embeddings route.
+const HF_EMBEDDINGS_URL = "https://trinitysoul-infer-tifin.hf.space/embeddings"
+
+const defaultUpstreamTimeout = 30 * time.Second
+
+// maxErrorBodyBytes bounds how much of an upstream body is kept in errors.
+const maxErrorBodyBytes = 512
+
+// maxDecodeSnippetBytes bounds the raw body quoted when decoding fails.
+const maxDecodeSnippetBytes = 200
+
+const defaultMaxUpstreamResponseBytes = 8 << 20
+
+// maxUpstreamResponseBytes caps how much of one upstream response body is
+// read, buffered or streamed; set from INFER_MAX_UPSTREAM_RESPONSE_BYTES in
+// main.
+var maxUpstreamResponseBytes int64 = defaultMaxUpstreamResponseBytes
+
+// statusClientClosed is the nginx convention for a client that went away
+// before the response was written.
+const statusClientClosed = 499
+
+const (
+	defaultMaxAttempts = 3
+	retryBaseDelay     = 200 * time.Millisecond
+	retryMaxDelay      = 5 * time.Second
+)
+
+// maxAttempts caps upstream tries per query; set from INFER_MAX_ATTEMPTS in
+// main.
+var maxAttempts = defaultMaxAttempts
+
+// rejectEmptyResponses makes an empty or whitespace-only answer an error;
+// set from INFER_REJECT_EMPTY_RESPONSES in main.
+var rejectEmptyResponses = true
+
+// errEmptyResponse is an answer with nothing but whitespace in it, which a
+// loaded host sometimes sends. It is retried like a dropped connection.
+var errEmptyResponse = errors.New("upstream returned an empty response")
+
+const (
+	upstreamMaxIdleConns        = 100
+	upstreamMaxIdleConnsPerHost = 32
+	upstreamIdleConnTimeout     = 90 * time.Second
+)
+
+// newUpstreamTransport keeps enough idle connections per host that a full
+// batch can reuse them instead of redialling the model host.
+func newUpstreamTransport(idlePerHost int) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = max(upstreamMaxIdleConns, idlePerHost)
+	t.MaxIdleConnsPerHost = idlePerHost
+	t.IdleConnTimeout = upstreamIdleConnTimeout
+	return t
+}
+
+// defaultResponseField is the model host's answer field, as in
+// {"response": "..."}.
+const defaultResponseField = "response"
+
+// SchemaDriftError is returned when the model host answers 2xx with a JSON
+// object whose answer field is missing, null or not a string. Keys lists
+// the fields it did send.
+type SchemaDriftError struct {
+	Field string
+	Keys  []string
+}
+
+func (e *SchemaDriftError) Error() string {
+	return fmt.Sprintf("upstream response field %q is missing or not a string (keys: %s)", e.Field, strings.Join(e.Keys, ", "))
+}
+
+// decodeModelResponse extracts the answer from a model host response body.
+// A missing field is schema drift. An empty or whitespace-only answer is
+// errEmptyResponse, unless empty answers are allowed.
+func decodeModelResponse(data []byte, field string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("decoding upstream response: %w (body: %q)", err, truncate(string(data), maxDecodeSnippetBytes))
+	}
+	var text string
+	if raw, ok := fields[field]; ok && string(raw) != "null" && json.Unmarshal(raw, &text) == nil {
+		if rejectEmptyResponses && strings.TrimSpace(text) == "" {
+			return "", errEmptyResponse
+		}
+		return text, nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return "", &SchemaDriftError{Field: field, Keys: keys}
+}
+
+// upstreamMeta returns every field of a model host response other than
+// the answer field, such as token counts or the model name, or nil if there
+// are none.
+func upstreamMeta(data []byte, field string) map[string]any {
+	var fields map[string]any
+	if json.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+	delete(fields, field)
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// ResponseTooLargeError is returned when an upstream body, buffered or
+// streamed, runs past Limit bytes. Reading stops there.
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("upstream response exceeds %d bytes", e.Limit)
+}
+
+// readUpstreamBody reads a whole upstream body, but never more than
+// maxUpstreamResponseBytes of it.
+func readUpstreamBody(r io.Reader) ([]byte, error) {
+	limit := maxUpstreamResponseBytes
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading upstream response: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, &ResponseTooLargeError{Limit: limit}
+	}
+	return data, nil
+}
+
+// cappedBody ends a streamed upstream body with ResponseTooLargeError once
+// more than limit bytes have come through in total.
+type cappedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func capBody(body io.ReadCloser) *cappedBody {
+	return &cappedBody{ReadCloser: body, remaining: maxUpstreamResponseBytes, limit: maxUpstreamResponseBytes}
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, &ResponseTooLargeError{Limit: b.limit}
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// UpstreamStatusError is returned when the model host answers with a
+// non-2xx status. RetryAfter is the host's Retry-After hint, if it sent one.
+type UpstreamStatusError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream returned %d: %s", e.StatusCode, e.Body)
+}
+
+func newUpstreamStatusError(resp *http.Response, body []byte) *UpstreamStatusError {
+	return &UpstreamStatusError{
+		StatusCode: resp.StatusCode,
+		Body:       truncate(string(body), maxErrorBodyBytes),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter reads a Retry-After value in seconds or as an HTTP date,
+// returning zero when it is missing, malformed or already past.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// rateLimitHint returns how long the model host asked callers to back off,
+// and whether err is an upstream 429 at all.
+func rateLimitHint(err error) (time.Duration, bool) {
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+		return statusErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// upstreamErrorStatus maps a failed upstream call to an HTTP status and a
+// short error type, so timeouts can be told apart from refused connections.
+func upstreamErrorStatus(err error) (int, string) {
+	code := upstreamErrorCode(err)
+	var statusErr *UpstreamStatusError
+	if code == codeUpstreamStatus && errors.Is(err, errUpstream4xx) && errors.As(err, &statusErr) {
+		return statusErr.StatusCode, code
+	}
+	return errorStatuses[code], code
+}
+
+// upstreamErrorCode classifies a failed upstream call.
+func upstreamErrorCode(err error) string {
+	kind, _ := upstreamKind(err)
+	var statusErr *UpstreamStatusError
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return codeCircuitOpen
+	case errors.Is(err, errUpstreamBusy):
+		return codeUpstreamBusy
+	case errors.Is(err, errBatchAborted):
+		return codeBatchAborted
+	case errors.As(err, new(*SchemaDriftError)):
+		return codeSchemaMismatch
+	case errors.As(err, new(*ResponseTooLargeError)):
+		return codeResponseTooLarge
+	case errors.Is(err, errEmptyResponse):
+		return codeEmptyResponse
+	case errors.As(err, new(*InvalidJSONError)):
+		return codeInvalidJSON
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode == http.StatusTooManyRequests {
+			return codeUpstreamRateLimited
+		}
+		return codeUpstreamStatus
+	case errors.Is(err, context.Canceled):
+		return codeClientCancelled
+	case kind == kindTimeout:
+		return codeUpstreamTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return codeConnectionRefused
+	default:
+		return codeUpstreamError
+	}
+}
+
+// isRetryable reports whether err is a transient upstream failure: a
+// dropped or refused connection, a 502/503/504 from the model host, or an
+// empty answer.
+func isRetryable(err error) bool {
+	kind, _ := upstreamKind(err)
+	switch kind {
+	case kindConnection, kindEmpty:
+		return true
+	case kindUpstream5xx:
+		var statusErr *UpstreamStatusError
+		errors.As(err, &statusErr)
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns a full-jitter exponential delay for the given retry.
+func backoff(retry int) time.Duration {
+	d := retryBaseDelay << retry
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return rand.N(d) + 1
+}
+
+// callModelAPI sends req to a backend from pool and, if that fails with an
+// upstream-side error and a fallback is configured, tries the fallback once.
+func callModelAPI(ctx context.Context, pool *backendPool, req ChatRequest) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "callModelAPI", trace.WithAttributes(attribute.String("chat_id", req.ChatID)))
+	defer func() { endUpstreamSpan(span, 0, err) }()
+
+	release, err := upstreamSlots.acquire(ctx, req.ChatID, priorityLevel(req.Priority))
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	done, err := adaptive.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := callPrimary(ctx, pool, req)
+	done(err)
+	if err == nil || pool.fallback == "" || ctx.Err() != nil || !countsAsUpstreamFailure(err) {
+		return resp, err
+	}
+
+	slog.Warn("primary upstream failed, using fallback",
+		"request_id", requestIDFrom(ctx), "chat_id", req.ChatID, "fallback", pool.fallback, "error", err.Error())
+	start := time.Now()
+	resp, ferr := callModelOnce(ctx, pool.fallback, req)
+	pool.fallbackStats.observe(ferr, time.Since(start))
+	observeUpstream(start, ferr)
+	if ferr != nil {
+		return "", fmt.Errorf("%w (fallback: %v)", err, ferr)
+	}
+	info := callInfoFrom(ctx)
+	info.setBackend(pool.fallback)
+	info.setFallback()
+	return resp, nil
+}
+
+// callPrimary sends req to the backend pool, retrying transient failures
+// with exponential backoff until maxAttempts is reached or ctx is done. Each
+// attempt takes the next backend, in rotation or in chat_id ranking.
+func callPrimary(ctx context.Context, pool *backendPool, req ChatRequest) (resp string, err error) {
+	if err := breaker.allow(); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	defer func() {
+		breaker.record(err)
+		observeUpstream(start, err)
+	}()
+	for attempt := 1; ; attempt++ {
+		b := pool.pickFor(req.ChatID, attempt)
+		callStart := time.Now()
+		resp, err := callModelOnce(ctx, b.url, req)
+		b.record(err, time.Since(callStart))
+		callInfoFrom(ctx).setBackend(b.url)
+		if err == nil || attempt >= maxAttempts || !isRetryable(err) {
+			return resp, err
+		}
+		delay := backoff(attempt - 1)
+		kind, _ := upstreamKind(err)
+		slog.Warn("retrying upstream call",
+			"request_id", requestIDFrom(ctx), "chat_id", req.ChatID, "backend", b.url, "attempt", attempt, "max_attempts", maxAttempts,
+			"delay_ms", delay.Milliseconds(), "error_kind", string(kind), "error", err.Error())
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return "", ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// upstreamGzip compresses request bodies sent upstream, for model hosts that
+// accept Content-Encoding: gzip.
+var upstreamGzip bool
+
+// newUpstreamRequest builds the JSON POST of payload to url.
+func newUpstreamRequest(ctx context.Context, url string, payload any) (*http.Request, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encoding upstream request: %w", err)
+	}
+	upstreamDebug.request(ctx, url, payload, body)
+	var r io.Reader = bytes.NewReader(body)
+	if upstreamGzip {
+		if r, err = gzipBody(body); err != nil {
+			return nil, fmt.Errorf("compressing upstream request: %w", err)
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, r)
+	if err != nil {
+		return nil, fmt.Errorf("building upstream request: %w", err)
+	}
+	setUpstreamHeaders(httpReq.Header)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if upstreamGzip {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	setTraceHeaders(ctx, httpReq.Header)
+	return httpReq, nil
+}
+
+func callModelOnce(ctx context.Context, upstream string, req ChatRequest) (_ string, err error) {
+	ctx, span := startUpstreamSpan(ctx, "upstream.infer", upstream)
+	status := 0
+	defer func() { endUpstreamSpan(span, status, err) }()
+	defer func() { err = classifyUpstream(err) }()
+
+	httpReq, err := newUpstreamRequest(ctx, upstream, req)
+	if err != nil {
+		return "", err
+	}
+	resp, err := inferenceClient(ctx).Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	status = resp.StatusCode
+
+	data, err := readUpstreamBody(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	upstreamDebug.response(ctx, upstream, req.ChatID, resp.StatusCode, data)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", newUpstreamStatusError(resp, data)
+	}
+	field := liveFrom(ctx).responseField
+	text, err := decodeModelResponse(data, field)
+	var drift *SchemaDriftError
+	if errors.As(err, &drift) {
+		slog.Warn("upstream response schema drift",
+			"request_id", requestIDFrom(ctx), "backend", upstream, "field", drift.Field, "keys", drift.Keys)
+	}
+	if err != nil {
+		return "", err
+	}
+	info := callInfoFrom(ctx)
+	info.setMeta(upstreamMeta(data, field))
+	info.setRaw(data)
+	return text, nil
+}
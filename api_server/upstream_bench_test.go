@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubLatency stands in for the model's generation time, so the number of
+// calls in flight matters the way it does against a real host.
+const stubLatency = time.Millisecond
+
+// newStubUpstream starts a model host that answers every /infer call with
+// a fixed response after stubLatency.
+func newStubUpstream(b *testing.B) *httptest.Server {
+	b.Helper()
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(stubLatency)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"response": "ok"})
+	}))
+	b.Cleanup(stub.Close)
+	return stub
+}
+
+// quietLogs drops log output for the rest of the benchmark.
+func quietLogs(b *testing.B) {
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { slog.SetDefault(prev) })
+}
+
+// reportRate reports n units of work done over the benchmark as a rate.
+func reportRate(b *testing.B, n int, unit string) {
+	b.ReportMetric(float64(n)/b.Elapsed().Seconds(), unit)
+}
+
+// BenchmarkCallModelAPI measures single upstream calls from a number of
+// concurrent workers, against transports keeping different numbers of idle
+// connections per host.
+func BenchmarkCallModelAPI(b *testing.B) {
+	quietLogs(b)
+	stub := newStubUpstream(b)
+	for _, idle := range []int{2, upstreamMaxIdleConnsPerHost, 128} {
+		for _, workers := range []int{1, 16, 64} {
+			b.Run(fmt.Sprintf("idle=%d/workers=%d", idle, workers), func(b *testing.B) {
+				cfg := testConfig(b, map[string]string{"INFER_UPSTREAM_URL": stub.URL + "/infer"})
+				transport := newUpstreamTransport(idle)
+				b.Cleanup(transport.CloseIdleConnections)
+				installConfig(cfg, transport)
+				req := ChatRequest{ChatID: "bench", UserPrompt: "hello"}
+
+				var next atomic.Int64
+				var failed atomic.Int64
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for range workers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for next.Add(1) <= int64(b.N) {
+							if _, err := callModelAPI(context.Background(), live.Load().pool, req); err != nil {
+								failed.Add(1)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				b.StopTimer()
+				if n := failed.Load(); n > 0 {
+					b.Fatalf("%d of %d calls failed", n, b.N)
+				}
+				reportRate(b, b.N, "req/s")
+			})
+		}
+	}
+}
+
+// BenchmarkBatchHandler measures /chat/batched/v2 with batches of distinct
+// queries at different batch concurrencies and idle connection limits.
+func BenchmarkBatchHandler(b *testing.B) {
+	const batchSize = 64
+	quietLogs(b)
+	stub := newStubUpstream(b)
+	for _, concurrency := range []int{1, 4, defaultBatchConcurrency, 64} {
+		for _, idle := range []int{2, upstreamMaxIdleConnsPerHost} {
+			b.Run(fmt.Sprintf("concurrency=%d/idle=%d", concurrency, idle), func(b *testing.B) {
+				cfg := testConfig(b, map[string]string{
+					"INFER_UPSTREAM_URL":      stub.URL + "/infer",
+					"INFER_BATCH_CONCURRENCY": strconv.Itoa(concurrency),
+					"INFER_CACHE_SIZE":        "0",
+				})
+				transport := newUpstreamTransport(idle)
+				b.Cleanup(transport.CloseIdleConnections)
+				installConfig(cfg, transport)
+				r, _ := newTestRouterFor(b, cfg, httpInferencer{})
+
+				queries := make([]ChatRequest, batchSize)
+				b.ResetTimer()
+				for n := range b.N {
+					// Distinct prompts on every iteration, so no query is
+					// shared with another.
+					for i := range queries {
+						queries[i] = ChatRequest{ChatID: "bench", UserPrompt: fmt.Sprintf("q%d-%d", n, i)}
+					}
+					if w := postJSON(b, r, "/chat/batched/v2", BatchRequest{Queries: queries}); w.Code != http.StatusOK {
+						b.Fatalf("status = %d; body %s", w.Code, w.Body)
+					}
+				}
+				b.StopTimer()
+				reportRate(b, b.N*batchSize, "queries/s")
+			})
+		}
+	}
+}
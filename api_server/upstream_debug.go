@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultUpstreamDebugMaxBytes = 4096
+
+// redactedValue replaces the value of a redacted field in debug logs.
+const redactedValue = "[REDACTED]"
+
+// upstreamDebugSettings controls logging of raw upstream bodies, which is
+// off unless INFER_UPSTREAM_DEBUG=true.
+type upstreamDebugSettings struct {
+	enabled  bool
+	maxBytes int
+	redact   map[string]bool
+}
+
+// loadUpstreamDebugSettings reads INFER_UPSTREAM_DEBUG,
+// INFER_UPSTREAM_DEBUG_MAX_BYTES and INFER_UPSTREAM_DEBUG_REDACT_FIELDS.
+// The bodies hold prompts and answers, so like load-test mode it also needs
+// INFER_DEV_MODE=true, is refused with GIN_MODE=release, and cannot be
+// turned on by a SIGHUP reload.
+func loadUpstreamDebugSettings() (upstreamDebugSettings, error) {
+	d := upstreamDebugSettings{redact: make(map[string]bool)}
+	var err error
+	if d.enabled, err = boolEnv("INFER_UPSTREAM_DEBUG", false); err != nil {
+		return d, err
+	}
+	if d.maxBytes, err = positiveIntEnv("INFER_UPSTREAM_DEBUG_MAX_BYTES", defaultUpstreamDebugMaxBytes); err != nil {
+		return d, err
+	}
+	for _, name := range strings.Split(os.Getenv("INFER_UPSTREAM_DEBUG_REDACT_FIELDS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			d.redact[name] = true
+		}
+	}
+	if !d.enabled {
+		return d, nil
+	}
+	dev, err := devModeEnv()
+	if err != nil {
+		return d, err
+	}
+	if !dev {
+		return d, errors.New("INFER_UPSTREAM_DEBUG logs prompts and answers and needs INFER_DEV_MODE=true")
+	}
+	if os.Getenv(gin.EnvGinMode) == gin.ReleaseMode {
+		return d, errors.New("INFER_UPSTREAM_DEBUG logs prompts and answers and cannot be used with GIN_MODE=release")
+	}
+	return d, nil
+}
+
+// upstreamDebugLogger logs the bodies sent to and received from the model
+// host. Each logged body has the configured fields masked, at any depth,
+// and the response filters applied to its other strings, so it shows no
+// more than a client would see; only then is it cut to maxBytes. A nil
+// *upstreamDebugLogger logs nothing.
+type upstreamDebugLogger struct {
+	maxBytes int
+	redact   map[string]bool
+	filters  *responseFilters
+}
+
+// upstreamDebug is set from config in main.
+var upstreamDebug *upstreamDebugLogger
+
+func newUpstreamDebugLogger(cfg upstreamDebugSettings, filters *responseFilters) *upstreamDebugLogger {
+	if !cfg.enabled {
+		return nil
+	}
+	return &upstreamDebugLogger{maxBytes: cfg.maxBytes, redact: cfg.redact, filters: filters}
+}
+
+// request logs the body of a call to url made for payload.
+func (d *upstreamDebugLogger) request(ctx context.Context, url string, payload any, body []byte) {
+	if d == nil {
+		return
+	}
+	slog.Info("upstream request", "request_id", requestIDFrom(ctx), "chat_id", debugChatID(payload), "url", url,
+		"body_bytes", len(body), "body", d.clean(body))
+}
+
+// response logs the body, possibly partial, of the answer to a call for
+// chatID.
+func (d *upstreamDebugLogger) response(ctx context.Context, url, chatID string, status int, body []byte) {
+	if d == nil {
+		return
+	}
+	slog.Info("upstream response", "request_id", requestIDFrom(ctx), "chat_id", chatID, "url", url, "status", status,
+		"body_bytes", len(body), "body", d.clean(body))
+}
+
+// clean redacts body and cuts it to maxBytes. With nothing to redact the
+// bytes are logged exactly as they were; otherwise a JSON body is
+// re-encoded, and one that is not JSON only gets the response filters.
+func (d *upstreamDebugLogger) clean(body []byte) string {
+	text := string(body)
+	if len(d.redact) == 0 && d.filters == nil {
+		return truncate(text, d.maxBytes)
+	}
+	var v any
+	if json.Unmarshal(body, &v) == nil {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(d.redactValue(v))
+		text = strings.TrimSuffix(buf.String(), "\n")
+	} else {
+		text = d.filters.apply(ChatRequest{}, text)
+	}
+	return truncate(text, d.maxBytes)
+}
+
+func (d *upstreamDebugLogger) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, inner := range v {
+			if d.redact[k] {
+				v[k] = redactedValue
+			} else {
+				v[k] = d.redactValue(inner)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = d.redactValue(v[i])
+		}
+	case string:
+		return d.filters.apply(ChatRequest{}, v)
+	}
+	return v
+}
+
+// debugChatID is the chat_id a payload was sent for, or empty for batch
+// and embeddings calls.
+func debugChatID(payload any) string {
+	if req, ok := payload.(ChatRequest); ok {
+		return req.ChatID
+	}
+	return ""
+}
+
+// stream wraps a streamed response body so the first maxBytes of it are
+// logged once it is closed.
+func (d *upstreamDebugLogger) stream(ctx context.Context, url, chatID string, status int, body io.ReadCloser) io.ReadCloser {
+	if d == nil {
+		return body
+	}
+	return &debugStreamBody{ReadCloser: body, d: d, ctx: ctx, url: url, chatID: chatID, status: status}
+}
+
+type debugStreamBody struct {
+	io.ReadCloser
+	d      *upstreamDebugLogger
+	ctx    context.Context
+	url    string
+	chatID string
+	status int
+	seen   bytes.Buffer
+	logged bool
+}
+
+func (b *debugStreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.d.maxBytes + 1 - b.seen.Len(); room > 0 {
+		b.seen.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+func (b *debugStreamBody) Close() error {
+	if !b.logged {
+		b.logged = true
+		b.d.response(b.ctx, b.url, b.chatID, b.status, b.seen.Bytes())
+	}
+	return b.ReadCloser.Close()
+}
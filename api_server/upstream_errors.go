@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// UpstreamErrorKind says what went wrong with an upstream call, so retries,
+// the circuit breaker, the adaptive limiter and the handlers can decide
+// what to do about it without picking the error apart themselves.
+type UpstreamErrorKind string
+
+const (
+	// kindConnection is a host that could not be reached, refused the
+	// connection or dropped it before answering.
+	kindConnection UpstreamErrorKind = "connection"
+	// kindTimeout is a call that ran out of time, on the client's deadline
+	// or the upstream client's own.
+	kindTimeout UpstreamErrorKind = "timeout"
+	// kindUpstream5xx and kindUpstream4xx are non-2xx answers; the full
+	// *UpstreamStatusError is in the chain.
+	kindUpstream5xx UpstreamErrorKind = "upstream_5xx"
+	kindUpstream4xx UpstreamErrorKind = "upstream_4xx"
+	// kindDecode is a 2xx body the server could not use: not JSON, schema
+	// drift, the wrong number of entries, or past maxUpstreamResponseBytes.
+	kindDecode UpstreamErrorKind = "decode"
+	// kindEmpty is an answer with nothing but whitespace in it.
+	kindEmpty UpstreamErrorKind = "empty"
+)
+
+// UpstreamError is a failed upstream call with its kind. Err is the
+// underlying error, so errors.As still finds an *UpstreamStatusError or a
+// *SchemaDriftError, and errors.Is still finds context.DeadlineExceeded.
+type UpstreamError struct {
+	Kind UpstreamErrorKind
+	Err  error
+}
+
+// Kind sentinels, for errors.Is(err, errUpstreamTimeout) and the like.
+var (
+	errUpstreamConnection = &UpstreamError{Kind: kindConnection}
+	errUpstreamTimeout    = &UpstreamError{Kind: kindTimeout}
+	errUpstream5xx        = &UpstreamError{Kind: kindUpstream5xx}
+	errUpstream4xx        = &UpstreamError{Kind: kindUpstream4xx}
+	errUpstreamDecode     = &UpstreamError{Kind: kindDecode}
+	errUpstreamEmpty      = &UpstreamError{Kind: kindEmpty}
+)
+
+func (e *UpstreamError) Error() string {
+	if e.Err == nil {
+		return "upstream " + string(e.Kind) + " error"
+	}
+	return e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// Is matches the kind sentinels: any UpstreamError is a sentinel of its
+// kind.
+func (e *UpstreamError) Is(target error) bool {
+	t, ok := target.(*UpstreamError)
+	return ok && t.Err == nil && t.Kind == e.Kind
+}
+
+// classifyUpstream wraps err from an upstream call in an *UpstreamError of
+// its kind. Errors that are already classified, and those that are not
+// upstream failures at all, such as a client cancellation or an open
+// circuit, are returned as they are.
+func classifyUpstream(err error) error {
+	if err == nil || errors.As(err, new(*UpstreamError)) {
+		return err
+	}
+	if kind, ok := kindOf(err); ok {
+		return &UpstreamError{Kind: kind, Err: err}
+	}
+	return err
+}
+
+// upstreamKind returns the kind of err, classifying it on the spot if it
+// has not been yet, and false if it is not an upstream failure.
+func upstreamKind(err error) (UpstreamErrorKind, bool) {
+	var upErr *UpstreamError
+	if errors.As(err, &upErr) {
+		return upErr.Kind, true
+	}
+	return kindOf(err)
+}
+
+func kindOf(err error) (UpstreamErrorKind, bool) {
+	var netErr net.Error
+	var statusErr *UpstreamStatusError
+	var opErr *net.OpError
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return "", false
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return kindTimeout, true
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode >= http.StatusInternalServerError {
+			return kindUpstream5xx, true
+		}
+		return kindUpstream4xx, true
+	case errors.Is(err, errEmptyResponse):
+		return kindEmpty, true
+	case errors.As(err, new(*SchemaDriftError)),
+		errors.As(err, new(*ResponseTooLargeError)),
+		errors.As(err, new(*json.SyntaxError)),
+		errors.As(err, new(*json.UnmarshalTypeError)):
+		return kindDecode, true
+	case errors.As(err, &opErr),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF):
+		return kindConnection, true
+	}
+	return "", false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// upstreamHeaders is attached to every request sent to the model host:
+// inference, streams, embeddings, warm-ups and health probes.
+var upstreamHeaders http.Header
+
+// reservedUpstreamHeaders are set by the server itself and may not be
+// configured.
+var reservedUpstreamHeaders = []string{
+	"Content-Type", "Content-Encoding", "Content-Length", "Host",
+	requestIDHeader, traceparentHeader, "Tracestate",
+}
+
+// loadUpstreamHeaders reads "Name: value" entries from INFER_UPSTREAM_HEADERS
+// (comma separated) and INFER_UPSTREAM_HEADERS_FILE (one per line, #
+// comments), and turns HF_TOKEN into "Authorization: Bearer <token>". Errors
+// name the header and the source but never echo a value, so secrets stay
+// out of the logs.
+func loadUpstreamHeaders() (http.Header, error) {
+	h := make(http.Header)
+	if raw := os.Getenv("INFER_UPSTREAM_HEADERS"); raw != "" {
+		for i, entry := range strings.Split(raw, ",") {
+			if err := addUpstreamHeader(h, entry); err != nil {
+				return nil, fmt.Errorf("INFER_UPSTREAM_HEADERS entry %d: %w", i+1, err)
+			}
+		}
+	}
+	if path := os.Getenv("INFER_UPSTREAM_HEADERS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("INFER_UPSTREAM_HEADERS_FILE: %w", err)
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for n := 1; sc.Scan(); n++ {
+			if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				if err := addUpstreamHeader(h, line); err != nil {
+					return nil, fmt.Errorf("INFER_UPSTREAM_HEADERS_FILE line %d: %w", n, err)
+				}
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("INFER_UPSTREAM_HEADERS_FILE: %w", err)
+		}
+	}
+	if token := strings.TrimSpace(os.Getenv("HF_TOKEN")); token != "" {
+		if h.Get("Authorization") != "" {
+			return nil, fmt.Errorf("HF_TOKEN: Authorization is already set in the upstream headers")
+		}
+		if err := addUpstreamHeader(h, "Authorization: Bearer "+token); err != nil {
+			return nil, fmt.Errorf("HF_TOKEN: %w", err)
+		}
+	}
+	return h, nil
+}
+
+func addUpstreamHeader(h http.Header, entry string) error {
+	name, value, ok := strings.Cut(entry, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	switch {
+	case !ok:
+		return fmt.Errorf("want \"Name: value\"")
+	case !httpguts.ValidHeaderFieldName(name):
+		return fmt.Errorf("invalid header name %q", name)
+	case !httpguts.ValidHeaderFieldValue(value):
+		return fmt.Errorf("header %s has an invalid value", name)
+	}
+	for _, reserved := range reservedUpstreamHeaders {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("header %s is set by the server", name)
+		}
+	}
+	h.Add(name, value)
+	return nil
+}
+
+// setUpstreamHeaders copies the configured headers onto an outgoing request.
+func setUpstreamHeaders(h http.Header) {
+	for name, values := range upstreamHeaders {
+		h[name] = append(h[name], values...)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultMaxPromptChars = 8000
+
+// Accepted ranges for generation parameters.
+const (
+	maxTemperature   = 2.0
+	maxMaxTokens     = 2048
+	maxStopSequences = 4
+)
+
+// fieldError names a request field that failed validation.
+type fieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// validateChatRequest returns every field of req that is missing or too
+// long; an empty result means the request may be forwarded upstream.
+func validateChatRequest(req ChatRequest, maxPromptChars int) []fieldError {
+	var errs []fieldError
+	if strings.TrimSpace(req.ChatID) == "" {
+		errs = append(errs, fieldError{"chat_id", "required"})
+	}
+	if strings.TrimSpace(req.UserPrompt) == "" {
+		errs = append(errs, fieldError{"user_prompt", "required"})
+	} else if n := utf8.RuneCountInString(req.UserPrompt); n > maxPromptChars {
+		errs = append(errs, fieldError{"user_prompt", fmt.Sprintf("length %d exceeds maximum %d", n, maxPromptChars)})
+	}
+	if n := utf8.RuneCountInString(req.SystemPrompt); n > maxPromptChars {
+		errs = append(errs, fieldError{"system_prompt", fmt.Sprintf("length %d exceeds maximum %d", n, maxPromptChars)})
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > maxTemperature) {
+		errs = append(errs, fieldError{"temperature", fmt.Sprintf("must be between 0 and %g", maxTemperature)})
+	}
+	if req.TopP != nil && (*req.TopP <= 0 || *req.TopP > 1) {
+		errs = append(errs, fieldError{"top_p", "must be greater than 0 and at most 1"})
+	}
+	if req.MaxTokens != nil && (*req.MaxTokens < 1 || *req.MaxTokens > maxMaxTokens) {
+		errs = append(errs, fieldError{"max_tokens", fmt.Sprintf("must be between 1 and %d", maxMaxTokens)})
+	}
+	if req.MaxResponseChars != nil && *req.MaxResponseChars < 1 {
+		errs = append(errs, fieldError{"max_response_chars", "must be at least 1"})
+	}
+	switch req.ResponseFormat {
+	case "", responseFormatText:
+	case responseFormatJSON:
+		if req.MaxResponseChars != nil {
+			errs = append(errs, fieldError{"max_response_chars", "cannot be combined with response_format json"})
+		}
+	default:
+		errs = append(errs, fieldError{"response_format", "must be text or json"})
+	}
+	if req.RepairJSON && req.ResponseFormat != responseFormatJSON {
+		errs = append(errs, fieldError{"repair_json", "only applies to response_format json"})
+	}
+	switch req.Priority {
+	case "", priorityHigh, priorityNormal, priorityLow:
+	default:
+		errs = append(errs, fieldError{"priority", "must be high, normal or low"})
+	}
+	if len(req.Stop) > maxStopSequences {
+		errs = append(errs, fieldError{"stop", fmt.Sprintf("at most %d sequences allowed", maxStopSequences)})
+	}
+	for _, s := range req.Stop {
+		if s == "" {
+			errs = append(errs, fieldError{"stop", "sequences must be non-empty"})
+			break
+		}
+	}
+	return errs
+}
+
+// validateEmbeddingsRequest checks that there are between 1 and maxInputs
+// inputs, each non-blank and within maxChars.
+func validateEmbeddingsRequest(req EmbeddingsRequest, maxInputs, maxChars int) []fieldError {
+	if len(req.Input) == 0 {
+		return []fieldError{{"input", "required"}}
+	}
+	if len(req.Input) > maxInputs {
+		return []fieldError{{"input", fmt.Sprintf("%d inputs exceeds maximum %d", len(req.Input), maxInputs)}}
+	}
+	var errs []fieldError
+	for i, in := range req.Input {
+		field := fmt.Sprintf("input[%d]", i)
+		if strings.TrimSpace(in) == "" {
+			errs = append(errs, fieldError{field, "required"})
+		} else if n := utf8.RuneCountInString(in); n > maxChars {
+			errs = append(errs, fieldError{field, fmt.Sprintf("length %d exceeds maximum %d", n, maxChars)})
+		}
+	}
+	return errs
+}
+
+// validateIndices requires a non-empty list of distinct indices into a
+// batch of n queries.
+func validateIndices(indices []int, n int) []fieldError {
+	if len(indices) == 0 {
+		return []fieldError{{"indices", "required"}}
+	}
+	seen := make(map[int]bool, len(indices))
+	for _, i := range indices {
+		switch {
+		case i < 0 || i >= n:
+			return []fieldError{{"indices", fmt.Sprintf("index %d out of range for %d queries", i, n)}}
+		case seen[i]:
+			return []fieldError{{"indices", fmt.Sprintf("index %d repeated", i)}}
+		}
+		seen[i] = true
+	}
+	return nil
+}
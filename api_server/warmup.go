@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const defaultKeepAliveInterval = 5 * time.Minute
+
+var warmupMaxTokens = 1
+
+// warmupRequest is the throwaway inference that wakes a sleeping model host:
+// a health probe is answered before the model is loaded, so it would not do.
+var warmupRequest = ChatRequest{ChatID: "warmup", UserPrompt: "hi", MaxTokens: &warmupMaxTokens}
+
+// warmBackends sends warmupRequest to every backend of the live pool, and
+// the fallback, right away and then every interval until ctx is done.
+// Failures are only logged.
+func warmBackends(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		p := live.Load().pool
+		urls := p.urls()
+		if p.fallback != "" {
+			urls = append(urls, p.fallback)
+		}
+		var wg sync.WaitGroup
+		for _, u := range urls {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				_, err := callModelOnce(ctx, u, warmupRequest)
+				attrs := []any{"backend", u, "duration_ms", time.Since(start).Milliseconds()}
+				if err != nil {
+					slog.Warn("upstream warm-up failed", append(attrs, "error", err.Error())...)
+					return
+				}
+				slog.Info("upstream warmed up", attrs...)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	signatureHeader         = "X-Signature-256"
+	defaultCallbackAttempts = 4
+	callbackTimeout         = 10 * time.Second
+)
+
+const (
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// callbackHosts reads INFER_CALLBACK_ALLOWED_HOSTS, a comma-separated list
+// of the host names job callbacks may go to. Empty allows any host with a
+// public address.
+func callbackHosts() map[string]bool {
+	hosts := make(map[string]bool)
+	for _, h := range strings.Split(os.Getenv("INFER_CALLBACK_ALLOWED_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts[h] = true
+		}
+	}
+	return hosts
+}
+
+// callbackPolicy decides where job callbacks may be sent, since the
+// callback_url comes from the client. Without allowed hosts any host is
+// accepted, but only public addresses are dialled, so a callback cannot
+// reach loopback, link-local addresses such as the cloud metadata service
+// at 169.254.169.254, or private networks. With allowed hosts only those
+// are accepted, at whatever address they resolve to. Redirects are never
+// followed.
+type callbackPolicy struct {
+	hosts  map[string]bool
+	client *http.Client
+}
+
+func newCallbackPolicy(hosts map[string]bool) *callbackPolicy {
+	p := &callbackPolicy{hosts: hosts}
+	dialer := &net.Dialer{Timeout: callbackTimeout, KeepAlive: 30 * time.Second}
+	public := &net.Dialer{Timeout: callbackTimeout, KeepAlive: 30 * time.Second, Control: dialPublicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would dial on the callback's behalf, past the address check.
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && p.hosts[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return public.DialContext(ctx, network, addr)
+	}
+	p.client = &http.Client{
+		Timeout:   callbackTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return p
+}
+
+// check validates a job's callback_url against the policy.
+func (p *callbackPolicy) check(raw string) error {
+	if err := validateUpstreamURL("callback_url", raw); err != nil {
+		return err
+	}
+	u, _ := url.Parse(raw)
+	host := strings.ToLower(u.Hostname())
+	if len(p.hosts) > 0 {
+		if !p.hosts[host] {
+			return fmt.Errorf("callback_url %q: host %s is not in INFER_CALLBACK_ALLOWED_HOSTS", raw, host)
+		}
+		return nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !publicAddr(addr) {
+		return fmt.Errorf("callback_url %q: %s is not a public address", raw, host)
+	}
+	return nil
+}
+
+// dialPublicOnly refuses a connection to an address that is not public,
+// after the host name has been resolved.
+func dialPublicOnly(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ap.Addr()) {
+		return fmt.Errorf("callback address %s is not public", ap.Addr())
+	}
+	return nil
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() && !addr.IsMulticast() && !addr.IsUnspecified()
+}
+
+// callbackSigner signs webhook bodies with HMAC-SHA256. A nil signer sends
+// callbacks unsigned.
+type callbackSigner struct {
+	secret []byte
+}
+
+func newCallbackSigner(secret string) *callbackSigner {
+	if secret == "" {
+		return nil
+	}
+	return &callbackSigner{secret: []byte(secret)}
+}
+
+// sign returns the signature header value, "sha256=<hex>".
+func (cs *callbackSigner) sign(body []byte) string {
+	mac := hmac.New(sha256.New, cs.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCallback POSTs the finished job to url, retrying with backoff
+// until a 2xx or attempts are exhausted.
+func (s *server) deliverCallback(ctx context.Context, url string, j job) error {
+	body, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("encoding callback: %w", err)
+	}
+	for attempt := 0; ; attempt++ {
+		if err = postCallback(ctx, s.callbacks.client, url, body, s.callbackSigner); err == nil {
+			return nil
+		}
+		if attempt+1 >= s.callbackAttempts {
+			return err
+		}
+		slog.Warn("job callback failed, retrying", "job_id", j.ID, "attempt", attempt+1, "error", err.Error())
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func postCallback(ctx context.Context, client *http.Client, url string, body []byte, signer *callbackSigner) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building callback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signer != nil {
+		req.Header.Set(signatureHeader, signer.sign(body))
+	}
+	setTraceHeaders(ctx, req.Header)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBodyBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
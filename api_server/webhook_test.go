@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCallbackPolicyCheck(t *testing.T) {
+	open := newCallbackPolicy(nil)
+	listed := newCallbackPolicy(map[string]bool{"hooks.example.com": true})
+	tests := []struct {
+		policy *callbackPolicy
+		url    string
+		ok     bool
+	}{
+		{open, "https://hooks.example.com/done", true},
+		{open, "http://203.0.113.7:8080/done", true},
+		{open, "ftp://hooks.example.com/done", false},
+		{open, "http://127.0.0.1/done", false},
+		{open, "http://[::1]/done", false},
+		{open, "http://169.254.169.254/latest/meta-data", false},
+		{open, "http://10.1.2.3/done", false},
+		{open, "http://192.168.0.10/done", false},
+		{open, "http://[::ffff:127.0.0.1]/done", false},
+		{listed, "https://hooks.example.com/done", true},
+		{listed, "https://HOOKS.example.com/done", true},
+		{listed, "https://elsewhere.example.com/done", false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.check(tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("check(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestPostCallbackDial(t *testing.T) {
+	var hits atomic.Int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer receiver.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(receiver.URL, http.StatusFound))
+	defer redirector.Close()
+	u, _ := url.Parse(receiver.URL)
+
+	// The receiver listens on loopback, which only an allowed host reaches.
+	if err := postCallback(context.Background(), newCallbackPolicy(nil).client, receiver.URL, []byte("{}"), nil); err == nil {
+		t.Error("callback to a loopback address was delivered")
+	}
+	allowed := newCallbackPolicy(map[string]bool{u.Hostname(): true})
+	if err := postCallback(context.Background(), allowed.client, receiver.URL, []byte("{}"), nil); err != nil {
+		t.Errorf("callback to an allowed host: %v", err)
+	}
+	if err := postCallback(context.Background(), allowed.client, redirector.URL, []byte("{}"), nil); err == nil {
+		t.Error("redirected callback reported as delivered")
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("receiver got %d callbacks, want 1; the redirect must not be followed", got)
+	}
+}
+
+func TestSubmitJobRejectsPrivateCallback(t *testing.T) {
+	r, _ := newTestRouter(t, &fakeInferencer{}, nil)
+	w := postJSON(t, r, "/jobs", map[string]any{
+		"queries":      batchOf("a"),
+		"callback_url": "http://169.254.169.254/latest/meta-data",
+	})
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != codeValidationFailed {
+		t.Errorf("status = %d, body %s; want 400 validation_failed", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsPingInterval is how often an open /chat/ws connection is pinged, so
+	// proxies keep it open and a dead peer is noticed once a ping cannot be
+	// written.
+	wsPingInterval = 30 * time.Second
+	// wsWriteTimeout bounds each frame written to a client that has stopped
+	// reading.
+	wsWriteTimeout = 10 * time.Second
+)
+
+// Message types on /chat/ws. Clients send chat (or no type), stop and ping;
+// the server sends token, done, error and pong.
+const (
+	wsTypeChat  = "chat"
+	wsTypeStop  = "stop"
+	wsTypePing  = "ping"
+	wsTypePong  = "pong"
+	wsTypeToken = "token"
+	wsTypeDone  = "done"
+	wsTypeError = "error"
+)
+
+// Reasons in a done frame.
+const (
+	wsDoneComplete = "complete"
+	wsDoneStopped  = "stopped"
+)
+
+// streamCauseStopped is a WebSocket answer cancelled by a stop message.
+const streamCauseStopped = "stopped"
+
+// errChatStopped is the cause of the cancellation a stop message triggers.
+var errChatStopped = errors.New("chat stopped by the client")
+
+// wsClientMessage is a message from a /chat/ws client: a ChatRequest, with
+// type chat or no type at all, or a control message with only a type.
+type wsClientMessage struct {
+	Type string `json:"type"`
+	ChatRequest
+}
+
+// wsFrame is a message from the server. Text is set on token frames,
+// Reason on done frames and Error, the usual error envelope, on error
+// frames.
+type wsFrame struct {
+	Type   string `json:"type"`
+	Text   string `json:"text,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Error  any    `json:"error,omitempty"`
+}
+
+// wsOrigins checks the Origin of WebSocket handshakes, which browsers send
+// without a CORS preflight. Non-browser clients send none and are allowed,
+// as is the server's own host and anything in INFER_CORS_ORIGINS.
+type wsOrigins []string
+
+func (o wsOrigins) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(o, "*") || slices.Contains(o, strings.TrimSuffix(origin, "/")) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleChatWS answers /chat/ws. Each chat message on the connection is
+// answered like a streamed /chat: the answer arrives as token frames and
+// ends with a done frame, or an error frame if it fails. One answer runs at
+// a time; a stop message cancels it, upstream call included, and it ends
+// with a done frame whose reason is stopped. The handler returns, and the
+// connection closes, when the client closes it or can no longer be written
+// to, cancelling whatever answer is in flight.
+func (s *server) handleChatWS(c *gin.Context) {
+	ws := websocket.Server{
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			if !s.wsOrigins.allowed(r) {
+				return errors.New("origin not allowed")
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = s.maxBodyBytes
+			// JSON frames are sent as text; only pings go through Write.
+			conn.PayloadType = websocket.PingFrame
+			(&wsSession{s: s, c: c, conn: conn}).run()
+		},
+	}
+	ws.ServeHTTP(c.Writer, c.Request)
+}
+
+// wsSession is one /chat/ws connection.
+type wsSession struct {
+	s    *server
+	c    *gin.Context
+	conn *websocket.Conn
+
+	writeMu sync.Mutex
+	chats   int
+	// stop cancels the answer in flight, if any; only run uses it.
+	stop context.CancelCauseFunc
+}
+
+func (ws *wsSession) run() {
+	ctx, cancel := context.WithCancel(ws.c.Request.Context())
+	defer cancel()
+	messages := make(chan wsClientMessage)
+	go ws.read(ctx, cancel, messages)
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	answered := make(chan struct{})
+	defer func() {
+		if ws.stop != nil {
+			// The connection is going away; wait for the answer to give up
+			// its upstream call.
+			cancel()
+			<-answered
+		}
+		addLogAttrs(ws.c, "ws_chats", ws.chats)
+	}()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			switch msg.Type {
+			case "", wsTypeChat:
+				if ws.stop != nil {
+					ws.sendError(newAPIError(codeChatInProgress, "an answer is already streaming on this connection; send stop first", nil))
+					continue
+				}
+				var chatCtx context.Context
+				chatCtx, ws.stop = context.WithCancelCause(ctx)
+				ws.chats++
+				go func() {
+					ws.answer(chatCtx, ctx, msg.ChatRequest)
+					answered <- struct{}{}
+				}()
+			case wsTypeStop:
+				if ws.stop != nil {
+					ws.stop(errChatStopped)
+				}
+			case wsTypePing:
+				ws.send(wsFrame{Type: wsTypePong})
+			default:
+				ws.sendError(newAPIError(codeInvalidBody, "unknown message type "+msg.Type, nil))
+			}
+		case <-answered:
+			ws.stop(nil)
+			ws.stop = nil
+		case <-ping.C:
+			ws.writeMu.Lock()
+			ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			_, err := ws.conn.Write(nil)
+			ws.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// read passes the client's messages to run, answering those that are not
+// JSON with an error frame. It closes messages, and cancels the connection,
+// once the client has closed it or it has failed.
+func (ws *wsSession) read(ctx context.Context, cancel context.CancelFunc, messages chan<- wsClientMessage) {
+	defer close(messages)
+	defer cancel()
+	for {
+		var msg wsClientMessage
+		err := websocket.JSON.Receive(ws.conn, &msg)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+			ws.sendError(newAPIError(codeInvalidBody, "message is not a valid JSON object: "+err.Error(), nil))
+			continue
+		case errors.Is(err, websocket.ErrFrameTooLarge):
+			ws.sendError(newAPIError(codeBodyTooLarge, "message too large", nil))
+			continue
+		case err != nil:
+			return
+		}
+		select {
+		case messages <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send writes one frame, closing the connection if the client cannot take
+// it in time.
+func (ws *wsSession) send(f wsFrame) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	err := websocket.JSON.Send(ws.conn, f)
+	if err != nil {
+		ws.conn.Close()
+	}
+	return err
+}
+
+func (ws *wsSession) sendError(e apiError) error {
+	return ws.send(wsFrame{Type: wsTypeError, Error: e.body(ws.c)["error"]})
+}
+
+// check applies /chat's validation, prompt budget and input moderation to
+// req, returning the error to send if it is refused.
+func (ws *wsSession) check(ctx context.Context, req ChatRequest) (apiError, bool) {
+	s := ws.s
+	errs := validateChatRequest(req, s.maxPromptChars)
+	if req.ResponseFormat == responseFormatJSON {
+		errs = append(errs, fieldError{"response_format", "json cannot be streamed; it is checked once the whole response is in"})
+	}
+	if len(errs) > 0 {
+		return newAPIError(codeValidationFailed, "invalid request", gin.H{"fields": errs}), false
+	}
+	if n, over := s.budget.exceeded(req); over {
+		return newAPIError(codePromptTooLong, s.budget.message(n), gin.H{
+			"measured": n,
+			"budget":   s.budget.max,
+			"unit":     s.budget.unit,
+		}), false
+	}
+	v, err := s.moderator.Moderate(ctx, req.UserPrompt)
+	if err != nil {
+		return newAPIError(codeModerationFailed, "moderation unavailable: "+err.Error(), nil), false
+	}
+	if !v.Allowed {
+		return newAPIError(codePromptBlocked, "prompt blocked by moderation", gin.H{"reason": v.Reason}), false
+	}
+	return apiError{}, true
+}
+
+// answer streams the answer to req under ctx, which a stop message cancels
+// with errChatStopped; connCtx is the connection's own context. Nothing
+// more is sent once the connection has gone.
+func (ws *wsSession) answer(ctx, connCtx context.Context, req ChatRequest) {
+	s := ws.s
+	// newRouter charges nothing for the handshake, so each message is
+	// charged on its own.
+	if e, ok := liveFrom(ctx).limiter.take(ws.c, 1); !ok {
+		ws.sendError(e)
+		return
+	}
+	if _, e, ok := s.quota.take(ws.c, 1); !ok {
+		ws.sendError(e)
+		return
+	}
+	s.filters.allowBypass(ws.c, &req)
+	e, ok := ws.check(ctx, req)
+	switch {
+	case errors.Is(context.Cause(ctx), errChatStopped):
+		ws.send(wsFrame{Type: wsTypeDone, Reason: wsDoneStopped})
+		return
+	case !ok:
+		ws.sendError(e)
+		return
+	}
+	upstreamReq, err := s.prompt.apply(liveFrom(ctx).systemPrompt.apply(req))
+	if err != nil {
+		ws.sendError(newAPIError(codePromptTemplate, err.Error(), nil))
+		return
+	}
+	upstreamReq = withHistory(upstreamReq, s.history.Get(ctx, req.ChatID))
+
+	start := time.Now()
+	var body io.ReadCloser
+	if isDryRun(ctx) {
+		body, err = dryRunStream(ctx, upstreamReq, s.dryRunLatency)
+	} else {
+		body, err = openModelStream(ctx, liveFrom(ctx).pool, upstreamReq)
+	}
+	if err != nil {
+		s.audit.record(ctx, upstreamReq, "", start, false, true, err)
+		ws.finish(ctx, connCtx, newStreamProgress("ws"), err)
+		return
+	}
+	defer body.Close()
+
+	buf := make([]byte, streamReadSize)
+	var pending []byte
+	var full strings.Builder
+	cutter := newStreamCutter(upstreamReq)
+	progress := newStreamProgress("ws")
+	send := func(text string) error {
+		if text == "" {
+			return nil
+		}
+		full.WriteString(text)
+		progress.sent(len(text))
+		return ws.send(wsFrame{Type: wsTypeToken, Text: text})
+	}
+	for {
+		n, readErr := body.Read(buf)
+		pending = append(pending, buf[:n]...)
+		var out string
+		complete := false
+		if cut := completeUTF8(pending); cut > 0 {
+			out, complete = cutter.push(string(pending[:cut]))
+			pending = append(pending[:0], pending[cut:]...)
+		}
+		if !complete && readErr == io.EOF {
+			rest, _ := cutter.push(string(pending))
+			out += rest + cutter.flush()
+			complete = true
+		}
+		if err := send(out); err != nil {
+			// The connection is closed; there is no one left to tell.
+			s.audit.record(ctx, upstreamReq, full.String(), start, false, true, err)
+			progress.interrupted(ws.c, streamCauseClient, err)
+			return
+		}
+		if complete {
+			s.audit.record(ctx, upstreamReq, full.String(), start, false, true, nil)
+			s.history.Append(connCtx, req.ChatID, turn{User: req.UserPrompt, Assistant: full.String()})
+			ws.send(wsFrame{Type: wsTypeDone, Reason: wsDoneComplete})
+			return
+		}
+		if readErr != nil {
+			s.audit.record(ctx, upstreamReq, full.String(), start, false, true, readErr)
+			ws.finish(ctx, connCtx, progress, readErr)
+			return
+		}
+	}
+}
+
+// finish ends an answer that did not complete: with a done frame if the
+// client stopped it, an error frame if the upstream failed, and nothing if
+// the connection has gone.
+func (ws *wsSession) finish(ctx, connCtx context.Context, progress *streamProgress, err error) {
+	switch {
+	case errors.Is(context.Cause(ctx), errChatStopped):
+		streamsInterrupted.WithLabelValues(progress.format, streamCauseStopped).Inc()
+		slog.Info("stream stopped", "request_id", requestIDFrom(ctx), "format", progress.format,
+			"chunks", progress.chunks, "bytes", progress.bytes, "elapsed_ms", time.Since(progress.start).Milliseconds())
+		ws.send(wsFrame{Type: wsTypeDone, Reason: wsDoneStopped})
+	case connCtx.Err() != nil:
+		progress.interrupted(ws.c, streamCauseClient, nil)
+	default:
+		cause := streamCauseUpstream
+		if errors.Is(err, context.DeadlineExceeded) {
+			cause = streamCauseDeadline
+		}
+		progress.interrupted(ws.c, cause, err)
+		ws.sendError(ws.s.upstreamError(ws.c, err))
+	}
+}
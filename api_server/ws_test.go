@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialChatWS serves r and opens /chat/ws on it as a client from the
+// server's own origin. Closing the server does not wait for hijacked
+// connections, so cleanup closes the connection and waits for the handler
+// to return before the next test installs its configuration.
+func dialChatWS(t *testing.T, r http.Handler) *websocket.Conn {
+	t.Helper()
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		r.ServeHTTP(w, req)
+	}))
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/chat/ws", "", srv.URL)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		handlers.Wait()
+		srv.Close()
+	})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// receiveFrame reads the next frame sent by the server.
+func receiveFrame(t *testing.T, conn *websocket.Conn) wsFrame {
+	t.Helper()
+	var f wsFrame
+	if err := websocket.JSON.Receive(conn, &f); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	return f
+}
+
+func TestChatWSStop(t *testing.T) {
+	// A dry-run answer that would take far longer than the test.
+	r, _ := newTestRouter(t, &fakeInferencer{}, map[string]string{
+		"INFER_DRY_RUN":         "true",
+		"INFER_DRY_RUN_LATENCY": "1m",
+	})
+	conn := dialChatWS(t, r)
+
+	websocket.JSON.Send(conn, wsClientMessage{ChatRequest: ChatRequest{ChatID: "c1", UserPrompt: "hello"}})
+	websocket.JSON.Send(conn, wsClientMessage{Type: wsTypeStop})
+	if f := receiveFrame(t, conn); f.Type != wsTypeDone || f.Reason != wsDoneStopped {
+		t.Fatalf("frame after stop = %+v, want done with reason %s", f, wsDoneStopped)
+	}
+	// The connection stays open for the next message.
+	websocket.JSON.Send(conn, wsClientMessage{Type: wsTypePing})
+	if f := receiveFrame(t, conn); f.Type != wsTypePong {
+		t.Errorf("frame after ping = %+v, want pong", f)
+	}
+}
+
+func TestChatWSRateLimitPerMessage(t *testing.T) {
+	r, _ := newTestRouter(t, &fakeInferencer{}, map[string]string{
+		"INFER_DRY_RUN":          "true",
+		"INFER_RATE_LIMIT_RPS":   "0.01",
+		"INFER_RATE_LIMIT_BURST": "1",
+	})
+	conn := dialChatWS(t, r)
+
+	// The handshake took no token, so the first chat gets the only one.
+	websocket.JSON.Send(conn, wsClientMessage{ChatRequest: ChatRequest{ChatID: "c1", UserPrompt: "hello"}})
+	var tokens int
+	for f := receiveFrame(t, conn); f.Type != wsTypeDone; f = receiveFrame(t, conn) {
+		if f.Type != wsTypeToken {
+			t.Fatalf("first chat got frame %+v, want tokens then done", f)
+		}
+		tokens++
+	}
+	if tokens == 0 {
+		t.Error("first chat got no tokens")
+	}
+
+	websocket.JSON.Send(conn, wsClientMessage{ChatRequest: ChatRequest{ChatID: "c1", UserPrompt: "again"}})
+	f := receiveFrame(t, conn)
+	if f.Type != wsTypeError {
+		t.Fatalf("second chat got frame %+v, want an error", f)
+	}
+	if e, _ := f.Error.(map[string]any); e["code"] != codeRateLimited {
+		t.Errorf("second chat error = %v, want %s", f.Error, codeRateLimited)
+	}
+}
@@ -1,5 +1,9 @@
-from transformers import AutoTokenizer, AutoModelForCausalLM
+from transformers import AutoTokenizer, AutoModelForCausalLM, TextIteratorStreamer
 from fastapi import FastAPI, Request
+from fastapi.responses import StreamingResponse
+from threading import Thread
+import gzip
+import json
 import torch
 import uvicorn
 
@@ -8,6 +12,33 @@ app = FastAPI()
 model_name = "HuggingFaceTB/SmolLM2-135M-Instruct"
 tokenizer = AutoTokenizer.from_pretrained(model_name)
 model = AutoModelForCausalLM.from_pretrained(model_name)
+if tokenizer.pad_token is None:
+    tokenizer.pad_token = tokenizer.eos_token
+# Batched generation needs prompts padded on the left.
+tokenizer.padding_side = "left"
+
+def build_prompt(data):
+    system_prompt = data.get("system_prompt", "")
+    if data.get("response_format") == "json":
+        system_prompt = (system_prompt + "\nRespond with a single valid JSON value and nothing else.").lstrip()
+    user_prompt = data.get("user_prompt", "")
+    return f"System-Prompt: {system_prompt}\nUser-Prompt: {user_prompt}\n Assistant-Answer: "
+
+def generation_kwargs(data):
+    kwargs = {"max_new_tokens": data.get("max_tokens") or 128}
+    if data.get("temperature"):
+        kwargs.update(do_sample=True, temperature=data["temperature"])
+    if data.get("top_p") is not None:
+        kwargs.update(do_sample=True, top_p=data["top_p"])
+    if data.get("stop"):
+        kwargs.update(stop_strings=data["stop"], tokenizer=tokenizer)
+    return kwargs
+
+async def read_json(request):
+    body = await request.body()
+    if request.headers.get("content-encoding", "").lower() == "gzip":
+        body = gzip.decompress(body)
+    return json.loads(body)
 
 @app.get("/")
 async def hello():
@@ -15,14 +46,47 @@ async def hello():
 
 @app.post("/infer")
 async def infer(request: Request):
-    data = await request.json()
-    system_prompt = data.get("system_prompt", "")
-    user_prompt = data.get("user_prompt", "")
-    prompt = f"System-Prompt: {system_prompt}\nUser-Prompt: {user_prompt}\n Assistant-Answer: "
-    inputs = tokenizer(prompt, return_tensors="pt")
-    outputs = model.generate(**inputs, max_new_tokens=128)
-    response = tokenizer.decode(outputs[0], skip_special_tokens=True)
-    return {"response": response}
+    data = await read_json(request)
+    inputs = tokenizer(build_prompt(data), return_tensors="pt")
+    outputs = model.generate(**inputs, **generation_kwargs(data))
+    prompt_tokens = inputs["input_ids"].shape[1]
+    # Decode only the new tokens, as /infer/stream does with skip_prompt.
+    response = tokenizer.decode(outputs[0][prompt_tokens:], skip_special_tokens=True)
+    return {
+        "response": response,
+        "model": model_name,
+        "usage": {"prompt_tokens": prompt_tokens, "completion_tokens": outputs.shape[1] - prompt_tokens},
+    }
+
+@app.post("/infer/stream")
+async def infer_stream(request: Request):
+    data = await read_json(request)
+    inputs = tokenizer(build_prompt(data), return_tensors="pt")
+    streamer = TextIteratorStreamer(tokenizer, skip_prompt=True, skip_special_tokens=True)
+    Thread(target=model.generate, kwargs=dict(**inputs, **generation_kwargs(data), streamer=streamer)).start()
+    return StreamingResponse(streamer, media_type="text/plain")
+
+@app.post("/infer/batch")
+async def infer_batch(request: Request):
+    data = await read_json(request)
+    queries = data["queries"]
+    # The API server only groups queries whose generation parameters match.
+    inputs = tokenizer([build_prompt(q) for q in queries], return_tensors="pt", padding=True)
+    outputs = model.generate(**inputs, **generation_kwargs(queries[0]))
+    # Prompts are left-padded to one length, so the answers all start there.
+    answers = outputs[:, inputs["input_ids"].shape[1]:]
+    return {"responses": [{"response": r} for r in tokenizer.batch_decode(answers, skip_special_tokens=True)]}
+
+@app.post("/embeddings")
+async def embeddings(request: Request):
+    data = await read_json(request)
+    inputs = tokenizer(data["inputs"], return_tensors="pt", padding=True, truncation=True)
+    with torch.no_grad():
+        hidden = model(**inputs, output_hidden_states=True).hidden_states[-1]
+    # Mean-pool the last hidden layer over non-padding tokens.
+    mask = inputs["attention_mask"].unsqueeze(-1)
+    pooled = (hidden * mask).sum(dim=1) / mask.sum(dim=1)
+    return {"embeddings": pooled.tolist()}
 
 if __name__ == "__main__":
     uvicorn.run(app, host="0.0.0.0", port=7860)